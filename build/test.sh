@@ -1,3 +1,3 @@
 #!/usr/bin/env bash
 set -e
-go test -v -cover -race `go list ./... | grep -v assets`
+go test -v -cover -race ./...
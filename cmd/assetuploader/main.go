@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"net/url"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
 
@@ -11,17 +15,238 @@ import (
 	"github.com/labstack/echo"
 	"github.com/tgracchus/assetuploader/pkg/assets"
 	"github.com/tgracchus/assetuploader/pkg/endpoints"
+	"github.com/tgracchus/assetuploader/pkg/job"
+	"github.com/tgracchus/assetuploader/pkg/schedule"
 )
 
 func main() {
+	pflag.String("storage", "s3", "storage backend, s3 or local")
 	pflag.String("region", "us-west-2", "aws region")
 	pflag.String("bucket", "dmc-asset-uploader-test", "aws bucket")
+	pflag.String("local-root", "data", "local storage root folder")
+	pflag.String("local-url", "http://localhost:8080", "local storage public url used in signed urls")
+	pflag.Int64("max-size", 0, "maximum size in bytes of an asset, 0 means no limit")
+	pflag.Int64("max-proxied-size", assets.DefaultMaxProxiedSize, "maximum size in bytes of the content put through the service when neither the asset nor --max-size limit it")
+	pflag.StringSlice("content-types", nil, "allowed content types of an asset, empty means any")
+	pflag.Duration("purge-delay", 7*24*time.Hour, "how long deleted assets can be restored before being purged")
+	pflag.Duration("gc-period", time.Hour, "how often abandoned and promoted objects are collected, 0 disables it")
+	pflag.Duration("gc-retention", 24*time.Hour, "how long after its urls expiration a not uploaded asset is collected")
+	pflag.Bool("gc-dry-run", false, "only log the objects the garbage collection would remove")
+	pflag.String("state-dir", "assets", "folder keeping the lifecycle state of the assets, a file per asset, empty keeps it in memory")
+	pflag.String("webhook-file", "webhooks.json", "file keeping the registered webhooks, empty keeps them in memory")
+	pflag.Int("webhook-attempts", 5, "how many times a webhook delivery is attempted before failing")
+	pflag.Duration("webhook-backoff", 30*time.Second, "how long after the first failed attempt a webhook delivery is retried, doubled on every retry")
+	pflag.Int("webhook-workers", 4, "how many webhook deliveries are attempted at the same time")
+	pflag.StringSlice("webhook-allowed-hosts", nil, "webhook hosts called back even if they resolve to a loopback, private or link-local address")
+	pflag.Duration("upload-expiration", assets.DefaultUploadExpiration, "how long the upload urls are valid when no expiration is requested")
+	pflag.Duration("upload-expiration-min", time.Second, "minimum expiration of the upload urls, shorter requested ones are raised to it")
+	pflag.Duration("upload-expiration-max", assets.MaxPresignExpiration, "maximum expiration of the upload urls, longer requested ones are lowered to it")
+	pflag.Duration("download-expiration", assets.DefaultDownloadExpiration, "how long the download urls are valid when no expiration is requested")
+	pflag.Duration("download-expiration-min", time.Second, "minimum expiration of the download urls, shorter requested ones are raised to it")
+	pflag.Duration("download-expiration-max", assets.MaxPresignExpiration, "maximum expiration of the download urls, longer requested ones are lowered to it")
+	pflag.String("encryption", "", "server side encryption of the assets which do not request one, SSE-S3, SSE-KMS or SSE-C, empty leaves it to the bucket")
+	pflag.String("kms-key-id", "", "kms key of the default SSE-KMS encryption, empty uses the s3 managed one")
+	pflag.String("sse-c-keys", "", "json file with the base64 encoded SSE-C keys by id, empty allows no SSE-C encryption")
+	pflag.String("sse-c-key-id", "", "SSE-C key of the default SSE-C encryption")
+	pflag.String("tenants-file", "", "json file with the tenants, identified by their api keys, and their buckets, prefixes and regions; empty serves every request with --bucket")
+	pflag.String("storage-class", "", "storage class the assets are promoted to when no rule applies, empty leaves it to the bucket")
+	pflag.StringSlice("storage-class-rules", nil, "storage classes by asset size as minSize=CLASS, the one with the greatest size not over the asset size applies")
+	pflag.Duration("archive-after", 0, "how long after being uploaded an asset is moved to the archive storage class, 0 disables it")
+	pflag.String("archive-class", string(assets.StorageClassGlacier), "archive storage class, GLACIER or DEEP_ARCHIVE")
+	pflag.Duration("archive-period", time.Hour, "how often the assets to archive are looked for")
+	pflag.Duration("restore-check-period", assets.DefaultRestoreCheckPeriod, "how often the progress of the restore of an archived asset is checked")
+	pflag.Duration("watch-period", time.Minute, "how often uploaded objects are looked for to mark their assets as uploaded, 0 disables it")
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.BindPFlags(pflag.CommandLine)
 	pflag.Parse()
-	region := viper.GetString("region")
-	bucket := viper.GetString("bucket")
+	e := echo.New()
+	e.HTTPErrorHandler = endpoints.AssetUploaderHTTPErrorHandler
+	var localStorage *assets.LocalStorage
+	switch storageType := viper.GetString("storage"); storageType {
+	case "s3":
+	case "local":
+		localStorage = newLocalStorage(viper.GetString("local-root"), viper.GetString("local-url"))
+		endpoints.RegisterLocalStorageEndpoints(e, localStorage)
+	default:
+		panic("Unknown storage " + storageType)
+	}
+	newStorage := func(region string) assets.Storage {
+		if localStorage != nil {
+			return localStorage
+		}
+		return newS3Storage(region)
+	}
+	encryption := assets.Encryption{
+		Mode:          assets.EncryptionMode(viper.GetString("encryption")),
+		KMSKeyID:      viper.GetString("kms-key-id"),
+		CustomerKeyID: viper.GetString("sse-c-key-id"),
+	}
+	if encryption.Mode != assets.EncryptionNone && localStorage != nil {
+		panic("Encryption is only supported by the s3 storage")
+	}
+	var customerKeys map[string][]byte
+	if keysFile := viper.GetString("sse-c-keys"); keysFile != "" {
+		var err error
+		customerKeys, err = assets.ReadCustomerKeys(keysFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if _, ok := customerKeys[encryption.CustomerKeyID]; encryption.Mode == assets.EncryptionCustomer && !ok {
+		panic("SSE-C key " + encryption.CustomerKeyID + " should be present in the sse-c-keys file")
+	}
+	storageClassPolicy := newStorageClassPolicy()
+	archiveClass, err := assets.ParseStorageClass(viper.GetString("archive-class"))
+	if err != nil {
+		panic(err)
+	}
+	if !archiveClass.Archived() {
+		panic("Archive class " + string(archiveClass) + " should be an archive one")
+	}
+	tiered := storageClassPolicy.Default != assets.StorageClassDefault || len(storageClassPolicy.Rules) > 0 || viper.GetDuration("archive-after") > 0
+	if tiered && localStorage != nil {
+		panic("Storage classes are only supported by the s3 storage")
+	}
+	policy := assets.UploadPolicy{MaxSize: viper.GetInt64("max-size"), ContentTypes: viper.GetStringSlice("content-types")}
+	options := []assets.Option{
+		assets.WithUploadPolicy(policy),
+		assets.WithMaxProxiedSize(viper.GetInt64("max-proxied-size")),
+		assets.WithEncryption(encryption),
+		assets.WithCustomerKeys(customerKeys),
+		assets.WithStorageClassPolicy(storageClassPolicy),
+		assets.WithArchive(viper.GetDuration("archive-after"), archiveClass),
+		assets.WithRestoreCheckPeriod(viper.GetDuration("restore-check-period")),
+		assets.WithPurgeDelay(viper.GetDuration("purge-delay")),
+		assets.WithGarbageRetention(viper.GetDuration("gc-retention")),
+		assets.WithUploadExpirationBounds(assets.ExpirationBounds{
+			Min: viper.GetDuration("upload-expiration-min"),
+			Max: viper.GetDuration("upload-expiration-max"),
+		}),
+		assets.WithDownloadExpiration(viper.GetDuration("download-expiration"), assets.ExpirationBounds{
+			Min: viper.GetDuration("download-expiration-min"),
+			Max: viper.GetDuration("download-expiration-max"),
+		}),
+	}
+	var tenants *endpoints.TenantRouter
+	if tenantsFile := viper.GetString("tenants-file"); tenantsFile == "" {
+		// Without tenants, every request is served with the bucket of the flags
+		storage := newStorage(viper.GetString("region"))
+		tenants = endpoints.NewSingleTenantRouter(newTenant("", viper.GetString("bucket"), storage, options))
+	} else {
+		configured, err := assets.ReadTenants(tenantsFile)
+		if err != nil {
+			panic(err)
+		}
+		tenants = endpoints.NewTenantRouter()
+		for _, tenant := range configured {
+			region := tenant.Region
+			if region == "" {
+				region = viper.GetString("region")
+			}
+			storage := assets.NewPrefixedStorage(newStorage(region), tenant.Prefix)
+			tenants.Add(newTenant(tenant.ID, tenant.Bucket, storage, options), tenant.APIKeys...)
+		}
+	}
+	endpoints.RegisterAssetsEndpoints(e, tenants)
+	endpoints.RegisterTusEndpoints(e, tenants, viper.GetInt64("max-size"))
+	endpoints.RegisterWebhookEndpoints(e, tenants)
+	endpoints.RegisterHealthCheck(e, tenants)
+	e.Logger.Fatal(e.Start(":8080"))
+}
+
+// newTenant creates the manager of the assets of a tenant, isolated from the other tenants with its own state, webhooks and jobs.
+func newTenant(id string, bucket string, storage assets.Storage, options []assets.Option) *endpoints.Tenant {
+	repository := assets.NewMemoryRepository()
+	if stateDir := viper.GetString("state-dir"); stateDir != "" {
+		var err error
+		repository, err = assets.NewFileRepository(tenantFile(stateDir, id))
+		if err != nil {
+			panic(err)
+		}
+	}
+	// Deliveries are retried as jobs of the same scheduler as the asset lifecycle
+	upsert, query := job.NewMemoryStore(job.MinutesKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, 30*time.Second)
+	webhookOptions := []assets.WebhookOption{
+		assets.WithDeliveryAttempts(viper.GetInt("webhook-attempts")),
+		assets.WithDeliveryBackoff(viper.GetDuration("webhook-backoff")),
+		assets.WithDeliveryWorkers(viper.GetInt("webhook-workers")),
+		assets.WithAllowedHosts(viper.GetStringSlice("webhook-allowed-hosts")...),
+	}
+	// Only one notifier is created, since each one starts its delivery workers
+	var notifier *assets.WebhookNotifier
+	if webhookFile := viper.GetString("webhook-file"); webhookFile != "" {
+		var err error
+		notifier, err = assets.NewFileWebhookNotifier(tenantFile(webhookFile, id), scheduler, webhookOptions...)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		notifier = assets.NewWebhookNotifier(scheduler, webhookOptions...)
+	}
+	options = append([]assets.Option{assets.WithRepository(repository), assets.WithNotifier(notifier)}, options...)
+	manager := assets.NewAssetManager(storage, scheduler, viper.GetDuration("upload-expiration"), options...)
+	if gcPeriod := viper.GetDuration("gc-period"); gcPeriod > 0 {
+		err := manager.ScheduleGarbageCollection(context.Background(), bucket, gcPeriod, viper.GetBool("gc-dry-run"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	if watchPeriod := viper.GetDuration("watch-period"); watchPeriod > 0 {
+		err := manager.ScheduleUploadWatcher(context.Background(), bucket, watchPeriod)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if viper.GetDuration("archive-after") > 0 {
+		err := manager.ScheduleArchive(context.Background(), bucket, viper.GetDuration("archive-period"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	// The restores requested before a restart are checked even if the archive is not scheduled anymore
+	err := manager.ResumeRestores(context.Background(), bucket)
+	if err != nil {
+		panic(err)
+	}
+	// The purges of the assets deleted before a restart are scheduled again
+	err = manager.ResumePurges(context.Background(), bucket)
+	if err != nil {
+		panic(err)
+	}
+	return &endpoints.Tenant{ID: id, Bucket: bucket, Storage: storage, Manager: manager, Notifier: notifier}
+}
+
+// newStorageClassPolicy returns the storage class policy of the flags, which can not archive the assets at promotion.
+func newStorageClassPolicy() assets.StorageClassPolicy {
+	defaultClass, err := assets.ParseStorageClass(viper.GetString("storage-class"))
+	if err != nil {
+		panic(err)
+	}
+	rules, err := assets.ParseStorageClassRules(viper.GetStringSlice("storage-class-rules"))
+	if err != nil {
+		panic(err)
+	}
+	policy := assets.StorageClassPolicy{Default: defaultClass, Rules: rules}
+	for _, rule := range append(rules, assets.StorageClassRule{StorageClass: defaultClass}) {
+		if rule.StorageClass.Archived() {
+			panic("Storage class " + string(rule.StorageClass) + " is an archive one, assets are archived with --archive-after")
+		}
+	}
+	return policy
+}
+
+// tenantFile returns the file, or folder, of a tenant, named after it so tenants do not share it, or the file itself without tenants.
+func tenantFile(path string, id string) string {
+	if id == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + id + ext
+}
+
+func newS3Storage(region string) assets.Storage {
 	// Setted as env variables only, so we dont see credentials in cmd history
 	awsKey := viper.GetString("AWS_ACCESS_KEY_ID")
 	if awsKey == "" {
@@ -31,17 +256,27 @@ func main() {
 	if awsSecret == "" {
 		panic("AWS_SECRET_ACCESS_KEY should be present in env vars")
 	}
-
-	e := echo.New()
-	e.HTTPErrorHandler = endpoints.AssetUploaderHTTPErrorHandler
 	credentials := credentials.NewStaticCredentials(awsKey, awsSecret, "")
 	session, err := assets.NewAwsSession(credentials, region)
 	if err != nil {
 		panic(err)
 	}
-	svc := assets.NewS3Client(session, region)
-	manager := assets.NewDefaultFileManager(svc)
-	endpoints.RegisterAssetsEndpoints(e, manager, bucket)
-	endpoints.RegisterHealthCheck(e, svc, bucket)
-	e.Logger.Fatal(e.Start(":8080"))
+	return assets.NewS3Storage(assets.NewS3Client(session, region))
+}
+
+func newLocalStorage(root string, localURL string) *assets.LocalStorage {
+	// Setted as env variable only, so we dont see the secret in cmd history
+	secret := viper.GetString("LOCAL_STORAGE_SECRET")
+	if secret == "" {
+		panic("LOCAL_STORAGE_SECRET should be present in env vars")
+	}
+	baseURL, err := url.Parse(localURL)
+	if err != nil {
+		panic(err)
+	}
+	storage, err := assets.NewLocalStorage(root, baseURL, []byte(secret))
+	if err != nil {
+		panic(err)
+	}
+	return storage
 }
@@ -1,13 +1,24 @@
 package assets
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/tgracchus/assetuploader/pkg/auerr"
 )
 
+var emptyCredentials = credentials.Credentials{}
+
 // NewAwsSession creates a new AWS session from the given credentials.
 func NewAwsSession(cred *credentials.Credentials, region string) (*session.Session, error) {
 	if cred == nil {
@@ -27,3 +38,436 @@ func NewAwsSession(cred *credentials.Credentials, region string) (*session.Sessi
 func NewS3Client(sess *session.Session, region string) *s3.S3 {
 	return s3.New(sess, aws.NewConfig().WithRegion(region))
 }
+
+// NewS3ClientWithEndpoint creates a new AWS s3 from the session pointing to an s3 compatible endpoint with path style urls.
+func NewS3ClientWithEndpoint(sess *session.Session, region string, endpoint string) *s3.S3 {
+	return s3.New(sess, aws.NewConfig().WithRegion(region).WithEndpoint(endpoint).WithS3ForcePathStyle(true))
+}
+
+// NewS3Storage creates a Storage backed by AWS s3.
+func NewS3Storage(svc *s3.S3) Storage {
+	return &s3Storage{svc: svc}
+}
+
+type s3Storage struct {
+	svc *s3.S3
+}
+
+func (s *s3Storage) PresignPut(ctx context.Context, bucket string, key string, expiration time.Duration, constraints PutConstraints) (*url.URL, error) {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	// Both headers end up in the signed headers, so s3 rejects puts which do not match them
+	if constraints.ContentType != "" {
+		input.ContentType = aws.String(constraints.ContentType)
+	}
+	if constraints.ContentLength > 0 {
+		input.ContentLength = aws.Int64(constraints.ContentLength)
+	}
+	// s3 checks the content against both digests, which are signed too
+	if constraints.Checksum.MD5 != "" {
+		input.ContentMD5 = aws.String(constraints.Checksum.MD5)
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = sseFields(constraints.Encryption)
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(constraints.Encryption)
+	req, _ := s.svc.PutObjectRequest(input)
+	if constraints.Checksum.SHA256 != "" {
+		req.HTTPRequest.Header.Set("X-Amz-Content-Sha256", constraints.Checksum.SHA256)
+	}
+	return presign(req, expiration)
+}
+
+func (s *s3Storage) PresignGet(ctx context.Context, bucket string, key string, expiration time.Duration, encryption Encryption) (*url.URL, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	req, _ := s.svc.GetObjectRequest(input)
+	return presign(req, expiration)
+}
+
+func presign(req *request.Request, expiration time.Duration) (*url.URL, error) {
+	signedURLString, err := req.Presign(expiration)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	signedURL, err := url.Parse(signedURLString)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return signedURL, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, bucket string, key string, body io.ReadSeeker, tags map[string]string, encryption Encryption) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if len(tags) > 0 {
+		input.Tagging = aws.String(encodeTags(tags))
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = sseFields(encryption)
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	_, err := s.svc.PutObjectWithContext(ctx, input)
+	return handleAwsError(err, bucket, key)
+}
+
+func (s *s3Storage) Get(ctx context.Context, bucket string, key string, encryption Encryption) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	result, err := s.svc.GetObjectWithContext(ctx, input)
+	err = handleAwsError(err, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+func (s *s3Storage) GetRange(ctx context.Context, bucket string, key string, offset int64, length int64, encryption Encryption) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	result, err := s.svc.GetObjectWithContext(ctx, input)
+	err = handleAwsError(err, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+func (s *s3Storage) Tags(ctx context.Context, bucket string, key string) (map[string]string, error) {
+	result, err := s.svc.GetObjectTaggingWithContext(
+		ctx,
+		&s3.GetObjectTaggingInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		},
+	)
+	err = handleAwsError(err, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(result.TagSet))
+	for _, tag := range result.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
+// maxCopyObjectSize is the biggest object s3 can copy in a single request, bigger ones are copied by parts.
+var maxCopyObjectSize int64 = 5 * 1024 * 1024 * 1024
+
+// copyPartSize is the size of each part when copying big objects.
+var copyPartSize int64 = 512 * 1024 * 1024
+
+func (s *s3Storage) SetTags(ctx context.Context, bucket string, key string, tags map[string]string) error {
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	_, err := s.svc.PutObjectTaggingWithContext(
+		ctx,
+		&s3.PutObjectTaggingInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Tagging: &s3.Tagging{TagSet: tagSet},
+		},
+	)
+	return handleAwsError(err, bucket, key)
+}
+
+func (s *s3Storage) Copy(ctx context.Context, bucket string, srcKey string, dstKey string, tags map[string]string, encryption Encryption, storageClass StorageClass) error {
+	info, err := s.Head(ctx, bucket, srcKey, encryption)
+	if err != nil {
+		return err
+	}
+	if info.Size > maxCopyObjectSize {
+		return s.copyByParts(ctx, bucket, srcKey, dstKey, tags, info.Size, encryption, storageClass)
+	}
+	// s3 does not keep the encryption of the source, it is set again for the copy
+	input := &s3.CopyObjectInput{
+		CopySource:       aws.String(bucket + "/" + srcKey),
+		Bucket:           aws.String(bucket),
+		Key:              aws.String(dstKey),
+		Tagging:          aws.String(encodeTags(tags)),
+		TaggingDirective: aws.String(s3.TaggingDirectiveReplace),
+		StorageClass:     storageClassField(storageClass),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = sseFields(encryption)
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = customerFields(encryption)
+	_, err = s.svc.CopyObjectWithContext(ctx, input)
+	return handleAwsError(err, bucket, srcKey)
+}
+
+func (s *s3Storage) copyByParts(ctx context.Context, bucket string, srcKey string, dstKey string, tags map[string]string, size int64, encryption Encryption, storageClass StorageClass) error {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(dstKey),
+		Tagging:      aws.String(encodeTags(tags)),
+		StorageClass: storageClassField(storageClass),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = sseFields(encryption)
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	created, err := s.svc.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return handleAwsError(err, bucket, dstKey)
+	}
+	parts := make([]*s3.CompletedPart, 0, size/copyPartSize+1)
+	for start := int64(0); start < size; start += copyPartSize {
+		end := start + copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		partNumber := int64(len(parts) + 1)
+		partInput := &s3.UploadPartCopyInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(dstKey),
+			CopySource:      aws.String(bucket + "/" + srcKey),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber:      aws.Int64(partNumber),
+			UploadId:        created.UploadId,
+		}
+		partInput.SSECustomerAlgorithm, partInput.SSECustomerKey = customerFields(encryption)
+		partInput.CopySourceSSECustomerAlgorithm, partInput.CopySourceSSECustomerKey = customerFields(encryption)
+		part, err := s.svc.UploadPartCopyWithContext(ctx, partInput)
+		if err != nil {
+			s.AbortMultipartUpload(ctx, bucket, dstKey, aws.StringValue(created.UploadId))
+			return handleAwsError(err, bucket, srcKey)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(partNumber)})
+	}
+	return s.complete(ctx, bucket, dstKey, aws.StringValue(created.UploadId), parts)
+}
+
+func (s *s3Storage) Head(ctx context.Context, bucket string, key string, encryption Encryption) (*ObjectInfo, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	result, err := s.svc.HeadObjectWithContext(ctx, input)
+	err = handleAwsError(err, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Size:         aws.Int64Value(result.ContentLength),
+		ContentType:  aws.StringValue(result.ContentType),
+		ETag:         aws.StringValue(result.ETag),
+		LastModified: aws.TimeValue(result.LastModified),
+		StorageClass: StorageClass(aws.StringValue(result.StorageClass)),
+		// The restore header is like ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+		Restoring: strings.Contains(aws.StringValue(result.Restore), `ongoing-request="true"`),
+		Restored:  strings.Contains(aws.StringValue(result.Restore), `ongoing-request="false"`),
+	}, nil
+}
+
+func (s *s3Storage) RestoreArchived(ctx context.Context, bucket string, key string, days int64) error {
+	_, err := s.svc.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(days),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(s3.TierStandard)},
+		},
+	})
+	if awsErr, ok := err.(awserr.RequestFailure); ok && awsErr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return handleAwsError(err, bucket, key)
+}
+
+func (s *s3Storage) List(ctx context.Context, bucket string, prefix string, startAfter string, limit int64) ([]string, bool, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(limit),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	result, err := s.svc.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, false, handleAwsError(err, bucket, prefix)
+	}
+	keys := make([]string, 0, len(result.Contents))
+	for _, object := range result.Contents {
+		keys = append(keys, aws.StringValue(object.Key))
+	}
+	return keys, aws.BoolValue(result.IsTruncated), nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, bucket string, key string) error {
+	_, err := s.svc.DeleteObjectWithContext(
+		ctx,
+		&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		},
+	)
+	return handleAwsError(err, bucket, key)
+}
+
+func (s *s3Storage) CreateMultipartUpload(ctx context.Context, bucket string, key string, contentType string, encryption Encryption) (string, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = sseFields(encryption)
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	created, err := s.svc.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return "", handleAwsError(err, bucket, key)
+	}
+	return aws.StringValue(created.UploadId), nil
+}
+
+func (s *s3Storage) PresignUploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, expiration time.Duration, encryption Encryption) (*url.URL, error) {
+	input := &s3.UploadPartInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int64(partNumber),
+	}
+	// Only the SSE-C key is sent with every part, the rest of the encryption is the one of the upload
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	req, _ := s.svc.UploadPartRequest(input)
+	return presign(req, expiration)
+}
+
+func (s *s3Storage) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, body io.ReadSeeker, encryption Encryption) error {
+	input := &s3.UploadPartInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int64(partNumber),
+		Body:       body,
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = customerFields(encryption)
+	_, err := s.svc.UploadPartWithContext(ctx, input)
+	return handleAwsError(err, bucket, key)
+}
+
+func (s *s3Storage) CompleteMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	parts := make([]*s3.CompletedPart, 0)
+	err := s.svc.ListPartsPagesWithContext(
+		ctx,
+		&s3.ListPartsInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		},
+		func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, part := range page.Parts {
+				parts = append(parts, &s3.CompletedPart{ETag: part.ETag, PartNumber: part.PartNumber})
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return handleAwsError(err, bucket, key)
+	}
+	if len(parts) == 0 {
+		return auerr.FError(auerr.ErrorBadInput, "No parts have been uploaded for %s/%s", bucket, key)
+	}
+	return s.complete(ctx, bucket, key, uploadID, parts)
+}
+
+func (s *s3Storage) complete(ctx context.Context, bucket string, key string, uploadID string, parts []*s3.CompletedPart) error {
+	_, err := s.svc.CompleteMultipartUploadWithContext(
+		ctx,
+		&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(key),
+			UploadId:        aws.String(uploadID),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		},
+	)
+	return handleAwsError(err, bucket, key)
+}
+
+func (s *s3Storage) AbortMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	_, err := s.svc.AbortMultipartUploadWithContext(
+		ctx,
+		&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		},
+	)
+	return handleAwsError(err, bucket, key)
+}
+
+func (s *s3Storage) CheckBucket(ctx context.Context, bucket string) error {
+	_, err := s.svc.GetBucketLocationWithContext(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	return handleAwsError(err, bucket, "")
+}
+
+// sseFields returns the server side encryption and kms key of the requests writing an object, nil if not encrypted by s3 keys.
+func sseFields(encryption Encryption) (*string, *string) {
+	switch encryption.Mode {
+	case EncryptionS3:
+		return aws.String(s3.ServerSideEncryptionAes256), nil
+	case EncryptionKMS:
+		if encryption.KMSKeyID == "" {
+			return aws.String(s3.ServerSideEncryptionAwsKms), nil
+		}
+		return aws.String(s3.ServerSideEncryptionAwsKms), aws.String(encryption.KMSKeyID)
+	}
+	return nil, nil
+}
+
+// customerFields returns the SSE-C algorithm and key of the requests on an object, nil if not encrypted with a customer key.
+// The sdk encodes the key and adds its md5.
+func customerFields(encryption Encryption) (*string, *string) {
+	if encryption.Mode != EncryptionCustomer {
+		return nil, nil
+	}
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(string(encryption.CustomerKey))
+}
+
+// storageClassField returns the storage class of the requests writing an object, nil for the default one of the bucket.
+func storageClassField(storageClass StorageClass) *string {
+	if storageClass == StorageClassDefault {
+		return nil
+	}
+	return aws.String(string(storageClass))
+}
+
+func encodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+func handleAwsError(err error, bucket string, key string) error {
+	if err != nil {
+		if awsErr, ok := err.(awserr.RequestFailure); ok {
+			switch code := awsErr.StatusCode(); {
+			case code == 404:
+				return auerr.FError(auerr.ErrorNotFound, "Object %s/%s is not found", bucket, key)
+			case awsErr.Code() == "InvalidObjectState":
+				return auerr.FError(auerr.ErrorConflict, "Object %s/%s is archived", bucket, key)
+			default:
+				return auerr.CError(auerr.ErrorInternalError, err)
+			}
+		}
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package assets
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// Content is an uploaded asset ready to be streamed through the service.
+type Content struct {
+	// Body reads the content, it should be closed after reading it.
+	Body        ReadSeekCloser
+	Size        int64
+	ContentType string
+	// ETag is quoted, as in the ETag header, empty if unknown.
+	ETag         string
+	LastModified time.Time
+	Metadata     Metadata
+}
+
+func (ps *assetManager) GetContent(ctx context.Context, bucket string, assetID uuid.UUID) (*Content, error) {
+	record, err := ps.checkIsUploaded(ctx, bucket, assetID)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := ps.withKey(record.Constraints.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	key := uploadedPath + assetID.String()
+	info, err := ps.storage.Head(ctx, bucket, key, encryption)
+	if err != nil {
+		return nil, ps.assetError(err, assetID)
+	}
+	ps.reads.add(recordKey(bucket, assetID), EventContentRequested, "")
+	etag := info.ETag
+	if etag != "" && !strings.HasPrefix(etag, `"`) {
+		etag = `"` + etag + `"`
+	}
+	return &Content{
+		Body:         &contentReader{ctx: ctx, storage: ps.storage, bucket: bucket, key: key, encryption: encryption, size: info.Size},
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         etag,
+		LastModified: info.LastModified,
+		Metadata:     record.Metadata,
+	}, nil
+}
+
+// ReadSeekCloser reads a content from any offset.
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// contentReader reads the content of an object from the storage, from wherever it is seeked to.
+// Seeking is free, the object is only read from the storage once it is read from the new offset.
+type contentReader struct {
+	ctx        context.Context
+	storage    Storage
+	bucket     string
+	key        string
+	encryption Encryption
+	size       int64
+	offset     int64
+	// body reads the object from offset to its end, nil until read
+	body io.ReadCloser
+}
+
+func (r *contentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.storage.GetRange(r.ctx, r.bucket, r.key, r.offset, r.size-r.offset, r.encryption)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		return n, auerr.FError(auerr.ErrorInternalError, "Object %s/%s ended at %d bytes, not %d", r.bucket, r.key, r.offset, r.size)
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next read, relative to the start, the current offset or the end.
+func (r *contentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, auerr.FError(auerr.ErrorBadInput, "Offset %d is before the start", offset)
+	}
+	if offset != r.offset {
+		err := r.Close()
+		if err != nil {
+			return 0, err
+		}
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+// Close releases the object being read, if any.
+func (r *contentReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return nil
+}
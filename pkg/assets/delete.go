@@ -0,0 +1,144 @@
+package assets
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+	"github.com/tgracchus/assetuploader/pkg/job"
+)
+
+// WithPurgeDelay sets how long after being deleted the objects of an asset are removed, it can be restored meanwhile.
+func WithPurgeDelay(delay time.Duration) Option {
+	return func(manager *assetManager) {
+		manager.purgeDelay = delay
+	}
+}
+
+func (ps *assetManager) Delete(ctx context.Context, bucket string, assetID uuid.UUID) error {
+	record, err := ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		if record.State == StateDeleted {
+			return auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", assetID.String())
+		}
+		now := time.Now().UTC()
+		record.addEvent(EventDeleted, now, "")
+		return record.moveTo(StateDeleted, now)
+	})
+	if err != nil {
+		return err
+	}
+	ps.waiters.wake(recordKey(bucket, assetID))
+	ps.notify(ctx, record, EventDeleted, "")
+	return ps.schedulePurge(ctx, bucket, assetID, record.DeletedAt())
+}
+
+// schedulePurge schedules the purge of a deleted asset at the end of its grace period.
+// Every deletion has its own purge job, which only purges if the asset was not restored since.
+func (ps *assetManager) schedulePurge(ctx context.Context, bucket string, assetID uuid.UUID, deletedAt time.Time) error {
+	purgeJob := job.NewFixedDateJob(
+		assetID.String()+"-purge-"+deletedAt.Format(time.RFC3339Nano),
+		ps.newPurgeFunction(bucket, assetID, deletedAt),
+		deletedAt.Add(ps.purgeDelay),
+	)
+	return ps.scheduler.Schedule(ctx, *purgeJob)
+}
+
+func (ps *assetManager) ResumePurges(ctx context.Context, bucket string) error {
+	return ps.listRecords(ctx, bucket, func(record *AssetRecord) error {
+		if record.State != StateDeleted {
+			return nil
+		}
+		// The job is named after the deletion date, so it replaces the one still scheduled, if any
+		return ps.schedulePurge(ctx, bucket, record.ID, record.DeletedAt())
+	})
+}
+
+func (ps *assetManager) Restore(ctx context.Context, bucket string, assetID uuid.UUID) (AssetState, error) {
+	record, err := ps.repository.Get(ctx, bucket, assetID)
+	if err != nil {
+		return "", err
+	}
+	if record.State == StateArchived || record.State == StateRestoring {
+		return ps.restoreArchived(ctx, bucket, assetID)
+	}
+	now := time.Now().UTC()
+	record, err = ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		if record.State != StateDeleted {
+			return auerr.FError(auerr.ErrorConflict, "Asset %s is neither deleted nor archived", assetID.String())
+		}
+		state := record.restoreState()
+		switch state {
+		case StateProcessing:
+			// Its promotion was stopped by the deletion, so it is promoted again
+			state = StateUploading
+			record.PromoteAt = now
+		case StateUploading:
+			if record.PromoteAt.Before(now) {
+				record.PromoteAt = now
+			}
+		case StateRestoring:
+			// Its restore check was dropped by the deletion, so it is checked again
+			record.RestoreCheckAt = now
+		}
+		record.addEvent(EventRestored, now, "")
+		return record.moveTo(state, now)
+	})
+	if err != nil {
+		return "", err
+	}
+	return record.State, ps.resumeRestored(ctx, bucket, record, now)
+}
+
+// resumeRestored schedules the job a restored asset waits for, if it may have run while the asset was deleted.
+// The promotion of an asset restored before its date is still scheduled.
+func (ps *assetManager) resumeRestored(ctx context.Context, bucket string, record *AssetRecord, restoredAt time.Time) error {
+	switch {
+	case record.State == StateUploading && record.PromoteAt.Equal(restoredAt):
+		promoteJob := job.NewFixedDateJob(
+			record.ID.String()+"-restored-"+restoredAt.Format(time.RFC3339Nano),
+			ps.newUploadedFunction(bucket, record.ID),
+			restoredAt,
+		)
+		return ps.scheduler.Schedule(ctx, *promoteJob)
+	case record.State == StateRestoring:
+		return ps.scheduleRestoreCheck(ctx, bucket, record.ID, record.RestoreCheckAt)
+	}
+	return nil
+}
+
+func (ps *assetManager) newPurgeFunction(bucket string, assetID uuid.UUID, deletedAt time.Time) job.Function {
+	return func(ctx context.Context) error {
+		record, err := ps.repository.Get(ctx, bucket, assetID)
+		if auerr.Is(err, auerr.ErrorNotFound) {
+			// Already purged
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !record.DeletedAt().Equal(deletedAt) {
+			// Restored, or deleted again and purged by a later job
+			return nil
+		}
+		if record.UploadID != "" {
+			err = ps.storage.AbortMultipartUpload(ctx, bucket, temporalPath+assetID.String(), record.UploadID)
+			if err != nil && !auerr.Is(err, auerr.ErrorNotFound) {
+				return err
+			}
+		}
+		for _, path := range []string{temporalPath, pendingPath, uploadedPath} {
+			err = ps.storage.Delete(ctx, bucket, path+assetID.String())
+			if err != nil {
+				return err
+			}
+		}
+		// The record goes last, so the asset is still deleted if the purge fails in between
+		err = ps.repository.Delete(ctx, bucket, assetID)
+		if err != nil {
+			return err
+		}
+		ps.reads.remove(recordKey(bucket, assetID))
+		return nil
+	}
+}
@@ -0,0 +1,143 @@
+package assets
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// EncryptionMode is how the content of an asset is encrypted at rest by the storage.
+type EncryptionMode string
+
+const (
+	// EncryptionNone leaves the content to the default encryption of the bucket.
+	EncryptionNone EncryptionMode = ""
+	// EncryptionS3 encrypts the content with keys managed by s3.
+	EncryptionS3 EncryptionMode = "SSE-S3"
+	// EncryptionKMS encrypts the content with a kms key.
+	EncryptionKMS EncryptionMode = "SSE-KMS"
+	// EncryptionCustomer encrypts the content with a customer provided key, which every request of the content has to send.
+	// The keys are held by the service and never shared, so the content is only uploaded and downloaded through it.
+	EncryptionCustomer EncryptionMode = "SSE-C"
+)
+
+// CustomerKeySize is the size of the SSE-C keys, 256 bits.
+const CustomerKeySize = 32
+
+const sseHeader = "X-Amz-Server-Side-Encryption"
+const sseKMSKeyIDHeader = "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"
+const sseAES256 = "AES256"
+const sseKMS = "aws:kms"
+
+// Encryption is the server side encryption of the content of an asset.
+type Encryption struct {
+	Mode EncryptionMode `json:"mode,omitempty"`
+	// KMSKeyID is the kms key of SSE-KMS, the one managed by s3 for the account if empty.
+	KMSKeyID string `json:"kmsKeyId,omitempty"`
+	// CustomerKeyID names the SSE-C key, among the ones held by the manager.
+	CustomerKeyID string `json:"customerKeyId,omitempty"`
+	// CustomerKey is the SSE-C key, only set when calling the storage so it is never persisted.
+	CustomerKey []byte `json:"-"`
+}
+
+// PutHeaders returns the headers the requests of a presigned put url have to send, since they are signed.
+// There are none for SSE-C, since its urls are never presigned.
+func (e Encryption) PutHeaders() map[string]string {
+	headers := make(map[string]string)
+	switch e.Mode {
+	case EncryptionS3:
+		headers[sseHeader] = sseAES256
+	case EncryptionKMS:
+		headers[sseHeader] = sseKMS
+		if e.KMSKeyID != "" {
+			headers[sseKMSKeyIDHeader] = e.KMSKeyID
+		}
+	}
+	return headers
+}
+
+// WithEncryption sets the encryption of the assets which do not request one.
+func WithEncryption(encryption Encryption) Option {
+	return func(manager *assetManager) {
+		manager.encryption = encryption
+	}
+}
+
+// WithCustomerKeys sets the SSE-C keys, by id, the assets can be encrypted with.
+// A key can not be removed while there are assets encrypted with it.
+func WithCustomerKeys(keys map[string][]byte) Option {
+	return func(manager *assetManager) {
+		manager.customerKeys = keys
+	}
+}
+
+// ReadCustomerKeys reads the SSE-C keys of a json file, with the base64 encoded keys by id.
+func ReadCustomerKeys(path string) (map[string][]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	encoded := make(map[string]string)
+	err = json.Unmarshal(content, &encoded)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorBadInput, err)
+	}
+	keys := make(map[string][]byte, len(encoded))
+	for id, encodedKey := range encoded {
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil || len(key) != CustomerKeySize {
+			return nil, auerr.FError(auerr.ErrorBadInput, "Customer key %s should be a base64 encoded %d bytes key", id, CustomerKeySize)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// checkEncryption returns the requested encryption, or the default one if none is requested, once checked.
+func (ps *assetManager) checkEncryption(encryption Encryption) (Encryption, error) {
+	if encryption.Mode == EncryptionNone {
+		if encryption.KMSKeyID != "" || encryption.CustomerKeyID != "" {
+			return encryption, auerr.SError(auerr.ErrorBadInput, "Encryption keys require an encryption mode")
+		}
+		encryption = ps.encryption
+	}
+	switch encryption.Mode {
+	case EncryptionNone, EncryptionS3:
+		if encryption.KMSKeyID != "" || encryption.CustomerKeyID != "" {
+			return encryption, auerr.FError(auerr.ErrorBadInput, "Encryption %s does not take keys", encryption.Mode)
+		}
+	case EncryptionKMS:
+		if encryption.CustomerKeyID != "" {
+			return encryption, auerr.FError(auerr.ErrorBadInput, "Encryption %s does not take a customer key", encryption.Mode)
+		}
+	case EncryptionCustomer:
+		if encryption.KMSKeyID != "" {
+			return encryption, auerr.FError(auerr.ErrorBadInput, "Encryption %s does not take a kms key", encryption.Mode)
+		}
+		if encryption.CustomerKeyID == "" && ps.encryption.Mode == EncryptionCustomer {
+			encryption.CustomerKeyID = ps.encryption.CustomerKeyID
+		}
+		if _, ok := ps.customerKeys[encryption.CustomerKeyID]; !ok {
+			return encryption, auerr.FError(auerr.ErrorBadInput, "Customer key %s is not found", encryption.CustomerKeyID)
+		}
+	default:
+		return encryption, auerr.FError(auerr.ErrorBadInput, "Encryption should be one of %s, %s or %s, not %s", EncryptionS3, EncryptionKMS, EncryptionCustomer, encryption.Mode)
+	}
+	encryption.CustomerKey = nil
+	return encryption, nil
+}
+
+// withKey returns the encryption with its SSE-C key, as the storage needs it to read or write the content.
+func (ps *assetManager) withKey(encryption Encryption) (Encryption, error) {
+	if encryption.Mode != EncryptionCustomer {
+		return encryption, nil
+	}
+	key, ok := ps.customerKeys[encryption.CustomerKeyID]
+	if !ok {
+		return encryption, auerr.FError(auerr.ErrorInternalError, "Customer key %s is not found", encryption.CustomerKeyID)
+	}
+	encryption.CustomerKey = key
+	return encryption, nil
+}
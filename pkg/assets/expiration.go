@@ -0,0 +1,56 @@
+package assets
+
+import (
+	"time"
+
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// DefaultUploadExpiration is how long the upload urls are valid when no expiration is requested, for the default managers.
+const DefaultUploadExpiration = 30 * time.Second
+
+// DefaultDownloadExpiration is how long the download urls are valid when no expiration is requested.
+const DefaultDownloadExpiration = time.Minute
+
+// MaxPresignExpiration is the longest a presigned s3 url can be valid.
+const MaxPresignExpiration = 7 * 24 * time.Hour
+
+// ExpirationBounds limit the requested expiration of the presigned urls, the ones out of them are clamped.
+// Zero values are not limited.
+type ExpirationBounds struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// WithUploadExpirationBounds sets the limits of the requested expiration of the upload urls, from 1 second to 7 days by default.
+func WithUploadExpirationBounds(bounds ExpirationBounds) Option {
+	return func(manager *assetManager) {
+		manager.uploadExpirationBounds = bounds
+	}
+}
+
+// WithDownloadExpiration sets how long the download urls are valid when no expiration is requested, and the limits of the requested one.
+// By default, they are valid 1 minute, from 1 second to 7 days.
+func WithDownloadExpiration(expiration time.Duration, bounds ExpirationBounds) Option {
+	return func(manager *assetManager) {
+		manager.downloadExpiration = expiration
+		manager.downloadExpirationBounds = bounds
+	}
+}
+
+// boundedExpiration returns the requested expiration clamped to the bounds, or the default one if none was requested.
+func boundedExpiration(requested time.Duration, defaultExpiration time.Duration, bounds ExpirationBounds) (time.Duration, error) {
+	if requested < 0 {
+		return 0, auerr.FError(auerr.ErrorBadInput, "Expiration should be positive, not %s", requested)
+	}
+	if requested == 0 {
+		requested = defaultExpiration
+	}
+	if bounds.Min > 0 && requested < bounds.Min {
+		return bounds.Min, nil
+	}
+	if bounds.Max > 0 && requested > bounds.Max {
+		return bounds.Max, nil
+	}
+	return requested, nil
+}
@@ -0,0 +1,13 @@
+package assets
+
+// MaxReadEvents is the maximum number of read events kept per asset.
+const MaxReadEvents = maxReadEvents
+
+// SetMaxCopyObjectSize changes the size from which s3 objects are copied by parts, so it can be tested with small objects.
+func SetMaxCopyObjectSize(maxSize int64, partSize int64) func() {
+	previousMaxSize, previousPartSize := maxCopyObjectSize, copyPartSize
+	maxCopyObjectSize, copyPartSize = maxSize, partSize
+	return func() {
+		maxCopyObjectSize, copyPartSize = previousMaxSize, previousPartSize
+	}
+}
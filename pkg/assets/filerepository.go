@@ -0,0 +1,219 @@
+package assets
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// recordLocks is the number of locks the records are spread over, so updates of different assets seldom wait for each other.
+const recordLocks = 64
+
+const recordExtension = ".json"
+
+// NewFileRepository creates an AssetRepository which keeps every record in its own file under dir, created if missing.
+// The records are loaded in memory, and only the file of the changed record is rewritten, atomically, on every change.
+func NewFileRepository(dir string) (AssetRepository, error) {
+	repository := &fileRepository{dir: dir, records: make(map[string]*AssetRecord)}
+	buckets, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return repository, nil
+	}
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	for _, bucket := range buckets {
+		if !bucket.IsDir() {
+			continue
+		}
+		err = repository.load(filepath.Join(dir, bucket.Name()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return repository, nil
+}
+
+type fileRepository struct {
+	dir string
+	// mutex guards records, the files are written holding the lock of their record only
+	mutex   sync.Mutex
+	records map[string]*AssetRecord
+	locks   [recordLocks]sync.Mutex
+}
+
+// load reads the records of the files of a bucket folder, skipping the ones being written.
+func (f *fileRepository) load(bucketDir string) error {
+	files, err := ioutil.ReadDir(bucketDir)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || filepath.Ext(file.Name()) != recordExtension {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(bucketDir, file.Name()))
+		if err != nil {
+			return auerr.CError(auerr.ErrorInternalError, err)
+		}
+		record := &AssetRecord{}
+		err = json.Unmarshal(content, record)
+		if err != nil {
+			return auerr.FError(auerr.ErrorInternalError, "Record %s is not valid: %s", file.Name(), err.Error())
+		}
+		f.records[recordKey(record.Bucket, record.ID)] = record
+	}
+	return nil
+}
+
+func (f *fileRepository) Create(ctx context.Context, record *AssetRecord) error {
+	key := recordKey(record.Bucket, record.ID)
+	lock := f.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := f.record(key); ok {
+		return auerr.FError(auerr.ErrorConflict, "Asset %s already exists", record.ID.String())
+	}
+	return f.store(key, record.copy())
+}
+
+func (f *fileRepository) Get(ctx context.Context, bucket string, assetID uuid.UUID) (*AssetRecord, error) {
+	record, ok := f.record(recordKey(bucket, assetID))
+	if !ok {
+		return nil, auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", assetID.String())
+	}
+	return record.copy(), nil
+}
+
+func (f *fileRepository) Update(ctx context.Context, bucket string, assetID uuid.UUID, update func(record *AssetRecord) error) (*AssetRecord, error) {
+	key := recordKey(bucket, assetID)
+	lock := f.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	record, ok := f.record(key)
+	if !ok {
+		return nil, auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", assetID.String())
+	}
+	updated := record.copy()
+	err := update(updated)
+	if err != nil {
+		return nil, err
+	}
+	err = f.store(key, updated)
+	if err != nil {
+		return nil, err
+	}
+	return updated.copy(), nil
+}
+
+func (f *fileRepository) Delete(ctx context.Context, bucket string, assetID uuid.UUID) error {
+	key := recordKey(bucket, assetID)
+	lock := f.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	err := os.Remove(f.path(bucket, assetID))
+	if err != nil && !os.IsNotExist(err) {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.records, key)
+	return nil
+}
+
+func (f *fileRepository) List(ctx context.Context, bucket string, startAfter string, limit int64) ([]*AssetRecord, bool, error) {
+	f.mutex.Lock()
+	records := make([]*AssetRecord, 0)
+	for _, record := range f.records {
+		if record.Bucket == bucket && record.ID.String() > startAfter {
+			records = append(records, record)
+		}
+	}
+	f.mutex.Unlock()
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID.String() < records[j].ID.String()
+	})
+	more := int64(len(records)) > limit
+	if more {
+		records = records[:limit]
+	}
+	// The stored records are replaced on every change, never modified, so they can be copied out of the lock
+	for i, record := range records {
+		records[i] = record.copy()
+	}
+	return records, more, nil
+}
+
+// store writes the record to its file, and then replaces it in memory. It is called holding the lock of the record.
+func (f *fileRepository) store(key string, record *AssetRecord) error {
+	err := writeJSON(f.path(record.Bucket, record.ID), record)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.records[key] = record
+	return nil
+}
+
+func (f *fileRepository) record(key string) (*AssetRecord, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	record, ok := f.records[key]
+	return record, ok
+}
+
+// path returns the file of the record, in the folder of its bucket.
+func (f *fileRepository) path(bucket string, assetID uuid.UUID) string {
+	return filepath.Join(f.dir, url.PathEscape(bucket), assetID.String()+recordExtension)
+}
+
+// lock returns the lock of the record under key, shared with the records hashed to the same one.
+func (f *fileRepository) lock(key string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &f.locks[hash.Sum32()%recordLocks]
+}
+
+// writeJSON replaces the file at path with value as json, creating its folder if missing.
+func writeJSON(path string, value interface{}) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	// Written aside and renamed, so a crash never leaves a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package assets
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+const listPageSize = 1000
+
+// WithGarbageRetention sets how long after its urls expiration a not uploaded asset is collected as garbage.
+func WithGarbageRetention(retention time.Duration) Option {
+	return func(manager *assetManager) {
+		manager.garbageRetention = retention
+	}
+}
+
+// GarbageReport lists the assets cleaned by a garbage collection, or the ones it would clean on a dry run.
+type GarbageReport struct {
+	DryRun bool
+	// AbandonedAssets are the assets whose urls expired long ago without being uploaded.
+	// Their record, metadata, multipart upload and pending chunk are removed.
+	AbandonedAssets []string
+	// PromotedTemps are the temporal objects of the assets already moved to the uploaded folder.
+	PromotedTemps []string
+	// RevokedTemps are the temporal objects uploaded to revoked assets, with urls issued before being revoked.
+	RevokedTemps []string
+}
+
+func (ps *assetManager) CollectGarbage(ctx context.Context, bucket string, dryRun bool) (*GarbageReport, error) {
+	report := &GarbageReport{DryRun: dryRun, AbandonedAssets: make([]string, 0), PromotedTemps: make([]string, 0), RevokedTemps: make([]string, 0)}
+	now := time.Now().UTC()
+	err := ps.listRecords(ctx, bucket, func(record *AssetRecord) error {
+		abandoned, err := ps.isAbandoned(ctx, bucket, record, now)
+		if err != nil || !abandoned {
+			return err
+		}
+		if !dryRun {
+			err = ps.removeAbandoned(ctx, bucket, record)
+			if err != nil {
+				return err
+			}
+		}
+		report.AbandonedAssets = append(report.AbandonedAssets, record.ID.String())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = ps.listAssetIDs(ctx, bucket, temporalPath, func(assetID uuid.UUID) error {
+		record, err := ps.repository.Get(ctx, bucket, assetID)
+		if auerr.Is(err, auerr.ErrorNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Failed assets keep their content, so the failure can be checked
+		promoted := record.State == StateUploaded || record.State == StateArchived || record.State == StateRestoring
+		if !promoted && record.State != StateRevoked {
+			return nil
+		}
+		if !dryRun {
+			err = ps.storage.Delete(ctx, bucket, temporalPath+assetID.String())
+			if err != nil {
+				return err
+			}
+		}
+		if record.State == StateRevoked {
+			report.RevokedTemps = append(report.RevokedTemps, assetID.String())
+		} else {
+			report.PromotedTemps = append(report.PromotedTemps, assetID.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// isAbandoned returns if the asset was never uploaded and its urls expired more than the garbage retention ago.
+func (ps *assetManager) isAbandoned(ctx context.Context, bucket string, record *AssetRecord, now time.Time) (bool, error) {
+	// Processed assets have content, deleted ones are removed by their purge job
+	if record.State != StateCreated && record.State != StateUploading {
+		return false, nil
+	}
+	if now.Before(record.CreatedAt.Add(record.Expiration + ps.garbageRetention)) {
+		return false, nil
+	}
+	encryption, err := ps.withKey(record.Constraints.Encryption)
+	if err != nil {
+		return false, err
+	}
+	_, err = ps.storage.Head(ctx, bucket, temporalPath+record.ID.String(), encryption)
+	if auerr.Is(err, auerr.ErrorNotFound) {
+		return true, nil
+	}
+	return false, err
+}
+
+func (ps *assetManager) removeAbandoned(ctx context.Context, bucket string, record *AssetRecord) error {
+	if record.UploadID != "" {
+		err := ps.storage.AbortMultipartUpload(ctx, bucket, temporalPath+record.ID.String(), record.UploadID)
+		if err != nil && !auerr.Is(err, auerr.ErrorNotFound) {
+			return err
+		}
+	}
+	if record.Resumable {
+		err := ps.storage.Delete(ctx, bucket, pendingPath+record.ID.String())
+		if err != nil {
+			return err
+		}
+	}
+	// The record goes last, so the asset is collected again if the removal fails in between
+	return ps.repository.Delete(ctx, bucket, record.ID)
+}
+
+// listRecords calls f with every asset record of the bucket, in pages.
+func (ps *assetManager) listRecords(ctx context.Context, bucket string, f func(record *AssetRecord) error) error {
+	startAfter := ""
+	for {
+		records, more, err := ps.repository.List(ctx, bucket, startAfter, listPageSize)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			err = f(record)
+			if err != nil {
+				return err
+			}
+		}
+		if !more || len(records) == 0 {
+			return nil
+		}
+		startAfter = records[len(records)-1].ID.String()
+	}
+}
+
+// listAssetIDs calls f with every asset id under path, in pages.
+func (ps *assetManager) listAssetIDs(ctx context.Context, bucket string, path string, f func(assetID uuid.UUID) error) error {
+	startAfter := ""
+	for {
+		keys, more, err := ps.storage.List(ctx, bucket, path, startAfter, listPageSize)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			assetID, err := uuid.Parse(strings.TrimPrefix(key, path))
+			if err != nil {
+				// Not an asset object
+				continue
+			}
+			err = f(assetID)
+			if err != nil {
+				return err
+			}
+		}
+		if !more || len(keys) == 0 {
+			return nil
+		}
+		startAfter = keys[len(keys)-1]
+	}
+}
+
+func (ps *assetManager) ScheduleGarbageCollection(ctx context.Context, bucket string, period time.Duration, dryRun bool) error {
+	if period <= 0 {
+		return auerr.FError(auerr.ErrorBadInput, "Garbage collection period should be positive, not %s", period)
+	}
+	return ps.schedulePeriodic(ctx, "gc-"+bucket, period, time.Now().UTC().Add(period), func(ctx context.Context) error {
+		report, err := ps.CollectGarbage(ctx, bucket, dryRun)
+		if err != nil {
+			return err
+		}
+		log.Printf("Garbage collection of %s, dry run %t, abandoned assets %v, promoted temps %v, revoked temps %v",
+			bucket, report.DryRun, report.AbandonedAssets, report.PromotedTemps, report.RevokedTemps)
+		return nil
+	})
+}
@@ -0,0 +1,135 @@
+package assets
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxEvents is the maximum number of lifecycle events kept per asset, the oldest ones are dropped first.
+const maxEvents = 1000
+
+// maxReadEvents is the maximum number of read events kept per asset, apart from its lifecycle events.
+const maxReadEvents = 100
+
+// EventType is a kind of event of the asset lifecycle.
+type EventType string
+
+const (
+	// EventURLsIssued is recorded when the upload urls of the asset are created.
+	EventURLsIssued EventType = "urls_issued"
+	// EventUploadReported is recorded when the client marks the asset as uploaded.
+	EventUploadReported EventType = "upload_reported"
+	// EventUploadDetected is recorded when the upload watcher marks the asset as uploaded.
+	EventUploadDetected EventType = "upload_detected"
+	// EventUploadProxied is recorded when the content of the asset is put through the service.
+	EventUploadProxied EventType = "upload_proxied"
+	// EventPromotionScheduled is recorded when the promotion job is scheduled, with its date as detail.
+	EventPromotionScheduled EventType = "promotion_scheduled"
+	// EventPromotionExecuted is recorded when a promotion attempt starts.
+	EventPromotionExecuted EventType = "promotion_executed"
+	// EventPromotionFailed is recorded when a promotion attempt does not succeed, with the reason as detail.
+	EventPromotionFailed EventType = "promotion_failed"
+	// EventPromotionSucceeded is recorded when the asset is moved to the uploaded folder.
+	EventPromotionSucceeded EventType = "promotion_succeeded"
+	// EventDownloadURLIssued is recorded when a download url of the asset is signed, with its timeout as detail.
+	EventDownloadURLIssued EventType = "download_url_issued"
+	// EventContentRequested is recorded when the content of the asset is requested through the service.
+	EventContentRequested EventType = "content_requested"
+	// EventRevoked is recorded when the upload urls of the asset are revoked.
+	EventRevoked EventType = "revoked"
+	// EventDeleted is recorded when the asset is deleted.
+	EventDeleted EventType = "deleted"
+	// EventRestored is recorded when the asset is restored.
+	EventRestored EventType = "restored"
+	// EventArchived is recorded when the asset is moved to the archive tier, with its storage class as detail.
+	EventArchived EventType = "archived"
+	// EventArchiveRestoreStarted is recorded when the restore of the archived asset is started.
+	EventArchiveRestoreStarted EventType = "archive_restore_started"
+	// EventArchiveRestored is recorded when the archived asset is restored, with its storage class as detail.
+	EventArchiveRestored EventType = "archive_restored"
+)
+
+// Event is something that happened to an asset.
+type Event struct {
+	Type EventType `json:"type"`
+	At   time.Time `json:"at"`
+	// Detail is a free form description of the event, empty if there is nothing to add.
+	Detail string `json:"detail,omitempty"`
+}
+
+// addEvent appends an event to the record history, dropping the oldest ones over the limit.
+func (r *AssetRecord) addEvent(eventType EventType, at time.Time, detail string) {
+	r.Events = append(r.Events, Event{Type: eventType, At: at, Detail: detail})
+	if len(r.Events) > maxEvents {
+		r.Events = append([]Event(nil), r.Events[len(r.Events)-maxEvents:]...)
+	}
+}
+
+func (ps *assetManager) History(ctx context.Context, bucket string, assetID uuid.UUID) ([]Event, error) {
+	// Deleted assets keep their history until purged
+	record, err := ps.repository.Get(ctx, bucket, assetID)
+	if err != nil {
+		return nil, err
+	}
+	return mergeEvents(record.Events, ps.reads.get(recordKey(bucket, assetID))), nil
+}
+
+// mergeEvents merges two lists of events ordered by date into one.
+func mergeEvents(events []Event, others []Event) []Event {
+	merged := make([]Event, 0, len(events)+len(others))
+	for len(events) > 0 && len(others) > 0 {
+		if others[0].At.Before(events[0].At) {
+			merged, others = append(merged, others[0]), others[1:]
+		} else {
+			merged, events = append(merged, events[0]), events[1:]
+		}
+	}
+	merged = append(merged, events...)
+	return append(merged, others...)
+}
+
+// reads are the latest read events of the assets, by asset. They are kept in memory apart from the lifecycle events,
+// so reading an asset does not write its record, nor pushes its lifecycle out of its history.
+type reads struct {
+	mutex  sync.Mutex
+	events map[string][]Event
+}
+
+func newReads() *reads {
+	return &reads{events: make(map[string][]Event)}
+}
+
+// add records a read event of the asset, dropping the oldest ones over the limit.
+func (r *reads) add(key string, eventType EventType, detail string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	events := append(r.events[key], Event{Type: eventType, At: time.Now().UTC(), Detail: detail})
+	if len(events) > maxReadEvents {
+		events = append([]Event(nil), events[len(events)-maxReadEvents:]...)
+	}
+	r.events[key] = events
+}
+
+func (r *reads) get(key string) []Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]Event(nil), r.events[key]...)
+}
+
+func (r *reads) remove(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.events, key)
+}
+
+// recordEvent appends an event to the asset history.
+func (ps *assetManager) recordEvent(ctx context.Context, bucket string, assetID uuid.UUID, eventType EventType, detail string) error {
+	_, err := ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		record.addEvent(eventType, time.Now().UTC(), detail)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,124 @@
+package assets
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// MaxListLimit is the maximum number of assets of a listed page.
+const MaxListLimit = 1000
+
+// ListFilter selects the listed assets. Zero values do not filter.
+type ListFilter struct {
+	// States are the allowed asset states, empty means any.
+	States []AssetState
+	// CreatedAfter and CreatedBefore bound, inclusively, the date the asset upload urls were signed.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Labels should all be present in the asset metadata, an empty value only requires the label to exist.
+	Labels map[string]string
+}
+
+// AssetInfo is the listed information of an asset, all of it is kept in the asset record.
+type AssetInfo struct {
+	ID    string
+	State AssetState
+	// Size and ContentType are the ones of the uploaded content, unknown until it is processed.
+	Size         int64
+	ContentType  string
+	StorageClass StorageClass
+	// Checksum is the one declared when the asset was created, or computed when its content was put through the service.
+	Checksum  Checksum
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Metadata  Metadata
+}
+
+// AssetPage is a page of listed assets.
+type AssetPage struct {
+	Assets []AssetInfo
+	// Cursor lists the next page, empty if there are no more assets.
+	Cursor string
+}
+
+func (ps *assetManager) List(ctx context.Context, bucket string, filter ListFilter, cursor string, limit int64) (*AssetPage, error) {
+	if limit < 1 || limit > MaxListLimit {
+		return nil, auerr.FError(auerr.ErrorBadInput, "Limit should be between 1 and %d, not %d", MaxListLimit, limit)
+	}
+	for _, state := range filter.States {
+		if !containsState(States, state) {
+			names := make([]string, 0, len(States))
+			for _, s := range States {
+				names = append(names, string(s))
+			}
+			return nil, auerr.FError(auerr.ErrorBadInput, "State should be one of %s, not %s", strings.Join(names, ", "), state)
+		}
+	}
+	page := &AssetPage{Assets: make([]AssetInfo, 0)}
+	startAfter := cursor
+	for {
+		records, more, err := ps.repository.List(ctx, bucket, startAfter, limit)
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			info := assetInfo(record, filter)
+			if info == nil {
+				continue
+			}
+			page.Assets = append(page.Assets, *info)
+			if int64(len(page.Assets)) == limit {
+				if more || i < len(records)-1 {
+					page.Cursor = info.ID
+				}
+				return page, nil
+			}
+		}
+		if !more {
+			return page, nil
+		}
+		startAfter = records[len(records)-1].ID.String()
+	}
+}
+
+// assetInfo returns the information of the asset if it matches the filter, nil otherwise.
+func assetInfo(record *AssetRecord, filter ListFilter) *AssetInfo {
+	if len(filter.States) > 0 && !containsState(filter.States, record.State) {
+		return nil
+	}
+	if !filter.CreatedAfter.IsZero() && record.CreatedAt.Before(filter.CreatedAfter) {
+		return nil
+	}
+	if !filter.CreatedBefore.IsZero() && record.CreatedAt.After(filter.CreatedBefore) {
+		return nil
+	}
+	for k, v := range filter.Labels {
+		label, ok := record.Metadata.Labels[k]
+		if !ok || (v != "" && label != v) {
+			return nil
+		}
+	}
+	return &AssetInfo{
+		ID:           record.ID.String(),
+		State:        record.State,
+		Size:         record.Size,
+		ContentType:  record.ContentType,
+		StorageClass: record.StorageClass,
+		Checksum:     record.checksum(),
+		CreatedAt:    record.CreatedAt,
+		UpdatedAt:    record.UpdatedAt,
+		Metadata:     record.Metadata,
+	}
+}
+
+func containsState(states []AssetState, state AssetState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
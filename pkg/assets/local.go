@@ -0,0 +1,625 @@
+package assets
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// LocalStoragePath is the url path where the local storage objects are served.
+const LocalStoragePath = "/storage/"
+
+const localExpiresParam = "X-Expires"
+const localSignatureParam = "X-Signature"
+const objectsDir = "objects"
+const metaDir = "meta"
+const multipartDir = "multipart"
+const uploadFile = "upload.json"
+
+// LocalUploadIDParam is the query param with the multipart upload id of an upload part url.
+const LocalUploadIDParam = "uploadId"
+
+// LocalPartNumberParam is the query param with the part number of an upload part url.
+const LocalPartNumberParam = "partNumber"
+
+const localContentTypeParam = "contentType"
+const localContentLengthParam = "contentLength"
+const localContentMD5Param = "contentMD5"
+const localContentSHA256Param = "contentSHA256"
+
+// NewLocalStorage creates a Storage which keeps the objects in the local filesystem under root.
+// Presigned urls point to baseURL and are signed with secret, they should be served with the local storage endpoints.
+func NewLocalStorage(root string, baseURL *url.URL, secret []byte) (*LocalStorage, error) {
+	if len(secret) == 0 {
+		return nil, auerr.SError(auerr.ErrorBadInput, "Local storage secret is empty")
+	}
+	if baseURL == nil {
+		return nil, auerr.SError(auerr.ErrorBadInput, "Local storage url is nil")
+	}
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return &LocalStorage{root: root, baseURL: baseURL, secret: secret}, nil
+}
+
+// LocalStorage is a Storage backed by the local filesystem with self signed urls.
+type LocalStorage struct {
+	root    string
+	baseURL *url.URL
+	secret  []byte
+}
+
+type localUpload struct {
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	ContentType string `json:"contentType"`
+}
+
+type localMeta struct {
+	Tags         map[string]string `json:"tags"`
+	ContentType  string            `json:"contentType"`
+	ETag         string            `json:"etag"`
+	LastModified time.Time         `json:"lastModified"`
+}
+
+// PresignPut creates a signed url to put an object in the local storage.
+// The constraints are signed as params of the url, they should be checked with CheckConstraints and SignedChecksum.
+func (l *LocalStorage) PresignPut(ctx context.Context, bucket string, key string, expiration time.Duration, constraints PutConstraints) (*url.URL, error) {
+	err := checkUnencrypted(constraints.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	if constraints.ContentType != "" {
+		params.Set(localContentTypeParam, constraints.ContentType)
+	}
+	if constraints.ContentLength > 0 {
+		params.Set(localContentLengthParam, strconv.FormatInt(constraints.ContentLength, 10))
+	}
+	if constraints.Checksum.MD5 != "" {
+		params.Set(localContentMD5Param, constraints.Checksum.MD5)
+	}
+	if constraints.Checksum.SHA256 != "" {
+		params.Set(localContentSHA256Param, constraints.Checksum.SHA256)
+	}
+	return l.presign("PUT", bucket, key, expiration, params)
+}
+
+// PresignGet creates a signed url to get an object from the local storage.
+func (l *LocalStorage) PresignGet(ctx context.Context, bucket string, key string, expiration time.Duration, encryption Encryption) (*url.URL, error) {
+	return l.presign("GET", bucket, key, expiration, url.Values{})
+}
+
+// presign creates an url for the given method, bucket and key, the params are added to the url and signed too.
+func (l *LocalStorage) presign(method string, bucket string, key string, expiration time.Duration, params url.Values) (*url.URL, error) {
+	_, err := l.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	expires := strconv.FormatInt(time.Now().Add(expiration).Unix(), 10)
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set(localExpiresParam, expires)
+	query.Set(localSignatureParam, l.signature(method, bucket, key, expires, params))
+	signedURL := *l.baseURL
+	signedURL.Path = path.Join(signedURL.Path, LocalStoragePath, bucket, key)
+	signedURL.RawQuery = query.Encode()
+	return &signedURL, nil
+}
+
+// Verify checks the query of a presigned url for the given method, bucket and key.
+func (l *LocalStorage) Verify(method string, bucket string, key string, query url.Values) error {
+	expires := query.Get(localExpiresParam)
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return auerr.FError(auerr.ErrorForbidden, "Invalid %s", localExpiresParam)
+	}
+	params := url.Values{}
+	for k, v := range query {
+		if k != localExpiresParam && k != localSignatureParam {
+			params[k] = v
+		}
+	}
+	expected := l.signature(method, bucket, key, expires, params)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(localSignatureParam))) {
+		return auerr.SError(auerr.ErrorForbidden, "Signature does not match")
+	}
+	if time.Now().Unix() > expiresAt {
+		return auerr.SError(auerr.ErrorForbidden, "Request has expired")
+	}
+	return nil
+}
+
+// CheckConstraints checks the content type and length of a put against the ones signed in the query of its url.
+func (l *LocalStorage) CheckConstraints(query url.Values, contentType string, contentLength int64) error {
+	if expected := query.Get(localContentTypeParam); expected != "" && expected != contentType {
+		return auerr.FError(auerr.ErrorForbidden, "Content type %s does not match the signed one", contentType)
+	}
+	if expected := query.Get(localContentLengthParam); expected != "" && expected != strconv.FormatInt(contentLength, 10) {
+		return auerr.FError(auerr.ErrorForbidden, "Content length %d does not match the signed one", contentLength)
+	}
+	return nil
+}
+
+// SignedChecksum returns the checksum signed in the query of a put url, the written content should match it.
+func (l *LocalStorage) SignedChecksum(query url.Values) Checksum {
+	return Checksum{MD5: query.Get(localContentMD5Param), SHA256: query.Get(localContentSHA256Param)}
+}
+
+func (l *LocalStorage) signature(method string, bucket string, key string, expires string, params url.Values) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(strings.Join([]string{method, bucket, key, expires, params.Encode()}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Put stores the body under the given key with the given tags.
+func (l *LocalStorage) Put(ctx context.Context, bucket string, key string, body io.ReadSeeker, tags map[string]string, encryption Encryption) error {
+	err := checkUnencrypted(encryption)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader = body
+	if body == nil {
+		reader = strings.NewReader("")
+	}
+	return l.Write(bucket, key, reader, "", tags, Checksum{})
+}
+
+// Write stores the content of reader under the given key.
+// The content is only stored if it matches the non empty values of checksum.
+func (l *LocalStorage) Write(bucket string, key string, reader io.Reader, contentType string, tags map[string]string, checksum Checksum) error {
+	objectPath, err := l.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(objectPath), 0700)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(objectPath), ".upload")
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	defer os.Remove(tmp.Name())
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, md5Hash, sha256Hash), reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	md5Sum := md5Hash.Sum(nil)
+	if checksum.MD5 != "" && checksum.MD5 != base64.StdEncoding.EncodeToString(md5Sum) {
+		return auerr.SError(auerr.ErrorBadInput, "Content MD5 does not match the expected one")
+	}
+	if checksum.SHA256 != "" && checksum.SHA256 != hex.EncodeToString(sha256Hash.Sum(nil)) {
+		return auerr.SError(auerr.ErrorBadInput, "Content SHA256 does not match the expected one")
+	}
+	err = os.Rename(tmp.Name(), objectPath)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return l.writeMeta(bucket, key, &localMeta{
+		Tags:         tags,
+		ContentType:  contentType,
+		ETag:         `"` + hex.EncodeToString(md5Sum) + `"`,
+		LastModified: time.Now().UTC(),
+	})
+}
+
+// Open opens the object under the given key for reading.
+func (l *LocalStorage) Open(bucket string, key string) (*os.File, *ObjectInfo, error) {
+	info, err := l.Head(context.Background(), bucket, key, Encryption{})
+	if err != nil {
+		return nil, nil, err
+	}
+	objectPath, err := l.objectPath(bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(objectPath)
+	if err != nil {
+		return nil, nil, l.fileError(err, bucket, key)
+	}
+	return file, info, nil
+}
+
+// Get returns the content of the object under the given key.
+func (l *LocalStorage) Get(ctx context.Context, bucket string, key string, encryption Encryption) (io.ReadCloser, error) {
+	file, _, err := l.Open(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// GetRange returns length bytes, at most, of the content of the object under the given key from offset.
+func (l *LocalStorage) GetRange(ctx context.Context, bucket string, key string, offset int64, length int64, encryption Encryption) (io.ReadCloser, error) {
+	file, _, err := l.Open(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return &rangeReader{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+// rangeReader reads a range of a file, closing the whole file.
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// Tags returns the tags of the object under the given key.
+func (l *LocalStorage) Tags(ctx context.Context, bucket string, key string) (map[string]string, error) {
+	meta, err := l.readMeta(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Tags == nil {
+		return map[string]string{}, nil
+	}
+	return meta.Tags, nil
+}
+
+// SetTags replaces the tags of the object under the given key, leaving its content as it is.
+func (l *LocalStorage) SetTags(ctx context.Context, bucket string, key string, tags map[string]string) error {
+	meta, err := l.readMeta(bucket, key)
+	if err != nil {
+		return err
+	}
+	meta.Tags = tags
+	return l.writeMeta(bucket, key, meta)
+}
+
+// Copy copies the object under srcKey to dstKey replacing its tags with the given ones.
+func (l *LocalStorage) Copy(ctx context.Context, bucket string, srcKey string, dstKey string, tags map[string]string, encryption Encryption, storageClass StorageClass) error {
+	if storageClass != StorageClassDefault && storageClass != StorageClassStandard {
+		return auerr.FError(auerr.ErrorBadInput, "Local storage does not support the %s storage class", storageClass)
+	}
+	file, info, err := l.Open(bucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return l.Write(bucket, dstKey, file, info.ContentType, tags, Checksum{})
+}
+
+// Head returns the information of the object under the given key.
+func (l *LocalStorage) Head(ctx context.Context, bucket string, key string, encryption Encryption) (*ObjectInfo, error) {
+	objectPath, err := l.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(objectPath)
+	if err != nil {
+		return nil, l.fileError(err, bucket, key)
+	}
+	meta, err := l.readMeta(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Size:         stat.Size(),
+		ContentType:  meta.ContentType,
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+	}, nil
+}
+
+// List returns, in lexicographical order, up to limit keys starting with prefix and greater than startAfter.
+func (l *LocalStorage) List(ctx context.Context, bucket string, prefix string, startAfter string, limit int64) ([]string, bool, error) {
+	bucketPath, err := l.safePath(objectsDir, bucket, "bucket", "")
+	if err != nil {
+		return nil, false, err
+	}
+	bucketPath = filepath.Dir(bucketPath)
+	keys := make([]string, 0)
+	err = filepath.Walk(bucketPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Skip folders and the files being written
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload") {
+			return nil
+		}
+		relative, err := filepath.Rel(bucketPath, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if strings.HasPrefix(key, prefix) && key > startAfter {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	sort.Strings(keys)
+	if int64(len(keys)) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
+
+// Delete removes the object under the given key.
+func (l *LocalStorage) Delete(ctx context.Context, bucket string, key string) error {
+	objectPath, err := l.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	metaPath, err := l.metaPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{objectPath, metaPath} {
+		err = os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return auerr.CError(auerr.ErrorInternalError, err)
+		}
+	}
+	return nil
+}
+
+// CreateMultipartUpload starts a multipart upload for the given key and returns its upload id.
+func (l *LocalStorage) CreateMultipartUpload(ctx context.Context, bucket string, key string, contentType string, encryption Encryption) (string, error) {
+	err := checkUnencrypted(encryption)
+	if err != nil {
+		return "", err
+	}
+	_, err = l.objectPath(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	uploadID := uuid.New().String()
+	uploadPath := filepath.Join(l.root, multipartDir, uploadID)
+	err = os.MkdirAll(uploadPath, 0700)
+	if err != nil {
+		return "", auerr.CError(auerr.ErrorInternalError, err)
+	}
+	content, err := json.Marshal(&localUpload{Bucket: bucket, Key: key, ContentType: contentType})
+	if err != nil {
+		return "", auerr.CError(auerr.ErrorInternalError, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(uploadPath, uploadFile), content, 0600)
+	if err != nil {
+		return "", auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return uploadID, nil
+}
+
+// PresignUploadPart creates a signed url to put a part of a multipart upload in the local storage.
+func (l *LocalStorage) PresignUploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, expiration time.Duration, encryption Encryption) (*url.URL, error) {
+	params := url.Values{}
+	params.Set(LocalUploadIDParam, uploadID)
+	params.Set(LocalPartNumberParam, strconv.FormatInt(partNumber, 10))
+	return l.presign("PUT", bucket, key, expiration, params)
+}
+
+// WritePart stores the content of reader as the part partNumber of a multipart upload.
+func (l *LocalStorage) WritePart(bucket string, key string, uploadID string, partNumber string, reader io.Reader) error {
+	number, err := strconv.ParseInt(partNumber, 10, 64)
+	if err != nil || number < 1 || number > MaxParts {
+		return auerr.FError(auerr.ErrorBadInput, "Invalid part number %s", partNumber)
+	}
+	uploadPath, _, err := l.uploadPath(bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(uploadPath, ".part")
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(uploadPath, strconv.FormatInt(number, 10)))
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return nil
+}
+
+// UploadPart stores the body as the part partNumber of a multipart upload.
+func (l *LocalStorage) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, body io.ReadSeeker, encryption Encryption) error {
+	return l.WritePart(bucket, key, uploadID, strconv.FormatInt(partNumber, 10), body)
+}
+
+// CompleteMultipartUpload assembles the uploaded parts, in part number order, into the object under the given key.
+func (l *LocalStorage) CompleteMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	uploadPath, upload, err := l.uploadPath(bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(uploadPath)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	partNumbers := make([]int, 0, len(files))
+	for _, file := range files {
+		if number, err := strconv.Atoi(file.Name()); err == nil {
+			partNumbers = append(partNumbers, number)
+		}
+	}
+	if len(partNumbers) == 0 {
+		return auerr.FError(auerr.ErrorBadInput, "No parts have been uploaded for %s/%s", bucket, key)
+	}
+	sort.Ints(partNumbers)
+	readers := make([]io.Reader, 0, len(partNumbers))
+	for _, number := range partNumbers {
+		part, err := os.Open(filepath.Join(uploadPath, strconv.Itoa(number)))
+		if err != nil {
+			return auerr.CError(auerr.ErrorInternalError, err)
+		}
+		defer part.Close()
+		readers = append(readers, part)
+	}
+	err = l.Write(bucket, key, io.MultiReader(readers...), upload.ContentType, nil, Checksum{})
+	if err != nil {
+		return err
+	}
+	return l.removeUpload(uploadPath)
+}
+
+// AbortMultipartUpload discards a multipart upload and its uploaded parts.
+func (l *LocalStorage) AbortMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	uploadPath, _, err := l.uploadPath(bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	return l.removeUpload(uploadPath)
+}
+
+func (l *LocalStorage) removeUpload(uploadPath string) error {
+	err := os.RemoveAll(uploadPath)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return nil
+}
+
+// uploadPath returns the folder and description of a multipart upload, checking it belongs to the given bucket and key.
+func (l *LocalStorage) uploadPath(bucket string, key string, uploadID string) (string, *localUpload, error) {
+	if _, err := uuid.Parse(uploadID); err != nil {
+		return "", nil, auerr.FError(auerr.ErrorBadInput, "Invalid upload id %s", uploadID)
+	}
+	uploadPath := filepath.Join(l.root, multipartDir, uploadID)
+	content, err := ioutil.ReadFile(filepath.Join(uploadPath, uploadFile))
+	if os.IsNotExist(err) {
+		return "", nil, auerr.FError(auerr.ErrorNotFound, "Upload %s is not found", uploadID)
+	}
+	if err != nil {
+		return "", nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	upload := &localUpload{}
+	err = json.Unmarshal(content, upload)
+	if err != nil {
+		return "", nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	if upload.Bucket != bucket || upload.Key != key {
+		return "", nil, auerr.FError(auerr.ErrorNotFound, "Upload %s is not found", uploadID)
+	}
+	return uploadPath, upload, nil
+}
+
+// checkUnencrypted rejects the server side encryption, the local storage keeps the objects as they are.
+// Reads ignore it, since nothing can be written encrypted.
+func checkUnencrypted(encryption Encryption) error {
+	if encryption.Mode != EncryptionNone {
+		return auerr.FError(auerr.ErrorBadInput, "Local storage does not support %s encryption", encryption.Mode)
+	}
+	return nil
+}
+
+// RestoreArchived fails, since the local storage does not archive objects.
+func (l *LocalStorage) RestoreArchived(ctx context.Context, bucket string, key string, days int64) error {
+	return auerr.SError(auerr.ErrorBadInput, "Local storage does not archive objects")
+}
+
+// CheckBucket returns an error if the root folder of the local storage can not be reached.
+func (l *LocalStorage) CheckBucket(ctx context.Context, bucket string) error {
+	_, err := os.Stat(l.root)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return nil
+}
+
+func (l *LocalStorage) readMeta(bucket string, key string) (*localMeta, error) {
+	metaPath, err := l.metaPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return nil, l.fileError(err, bucket, key)
+	}
+	meta := &localMeta{}
+	err = json.Unmarshal(content, meta)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return meta, nil
+}
+
+func (l *LocalStorage) writeMeta(bucket string, key string, meta *localMeta) error {
+	metaPath, err := l.metaPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	err = os.MkdirAll(filepath.Dir(metaPath), 0700)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	err = ioutil.WriteFile(metaPath, content, 0600)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return nil
+}
+
+func (l *LocalStorage) objectPath(bucket string, key string) (string, error) {
+	return l.safePath(objectsDir, bucket, key, "")
+}
+
+func (l *LocalStorage) metaPath(bucket string, key string) (string, error) {
+	return l.safePath(metaDir, bucket, key, ".json")
+}
+
+// safePath builds a path under root making sure bucket and key can not escape from it.
+func (l *LocalStorage) safePath(dir string, bucket string, key string, suffix string) (string, error) {
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || bucket == "." || bucket == ".." {
+		return "", auerr.FError(auerr.ErrorBadInput, "Invalid bucket %s", bucket)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.Contains(segment, `\`) {
+			return "", auerr.FError(auerr.ErrorBadInput, "Invalid key %s", key)
+		}
+	}
+	return filepath.Join(l.root, dir, bucket, filepath.FromSlash(key)) + suffix, nil
+}
+
+func (l *LocalStorage) fileError(err error, bucket string, key string) error {
+	if os.IsNotExist(err) {
+		return auerr.FError(auerr.ErrorNotFound, "Object %s/%s is not found", bucket, key)
+	}
+	return auerr.CError(auerr.ErrorInternalError, err)
+}
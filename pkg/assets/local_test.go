@@ -0,0 +1,148 @@
+package assets_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+func newTestLocalStorage(t *testing.T) *assets.LocalStorage {
+	root, err := ioutil.TempDir("", "localstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL, err := url.Parse("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := assets.NewLocalStorage(root, baseURL, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestLocalStorageSignedURL(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	ctx := context.Background()
+	t.Run("TestValidSignature", func(t *testing.T) {
+		putURL, err := storage.PresignPut(ctx, "bucket", "temp/asset", time.Minute, assets.PutConstraints{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if putURL.Path != "/storage/bucket/temp/asset" {
+			t.Fatalf("Path should be /storage/bucket/temp/asset, not %s", putURL.Path)
+		}
+		err = storage.Verify(http.MethodPut, "bucket", "temp/asset", putURL.Query())
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("TestWrongMethod", func(t *testing.T) {
+		putURL, err := storage.PresignPut(ctx, "bucket", "temp/asset", time.Minute, assets.PutConstraints{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = storage.Verify(http.MethodGet, "bucket", "temp/asset", putURL.Query())
+		if !auerr.Is(err, auerr.ErrorForbidden) {
+			t.Fatalf("We expected a forbidden error, got %v", err)
+		}
+	})
+	t.Run("TestWrongKey", func(t *testing.T) {
+		putURL, err := storage.PresignPut(ctx, "bucket", "temp/asset", time.Minute, assets.PutConstraints{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = storage.Verify(http.MethodPut, "bucket", "uploaded/asset", putURL.Query())
+		if !auerr.Is(err, auerr.ErrorForbidden) {
+			t.Fatalf("We expected a forbidden error, got %v", err)
+		}
+	})
+	t.Run("TestExpired", func(t *testing.T) {
+		putURL, err := storage.PresignPut(ctx, "bucket", "temp/asset", -1*time.Second, assets.PutConstraints{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = storage.Verify(http.MethodPut, "bucket", "temp/asset", putURL.Query())
+		if !auerr.Is(err, auerr.ErrorForbidden) {
+			t.Fatalf("We expected a forbidden error, got %v", err)
+		}
+	})
+	t.Run("TestPathTraversal", func(t *testing.T) {
+		_, err := storage.PresignPut(ctx, "bucket", "temp/../../asset", time.Minute, assets.PutConstraints{})
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("We expected a bad input error, got %v", err)
+		}
+	})
+}
+
+func TestLocalStorageObjects(t *testing.T) {
+	storage := newTestLocalStorage(t)
+	ctx := context.Background()
+	err := storage.Put(ctx, "bucket", "temp/asset", strings.NewReader("CONTENT"), map[string]string{"status": "new"}, assets.Encryption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Copy(ctx, "bucket", "temp/asset", "uploaded/asset", map[string]string{"status": "uploaded"}, assets.Encryption{}, assets.StorageClassDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := storage.Tags(ctx, "bucket", "uploaded/asset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["status"] != "uploaded" {
+		t.Fatalf("Status tag should be uploaded, not %s", tags["status"])
+	}
+	info, err := storage.Head(ctx, "bucket", "uploaded/asset", assets.Encryption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("CONTENT")) {
+		t.Fatalf("Size should be %d, not %d", len("CONTENT"), info.Size)
+	}
+	content, err := storage.GetRange(ctx, "bucket", "uploaded/asset", 1, 3, assets.Encryption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if body, err := ioutil.ReadAll(content); err != nil || string(body) != "ONT" {
+		t.Fatalf("Range should be ONT, not %s %v", body, err)
+	}
+	keys, more, err := storage.List(ctx, "bucket", "uploaded/", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"uploaded/asset"}) || more {
+		t.Fatalf("Listed keys should be [uploaded/asset], not %v", keys)
+	}
+	err = storage.Delete(ctx, "bucket", "temp/asset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.Head(ctx, "bucket", "temp/asset", assets.Encryption{})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+	err = storage.CheckBucket(ctx, "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalStorageEmptySecret(t *testing.T) {
+	baseURL, _ := url.Parse("http://localhost:8080")
+	_, err := assets.NewLocalStorage(os.TempDir(), baseURL, nil)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+}
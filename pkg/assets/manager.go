@@ -2,14 +2,19 @@ package assets
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
 	"math"
+	"mime"
 	"net/url"
-	"strconv"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/google/uuid"
 	"github.com/tgracchus/assetuploader/pkg/auerr"
@@ -17,198 +22,679 @@ import (
 	"github.com/tgracchus/assetuploader/pkg/schedule"
 )
 
-var emptyCredentials = credentials.Credentials{}
-
 const uploadedPath = "uploaded/"
 const temporalPath = "temp/"
 const status = "status"
 const uploaded = "uploaded"
+const dateFormat = "20060102T150405Z0700"
+
+// MaxParts is the maximum number of parts of a multipart upload.
+const MaxParts = 10000
 
 // AssetManager is responsible for the lifecycle of assets.
 type AssetManager interface {
-	PutURL(ctx context.Context, bucket string, assetID uuid.UUID) (*url.URL, error)
+	// PutURL creates an asset and its upload url, valid for the requested expiration within the bounds, or the default one if 0.
+	PutURL(ctx context.Context, bucket string, assetID uuid.UUID, constraints PutConstraints, expiration time.Duration) (*Upload, error)
+	// MultipartPutURLs creates an asset and the upload urls of its parts, with the same expiration as PutURL.
+	MultipartPutURLs(ctx context.Context, bucket string, assetID uuid.UUID, parts int64, constraints PutConstraints, expiration time.Duration) (*Upload, error)
+	// CreateResumableUpload creates an asset uploaded by chunks through the service, so an interrupted upload can be resumed.
+	// The content length is always the declared one, a zero one is an empty content, uploaded once created.
+	CreateResumableUpload(ctx context.Context, bucket string, assetID uuid.UUID, constraints PutConstraints) (*UploadProgress, error)
+	// Progress returns how much of a resumable upload has been received.
+	Progress(ctx context.Context, bucket string, assetID uuid.UUID) (*UploadProgress, error)
+	// WriteChunk appends the chunk to a resumable upload at offset, which should be the received bytes so far.
+	// Once the declared length is received, the asset is marked as uploaded.
+	WriteChunk(ctx context.Context, bucket string, assetID uuid.UUID, offset int64, chunk io.Reader) (*UploadProgress, error)
+	// PutContent streams the content of a single part asset through the service into its upload, and marks it as uploaded,
+	// for the clients which can not reach the storage. The length is -1 when unknown, the content type the declared one when empty.
+	PutContent(ctx context.Context, bucket string, assetID uuid.UUID, contentType string, length int64, content io.Reader) error
 	Uploaded(ctx context.Context, bucket string, assetID uuid.UUID) error
-	GetURL(ctx context.Context, bucket string, assetID uuid.UUID, timeout int64) (*url.URL, error)
+	// GetURL creates the download url of an uploaded asset, valid for the requested expiration within the bounds, or the default one if 0.
+	GetURL(ctx context.Context, bucket string, assetID uuid.UUID, expiration time.Duration) (*Download, error)
+	// GetContent returns the content of an uploaded asset to be streamed through the service, for the clients which can not reach the storage.
+	GetContent(ctx context.Context, bucket string, assetID uuid.UUID) (*Content, error)
+	// WaitProcessed returns once the asset is uploaded or failed, or after wait at most.
+	// It is woken up by the processing of the asset, within this process.
+	WaitProcessed(ctx context.Context, bucket string, assetID uuid.UUID, wait time.Duration) error
+	PutMetadata(ctx context.Context, bucket string, assetID uuid.UUID, metadata Metadata) error
+	UpdateMetadata(ctx context.Context, bucket string, assetID uuid.UUID, update MetadataUpdate) (*Metadata, error)
+	// Revoke cancels the upload urls of an asset not processed yet, it is never promoted and its uploaded content is discarded.
+	Revoke(ctx context.Context, bucket string, assetID uuid.UUID) error
+	Delete(ctx context.Context, bucket string, assetID uuid.UUID) error
+	// Restore undeletes a deleted asset, or starts the restore of an archived one and returns StateRestoring,
+	// the asset is uploaded again once its restore is done. It returns the state of the asset.
+	Restore(ctx context.Context, bucket string, assetID uuid.UUID) (AssetState, error)
+	Status(ctx context.Context, bucket string, assetID uuid.UUID) (*AssetStatus, error)
+	// History returns the events of the asset, oldest first.
+	History(ctx context.Context, bucket string, assetID uuid.UUID) ([]Event, error)
+	CollectGarbage(ctx context.Context, bucket string, dryRun bool) (*GarbageReport, error)
+	// ScheduleGarbageCollection collects the garbage of the bucket every period, logging the report of every collection.
+	// It requires a scheduler running the jobs at their date.
+	ScheduleGarbageCollection(ctx context.Context, bucket string, period time.Duration, dryRun bool) error
+	// ScheduleUploadWatcher looks for uploaded objects every period, and marks their assets as uploaded.
+	// It also processes the uploading assets whose promotion job was lost, on a restart.
+	// It requires a scheduler running the jobs at their date.
+	ScheduleUploadWatcher(ctx context.Context, bucket string, period time.Duration) error
+	// ScheduleArchive moves every period the assets uploaded longer than the archive age ago to the archive storage class.
+	// It also checks the restoring assets whose check job was lost, on a restart.
+	// It requires a scheduler running the jobs at their date, and the archive to be set.
+	ScheduleArchive(ctx context.Context, bucket string, period time.Duration) error
+	// ResumeRestores schedules again the check of every restoring asset at its date, or right away if it is overdue,
+	// since the check jobs are lost on a restart. It should be called at start up, whether the archive is scheduled or not.
+	ResumeRestores(ctx context.Context, bucket string) error
+	// ResumePurges schedules again the purge of every deleted asset at the end of its grace period, or right away if it is over,
+	// since the purge jobs are lost on a restart. It should be called at start up.
+	ResumePurges(ctx context.Context, bucket string) error
+	List(ctx context.Context, bucket string, filter ListFilter, cursor string, limit int64) (*AssetPage, error)
+}
+
+// Upload is a created asset ready to be uploaded until its urls expire.
+type Upload struct {
+	// URLs are the ones of the parts of a multipart upload, or the only one of a single part upload.
+	// SSE-C assets have none, their content is put through the service.
+	URLs      []*url.URL
+	ExpiresAt time.Time
+	// Headers are the ones the upload requests have to send, since they are signed into the urls.
+	Headers map[string]string
+}
+
+// Download is an uploaded asset ready to be downloaded.
+type Download struct {
+	URL       *url.URL
+	ExpiresAt time.Time
+	// Checksum is the one declared when the asset was created, or computed when its content was put through the service,
+	// so downloads can be checked against it.
+	Checksum Checksum
+	Metadata Metadata
 }
 
 // NewDefaultFileManager creates an AssetManager based on s3 with scheduled execution.
 func NewDefaultFileManager(svc *s3.S3) AssetManager {
+	return NewDefaultAssetManager(NewS3Storage(svc))
+}
+
+// NewDefaultAssetManager creates an AssetManager based on the given storage with scheduled execution.
+func NewDefaultAssetManager(storage Storage, options ...Option) AssetManager {
 	upsert, query := job.NewMemoryStore(job.MinutesKeys)
-	expirationDuration := 30 * time.Second
-	scheduler := schedule.NewSimpleScheduler(upsert, query, expirationDuration)
-	return News3AssetManager(svc, scheduler, expirationDuration)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, 30*time.Second)
+	return NewAssetManager(storage, scheduler, DefaultUploadExpiration, options...)
 }
 
 // News3AssetManager creates an AssetManager based on s3 with custom configuration.
+//
+// Deprecated: use NewAssetManager with NewS3Storage.
 func News3AssetManager(svc *s3.S3, scheduler schedule.SimpleScheduler, putExpirationTime time.Duration) AssetManager {
-	return &s3AssetManager{
-		svc:               svc,
-		putExpirationTime: putExpirationTime,
-		scheduler:         scheduler,
+	return NewAssetManager(NewS3Storage(svc), scheduler, putExpirationTime)
+}
+
+// NewAssetManager creates an AssetManager based on the given storage with custom configuration.
+func NewAssetManager(storage Storage, scheduler schedule.SimpleScheduler, putExpirationTime time.Duration, options ...Option) AssetManager {
+	manager := &assetManager{
+		storage:                  storage,
+		putExpirationTime:        putExpirationTime,
+		scheduler:                scheduler,
+		multipartAbortDelay:      24 * time.Hour,
+		purgeDelay:               7 * 24 * time.Hour,
+		garbageRetention:         24 * time.Hour,
+		repository:               NewMemoryRepository(),
+		waiters:                  newWaiters(),
+		reads:                    newReads(),
+		resumablePartSize:        DefaultResumablePartSize,
+		maxProxiedSize:           DefaultMaxProxiedSize,
+		writers:                  newWriters(),
+		uploadExpirationBounds:   ExpirationBounds{Min: time.Second, Max: MaxPresignExpiration},
+		downloadExpiration:       DefaultDownloadExpiration,
+		downloadExpirationBounds: ExpirationBounds{Min: time.Second, Max: MaxPresignExpiration},
+		restoreCheckPeriod:       DefaultRestoreCheckPeriod,
+	}
+	for _, option := range options {
+		option(manager)
 	}
+	return manager
+}
+
+// Option sets an optional configuration of the AssetManager.
+type Option func(manager *assetManager)
+
+// WithMultipartAbortDelay sets how long after its urls expiration a not completed multipart upload is aborted.
+func WithMultipartAbortDelay(delay time.Duration) Option {
+	return func(manager *assetManager) {
+		manager.multipartAbortDelay = delay
+	}
+}
+
+// WithRepository sets where the lifecycle state of the assets is kept, in memory by default.
+func WithRepository(repository AssetRepository) Option {
+	return func(manager *assetManager) {
+		manager.repository = repository
+	}
+}
+
+// WithUploadPolicy sets the limits the uploaded assets should comply with.
+func WithUploadPolicy(policy UploadPolicy) Option {
+	return func(manager *assetManager) {
+		manager.policy = policy
+	}
+}
+
+// UploadPolicy limits the size and content type of the uploaded assets.
+// When a limit is set, the upload urls can only be created for a declared content type or length within it.
+type UploadPolicy struct {
+	// MaxSize is the maximum size in bytes of an asset, 0 means no limit.
+	MaxSize int64
+	// ContentTypes are the allowed content types of an asset, empty means any.
+	ContentTypes []string
 }
 
-type s3AssetManager struct {
-	svc               *s3.S3
-	putExpirationTime time.Duration
-	scheduler         schedule.SimpleScheduler
+type assetManager struct {
+	storage                  Storage
+	putExpirationTime        time.Duration
+	scheduler                schedule.SimpleScheduler
+	multipartAbortDelay      time.Duration
+	policy                   UploadPolicy
+	purgeDelay               time.Duration
+	garbageRetention         time.Duration
+	repository               AssetRepository
+	notifier                 Notifier
+	waiters                  *waiters
+	reads                    *reads
+	resumablePartSize        int64
+	maxProxiedSize           int64
+	writers                  *writers
+	uploadExpirationBounds   ExpirationBounds
+	downloadExpiration       time.Duration
+	downloadExpirationBounds ExpirationBounds
+	encryption               Encryption
+	customerKeys             map[string][]byte
+	storageClassPolicy       StorageClassPolicy
+	archiveAfter             time.Duration
+	archiveStorageClass      StorageClass
+	restoreCheckPeriod       time.Duration
 }
 
-func (ps *s3AssetManager) PutURL(ctx context.Context, bucket string, assetID uuid.UUID) (*url.URL, error) {
+func (ps *assetManager) PutURL(ctx context.Context, bucket string, assetID uuid.UUID, constraints PutConstraints, expiration time.Duration) (*Upload, error) {
+	expiration, err := boundedExpiration(expiration, ps.putExpirationTime, ps.uploadExpirationBounds)
+	if err != nil {
+		return nil, err
+	}
+	constraints, err = ps.checkConstraints(constraints, false)
+	if err != nil {
+		return nil, err
+	}
+	signedAt := time.Now().UTC()
+	// The url would need the key, so the content is put through the service instead
+	if constraints.Encryption.Mode == EncryptionCustomer {
+		err = ps.createRecord(ctx, bucket, assetID, signedAt, constraints, expiration, "", "")
+		if err != nil {
+			return nil, err
+		}
+		return &Upload{ExpiresAt: signedAt.Add(expiration)}, nil
+	}
 	// Create signed url
-	signReq, _ := ps.svc.PutObjectRequest(&s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(temporalPath + assetID.String()),
-	})
-	postURLString, err := signReq.Presign(ps.putExpirationTime)
+	signed := constraints
+	signed.Encryption, err = ps.withKey(constraints.Encryption)
 	if err != nil {
-		return nil, auerr.CError(auerr.ErrorInternalError, err)
+		return nil, err
 	}
-	postURL, err := url.Parse(postURLString)
+	postURL, err := ps.storage.PresignPut(ctx, bucket, temporalPath+assetID.String(), expiration, signed)
 	if err != nil {
-		return nil, auerr.CError(auerr.ErrorInternalError, err)
+		return nil, err
 	}
-	// Create signed mark
-	tags := url.Values{}
-	tags.Set("X-Amz-Expires", postURL.Query().Get("X-Amz-Expires"))
-	tags.Set("X-Amz-Date", postURL.Query().Get("X-Amz-Date"))
-	_, err = ps.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:  aws.String(bucket),
-		Key:     aws.String(uploadedPath + assetID.String()),
-		Tagging: aws.String(tags.Encode()),
-	})
+	err = ps.createRecord(ctx, bucket, assetID, signedAt, constraints, expiration, "", "")
 	if err != nil {
-		return nil, auerr.CError(auerr.ErrorInternalError, err)
+		return nil, err
+	}
+	return &Upload{URLs: []*url.URL{postURL}, ExpiresAt: signedAt.Add(expiration), Headers: signed.Encryption.PutHeaders()}, nil
+}
+
+func (ps *assetManager) MultipartPutURLs(ctx context.Context, bucket string, assetID uuid.UUID, parts int64, constraints PutConstraints, expiration time.Duration) (*Upload, error) {
+	if parts < 1 || parts > MaxParts {
+		return nil, auerr.FError(auerr.ErrorBadInput, "Parts should be between 1 and %d, not %d", MaxParts, parts)
+	}
+	expiration, err := boundedExpiration(expiration, ps.putExpirationTime, ps.uploadExpirationBounds)
+	if err != nil {
+		return nil, err
+	}
+	// The length and checksum of the parts can not be signed, the declared ones are only checked once uploaded
+	constraints, err = ps.checkConstraints(constraints, false)
+	if err != nil {
+		return nil, err
+	}
+	if constraints.Encryption.Mode == EncryptionCustomer {
+		return nil, auerr.FError(auerr.ErrorBadInput, "Encryption %s can not be uploaded in parts, its content should be put through the service", EncryptionCustomer)
+	}
+	encryption := constraints.Encryption
+	signedAt := time.Now().UTC()
+	key := temporalPath + assetID.String()
+	uploadID, err := ps.storage.CreateMultipartUpload(ctx, bucket, key, constraints.ContentType, encryption)
+	if err != nil {
+		return nil, err
+	}
+	// Create signed urls for every part
+	partURLs := make([]*url.URL, 0, parts)
+	for partNumber := int64(1); partNumber <= parts; partNumber++ {
+		partURL, err := ps.storage.PresignUploadPart(ctx, bucket, key, uploadID, partNumber, expiration, encryption)
+		if err != nil {
+			return nil, err
+		}
+		partURLs = append(partURLs, partURL)
+	}
+	err = ps.createRecord(ctx, bucket, assetID, signedAt, constraints, expiration, uploadID, fmt.Sprintf("%d parts", parts))
+	if err != nil {
+		return nil, err
+	}
+	// Abort the upload if it is abandoned
+	abortDate := signedAt.Add(expiration + ps.multipartAbortDelay)
+	abortJob := job.NewFixedDateJob(assetID.String()+"-abort", ps.newAbortFunction(bucket, key, uploadID), abortDate)
+	err = ps.scheduler.Schedule(ctx, *abortJob)
+	if err != nil {
+		return nil, err
+	}
+	// The encryption is the one of the upload, so the parts do not send it
+	return &Upload{URLs: partURLs, ExpiresAt: signedAt.Add(expiration)}, nil
+}
+
+// createRecord records the created asset with the signed date and expiration of its urls.
+func (ps *assetManager) createRecord(ctx context.Context, bucket string, assetID uuid.UUID, signedAt time.Time, constraints PutConstraints, expiration time.Duration, uploadID string, detail string) error {
+	return ps.repository.Create(ctx, newRecord(bucket, assetID, signedAt, constraints, expiration, uploadID, detail))
+}
+
+func newRecord(bucket string, assetID uuid.UUID, signedAt time.Time, constraints PutConstraints, expiration time.Duration, uploadID string, detail string) *AssetRecord {
+	return &AssetRecord{
+		Bucket:      bucket,
+		ID:          assetID,
+		State:       StateCreated,
+		Constraints: constraints,
+		Expiration:  expiration,
+		UploadID:    uploadID,
+		CreatedAt:   signedAt,
+		UpdatedAt:   signedAt,
+		History:     []Transition{{State: StateCreated, At: signedAt}},
+		Events:      []Event{{Type: EventURLsIssued, At: signedAt, Detail: detail}},
+	}
+}
+
+// checkConstraints checks the declared constraints against the upload policy and returns them normalized.
+// When the length is always declared, a zero one is an empty content, otherwise it is an undeclared length.
+func (ps *assetManager) checkConstraints(constraints PutConstraints, lengthDeclared bool) (PutConstraints, error) {
+	if constraints.ContentLength < 0 {
+		return constraints, auerr.FError(auerr.ErrorBadInput, "Content length should be positive, not %d", constraints.ContentLength)
+	}
+	if ps.policy.MaxSize > 0 {
+		if constraints.ContentLength == 0 && !lengthDeclared {
+			return constraints, auerr.SError(auerr.ErrorBadInput, "Content length is required")
+		}
+		if constraints.ContentLength > ps.policy.MaxSize {
+			return constraints, auerr.FError(auerr.ErrorBadInput, "Content length should be at most %d, not %d", ps.policy.MaxSize, constraints.ContentLength)
+		}
+	}
+	if constraints.ContentType != "" {
+		// Parameters are not allowed since they can not be signed into local storage urls
+		mediaType, params, err := mime.ParseMediaType(constraints.ContentType)
+		if err != nil || len(params) > 0 || mediaType != constraints.ContentType {
+			return constraints, auerr.FError(auerr.ErrorBadInput, "Content type %s should be a media type without parameters", constraints.ContentType)
+		}
+	}
+	if len(ps.policy.ContentTypes) > 0 && !ps.allowedContentType(constraints.ContentType) {
+		return constraints, auerr.FError(auerr.ErrorBadInput, "Content type should be one of %s, not %s", strings.Join(ps.policy.ContentTypes, ", "), constraints.ContentType)
+	}
+	if constraints.Checksum.MD5 != "" {
+		digest, err := base64.StdEncoding.DecodeString(constraints.Checksum.MD5)
+		if err != nil || len(digest) != md5.Size {
+			return constraints, auerr.FError(auerr.ErrorBadInput, "Content MD5 %s should be a base64 encoded md5 digest", constraints.Checksum.MD5)
+		}
+	}
+	if constraints.Checksum.SHA256 != "" {
+		// s3 expects it in lower case
+		constraints.Checksum.SHA256 = strings.ToLower(constraints.Checksum.SHA256)
+		digest, err := hex.DecodeString(constraints.Checksum.SHA256)
+		if err != nil || len(digest) != sha256.Size {
+			return constraints, auerr.FError(auerr.ErrorBadInput, "Content SHA256 %s should be a hex encoded sha256 digest", constraints.Checksum.SHA256)
+		}
+	}
+	encryption, err := ps.checkEncryption(constraints.Encryption)
+	if err != nil {
+		return constraints, err
+	}
+	constraints.Encryption = encryption
+	storageClass, err := checkStorageClass(constraints.StorageClass)
+	if err != nil {
+		return constraints, err
+	}
+	constraints.StorageClass = storageClass
+	return constraints, nil
+}
+
+func (ps *assetManager) allowedContentType(contentType string) bool {
+	for _, allowed := range ps.policy.ContentTypes {
+		if allowed == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func (ps *assetManager) newAbortFunction(bucket string, key string, uploadID string) job.Function {
+	return func(ctx context.Context) error {
+		err := ps.storage.AbortMultipartUpload(ctx, bucket, key, uploadID)
+		if auerr.Is(err, auerr.ErrorNotFound) {
+			// Already completed or aborted
+			return nil
+		}
+		return err
 	}
-	return postURL, nil
 }
-func (ps *s3AssetManager) Uploaded(ctx context.Context, bucket string, assetID uuid.UUID) error {
-	tags, err := ps.checkIsNotUploaded(ctx, bucket, uploadedPath, assetID)
+
+// schedulePeriodic schedules f at the given date, and once done, again every period.
+// Every execution is a job of its own, the finished ones are evicted by the job store.
+func (ps *assetManager) schedulePeriodic(ctx context.Context, name string, period time.Duration, date time.Time, f job.Function) error {
+	periodicJob := job.NewFixedDateJob(name+"-"+date.Format(dateFormat), func(ctx context.Context) error {
+		// The next execution is scheduled even if this one fails
+		defer func() {
+			err := ps.schedulePeriodic(ctx, name, period, time.Now().UTC().Add(period), f)
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}()
+		return f(ctx)
+	}, date)
+	return ps.scheduler.Schedule(ctx, *periodicJob)
+}
+
+func (ps *assetManager) Uploaded(ctx context.Context, bucket string, assetID uuid.UUID) error {
+	return ps.uploaded(ctx, bucket, assetID, EventUploadReported)
+}
+
+// uploaded marks the asset as uploaded, recording who did it with the given event.
+func (ps *assetManager) uploaded(ctx context.Context, bucket string, assetID uuid.UUID, eventType EventType) error {
+	record, err := ps.checkIsNotUploaded(ctx, bucket, assetID)
 	if err != nil {
 		return err
 	}
-	expireS := tags["X-Amz-Expires"]
-	expire, err := strconv.Atoi(*expireS.Value)
+	err = ps.recordEvent(ctx, bucket, assetID, eventType, "")
 	if err != nil {
-		return auerr.CError(auerr.ErrorInternalError, err)
+		return err
 	}
-	dateS := tags["X-Amz-Date"]
-	date, err := time.Parse("20060102T150405Z0700", *dateS.Value)
+	encryption, err := ps.withKey(record.Constraints.Encryption)
 	if err != nil {
-		return auerr.CError(auerr.ErrorInternalError, err)
+		return err
+	}
+	if record.UploadID != "" {
+		err = ps.completeMultipartUpload(ctx, bucket, assetID, record.UploadID, encryption)
+		if err != nil {
+			return err
+		}
+	}
+	// Promote right away if the upload is already done, the delayed job is left for the uploads still in flight
+	info, err := ps.storage.Head(ctx, bucket, temporalPath+assetID.String(), encryption)
+	if err != nil && !auerr.Is(err, auerr.ErrorNotFound) {
+		return err
+	}
+	if err == nil && isComplete(record, info) {
+		return ps.newUploadedFunction(bucket, assetID)(ctx)
+	}
+	expire := time.Duration(math.Round(record.Expiration.Seconds()*1.10)) * time.Second
+	expirationDate := record.CreatedAt.Add(expire)
+	// Record when the promotion is expected, so its status can be queried meanwhile
+	_, err = ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		// Deleted or revoked meanwhile
+		if record.State != StateCreated && record.State != StateUploading {
+			return stateError(record)
+		}
+		now := time.Now().UTC()
+		record.PromoteAt = expirationDate
+		record.Error = ""
+		record.addEvent(EventPromotionScheduled, now, expirationDate.Format(time.RFC3339))
+		return record.moveTo(StateUploading, now)
+	})
+	if err != nil {
+		return err
 	}
-	expire = int(math.Round(float64(expire) * 1.10))
-	expirationDate := date.Add(time.Duration(expire) * time.Second)
 	job := job.NewFixedDateJob(assetID.String(), ps.newUploadedFunction(bucket, assetID), expirationDate)
 	return ps.scheduler.Schedule(ctx, *job)
 }
 
-func (ps *s3AssetManager) newUploadedFunction(bucket string, assetID uuid.UUID) job.Function {
+// isComplete returns if the uploaded object has the declared length, any object is complete when none was declared.
+func isComplete(record *AssetRecord, info *ObjectInfo) bool {
+	declared := record.Constraints.ContentLength
+	return declared == 0 || declared == info.Size
+}
+
+func (ps *assetManager) completeMultipartUpload(ctx context.Context, bucket string, assetID uuid.UUID, uploadID string, encryption Encryption) error {
+	key := temporalPath + assetID.String()
+	err := ps.storage.CompleteMultipartUpload(ctx, bucket, key, uploadID)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		return err
+	}
+	// The upload is gone, it is fine as long as it was completed by a previous call
+	_, err = ps.storage.Head(ctx, bucket, key, encryption)
+	if auerr.Is(err, auerr.ErrorNotFound) {
+		return auerr.FError(auerr.ErrorNotFound, "Multipart upload of asset %s is not found", assetID.String())
+	}
+	return err
+}
+
+func (ps *assetManager) newUploadedFunction(bucket string, assetID uuid.UUID) job.Function {
 	return func(ctx context.Context) error {
-		// Check if the asset metadata is present and already contains the uploaded tags
-		// if its not present, it means not signed Url has been generated
-		tags, err := ps.checkIsNotUploaded(ctx, bucket, uploadedPath, assetID)
-		if err != nil {
-			return err
+		err := ps.promote(ctx, bucket, assetID)
+		if auerr.Is(err, auerr.ErrorConflict) {
+			// Already promoted, right away when marked as uploaded, or revoked meanwhile
+			return ps.discardRevoked(ctx, bucket, assetID)
 		}
-		// Move the asset to the uploaded folder with proper tags
-		updatedTags := url.Values{status: []string{uploaded}}
-		for k, v := range tags {
-			updatedTags.Add(k, *v.Value)
+		if err != nil {
+			ps.recordError(ctx, bucket, assetID, err)
 		}
-		_, err = ps.svc.CopyObjectWithContext(
-			ctx,
-			&s3.CopyObjectInput{
-				CopySource:       aws.String(bucket + "/" + temporalPath + assetID.String()),
-				Bucket:           aws.String(bucket),
-				Key:              aws.String(uploadedPath + assetID.String()),
-				Tagging:          aws.String(updatedTags.Encode()),
-				TaggingDirective: aws.String(s3.TaggingDirectiveReplace),
-			},
-		)
-		return ps.handleAwsError(err, assetID)
+		return err
 	}
 }
 
-func (ps *s3AssetManager) GetURL(ctx context.Context, bucket string, assetID uuid.UUID, timeout int64) (*url.URL, error) {
-	_, err := ps.checkIsUploaded(ctx, bucket, uploadedPath, assetID)
+// promote moves the uploaded object to the uploaded folder, or marks the asset as failed if it does not comply.
+func (ps *assetManager) promote(ctx context.Context, bucket string, assetID uuid.UUID) error {
+	// Only the created or uploading assets can be processed, so concurrent promotions do not overlap
+	record, err := ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		if record.State != StateCreated && record.State != StateUploading {
+			return stateError(record)
+		}
+		now := time.Now().UTC()
+		record.addEvent(EventPromotionExecuted, now, "")
+		return record.moveTo(StateProcessing, now)
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req, _ := ps.svc.GetObjectRequest(
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(uploadedPath + assetID.String()),
-		})
-
-	getURLString, err := req.Presign(time.Duration(timeout) * time.Second)
+	encryption, err := ps.withKey(record.Constraints.Encryption)
+	if err != nil {
+		return err
+	}
+	info, err := ps.storage.Head(ctx, bucket, temporalPath+assetID.String(), encryption)
+	if err != nil {
+		return ps.assetError(err, assetID)
+	}
+	reason := ps.violation(record, info)
+	if reason == "" {
+		reason, err = ps.checksumViolation(ctx, bucket, assetID, record, info, encryption)
+		if err != nil {
+			return err
+		}
+	}
+	// The asset does not comply with the policy, so it is not promoted and stays failed
+	if reason != "" {
+		return ps.processed(ctx, bucket, assetID, info, StateFailed, reason)
+	}
+	// Move the asset to the uploaded folder, tagged so it can be told apart in the bucket, with the same encryption
+	storageClass := ps.promotionStorageClass(record, info.Size)
+	err = ps.storage.Copy(ctx, bucket, temporalPath+assetID.String(), uploadedPath+assetID.String(), map[string]string{status: uploaded}, encryption, storageClass)
 	if err != nil {
-		return nil, auerr.CError(auerr.ErrorInternalError, err)
+		return ps.assetError(err, assetID)
 	}
+	// The promoted object is in the storage class of the copy
+	info.StorageClass = storageClass
+	return ps.processed(ctx, bucket, assetID, info, StateUploaded, "")
+}
 
-	getURL, err := url.Parse(getURLString)
+// processed records the final state of a processed asset with the information of its uploaded object.
+func (ps *assetManager) processed(ctx context.Context, bucket string, assetID uuid.UUID, info *ObjectInfo, state AssetState, reason string) error {
+	eventType := EventPromotionSucceeded
+	if state == StateFailed {
+		eventType = EventPromotionFailed
+	}
+	record, err := ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		// Deleted meanwhile, it is promoted again if restored
+		if record.State != StateProcessing {
+			return auerr.FError(auerr.ErrorConflict, "Asset %s is %s", assetID.String(), record.State)
+		}
+		record.Size = info.Size
+		record.ContentType = info.ContentType
+		record.StorageClass = info.StorageClass
+		now := time.Now().UTC()
+		record.PromoteAt = time.Time{}
+		record.Error = reason
+		record.addEvent(eventType, now, reason)
+		return record.moveTo(state, now)
+	})
 	if err != nil {
-		return nil, auerr.CError(auerr.ErrorInternalError, err)
+		return err
 	}
-	return getURL, nil
+	ps.waiters.wake(recordKey(bucket, assetID))
+	ps.notify(ctx, record, eventType, reason)
+	return nil
+}
 
+// violation returns why the uploaded object does not comply with its declared constraints or the policy, empty if it does.
+func (ps *assetManager) violation(record *AssetRecord, info *ObjectInfo) string {
+	if declared := record.Constraints.ContentLength; declared > 0 && declared != info.Size {
+		return "content length does not match the declared one"
+	}
+	if ps.policy.MaxSize > 0 && info.Size > ps.policy.MaxSize {
+		return "content length exceeds the max size"
+	}
+	if declared := record.Constraints.ContentType; declared != "" && declared != info.ContentType {
+		return "content type does not match the declared one"
+	}
+	if len(ps.policy.ContentTypes) > 0 && !ps.allowedContentType(info.ContentType) {
+		return "content type is not allowed"
+	}
+	return ""
 }
-func (ps *s3AssetManager) handleAwsError(err error, assetID uuid.UUID) error {
-	if err != nil {
-		if awsErr, ok := err.(awserr.RequestFailure); ok {
-			switch code := awsErr.StatusCode(); code {
-			case 404:
-				return auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", assetID.String())
-			default:
-				return auerr.CError(auerr.ErrorInternalError, err)
-			}
+
+// checksumViolation returns why the uploaded object does not match its declared checksum, empty if it does.
+func (ps *assetManager) checksumViolation(ctx context.Context, bucket string, assetID uuid.UUID, record *AssetRecord, info *ObjectInfo, encryption Encryption) (string, error) {
+	declaredMD5, declaredSHA256 := record.Constraints.Checksum.MD5, record.Constraints.Checksum.SHA256
+	if declaredMD5 == "" && declaredSHA256 == "" {
+		return "", nil
+	}
+	// The etag of a single part object is its md5, so there is no need to read it, unless it is encrypted with a customer or kms key
+	if declaredSHA256 == "" && (encryption.Mode == EncryptionNone || encryption.Mode == EncryptionS3) {
+		if digest, err := base64.StdEncoding.DecodeString(declaredMD5); err == nil && info.ETag == `"`+hex.EncodeToString(digest)+`"` {
+			return "", nil
 		}
-		return auerr.CError(auerr.ErrorInternalError, err)
 	}
-	return nil
+	content, err := ps.storage.Get(ctx, bucket, temporalPath+assetID.String(), encryption)
+	if err != nil {
+		return "", ps.assetError(err, assetID)
+	}
+	defer content.Close()
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(md5Hash, sha256Hash), content)
+	if err != nil {
+		return "", auerr.CError(auerr.ErrorInternalError, err)
+	}
+	if declaredMD5 != "" && declaredMD5 != base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)) {
+		return "content md5 does not match the declared one", nil
+	}
+	if declaredSHA256 != "" && declaredSHA256 != hex.EncodeToString(sha256Hash.Sum(nil)) {
+		return "content sha256 does not match the declared one", nil
+	}
+	return "", nil
 }
-func (ps *s3AssetManager) checkIsUploaded(ctx context.Context, bucket string, path string, assetID uuid.UUID) (map[string]*s3.Tag, error) {
-	tags, err := ps.tags(ctx, bucket, path, assetID)
+
+func (ps *assetManager) GetURL(ctx context.Context, bucket string, assetID uuid.UUID, expiration time.Duration) (*Download, error) {
+	expiration, err := boundedExpiration(expiration, ps.downloadExpiration, ps.downloadExpirationBounds)
 	if err != nil {
 		return nil, err
 	}
-	if tag, ok := tags[status]; ok {
-		if *tag.Value == uploaded {
-			return tags, nil
-		}
+	record, err := ps.checkIsUploaded(ctx, bucket, assetID)
+	if err != nil {
+		return nil, err
 	}
-	return nil, auerr.FError(auerr.ErrorNotFound, "Can not find assetID %s with status uploaded", assetID.String())
+	// The url would need the key, which is never shared
+	if record.Constraints.Encryption.Mode == EncryptionCustomer {
+		return nil, auerr.FError(auerr.ErrorForbidden, "Asset %s is encrypted with %s, its content should be downloaded through the service", assetID.String(), EncryptionCustomer)
+	}
+	signedAt := time.Now().UTC()
+	getURL, err := ps.storage.PresignGet(ctx, bucket, uploadedPath+assetID.String(), expiration, record.Constraints.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	ps.reads.add(recordKey(bucket, assetID), EventDownloadURLIssued, fmt.Sprintf("expires in %ds", int64(expiration.Seconds())))
+	return &Download{
+		URL:       getURL,
+		ExpiresAt: signedAt.Add(expiration),
+		Checksum:  record.checksum(),
+		Metadata:  record.Metadata,
+	}, nil
+}
+
+// assetError replaces the storage not found error with an asset one, so the storage layout is not leaked.
+func (ps *assetManager) assetError(err error, assetID uuid.UUID) error {
+	if auerr.Is(err, auerr.ErrorNotFound) {
+		return auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", assetID.String())
+	}
+	return err
 }
 
-func (ps *s3AssetManager) checkIsNotUploaded(ctx context.Context, bucket string, path string, assetID uuid.UUID) (map[string]*s3.Tag, error) {
-	tags, err := ps.tags(ctx, bucket, path, assetID)
+func (ps *assetManager) checkIsUploaded(ctx context.Context, bucket string, assetID uuid.UUID) (*AssetRecord, error) {
+	record, err := ps.record(ctx, bucket, assetID)
 	if err != nil {
 		return nil, err
 	}
-	if tag, ok := tags[status]; ok {
-		if *tag.Value == uploaded {
-			return nil, auerr.FError(auerr.ErrorConflict, "Asset %s already uploaded", assetID.String())
-		}
+	switch record.State {
+	case StateUploaded:
+		return record, nil
+	case StateArchived:
+		return nil, auerr.FError(auerr.ErrorConflict, "Asset %s is archived, it should be restored first", assetID.String())
+	case StateRestoring:
+		return nil, auerr.FError(auerr.ErrorConflict, "Asset %s is being restored", assetID.String())
 	}
-	return tags, nil
+	return nil, auerr.FError(auerr.ErrorNotFound, "Can not find assetID %s with status uploaded", assetID.String())
 }
-func (ps *s3AssetManager) tags(ctx context.Context, bucket string, path string, assetID uuid.UUID) (map[string]*s3.Tag, error) {
-	//Check if it exist
-	result, err := ps.svc.GetObjectTaggingWithContext(
-		ctx,
-		&s3.GetObjectTaggingInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(path + assetID.String()),
-		},
-	)
-	err = ps.handleAwsError(err, assetID)
+
+func (ps *assetManager) checkIsNotUploaded(ctx context.Context, bucket string, assetID uuid.UUID) (*AssetRecord, error) {
+	record, err := ps.record(ctx, bucket, assetID)
 	if err != nil {
 		return nil, err
 	}
-	tags := make(map[string]*s3.Tag, len(result.TagSet))
-	for _, tag := range result.TagSet {
-		tags[*tag.Key] = tag
+	if record.State != StateCreated && record.State != StateUploading {
+		return nil, stateError(record)
+	}
+	return record, nil
+}
 
+// stateError returns why the asset can not be marked as uploaded in its state.
+func stateError(record *AssetRecord) error {
+	switch record.State {
+	case StateUploaded:
+		return auerr.FError(auerr.ErrorConflict, "Asset %s already uploaded", record.ID.String())
+	case StateFailed:
+		return auerr.FError(auerr.ErrorConflict, "Asset %s upload failed: %s", record.ID.String(), record.Error)
+	case StateRevoked:
+		return auerr.FError(auerr.ErrorConflict, "Asset %s was revoked", record.ID.String())
+	case StateDeleted:
+		return auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", record.ID.String())
+	}
+	return auerr.FError(auerr.ErrorConflict, "Asset %s is %s", record.ID.String(), record.State)
+}
+
+// record returns the record of the asset, deleted assets are not found.
+func (ps *assetManager) record(ctx context.Context, bucket string, assetID uuid.UUID) (*AssetRecord, error) {
+	record, err := ps.repository.Get(ctx, bucket, assetID)
+	if err != nil {
+		return nil, err
+	}
+	// Deleted assets are only visible to restore them
+	if record.State == StateDeleted {
+		return nil, auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", assetID.String())
 	}
-	return tags, nil
+	return record, nil
 }
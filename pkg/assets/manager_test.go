@@ -2,21 +2,31 @@ package assets_test
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/tgracchus/assetuploader/pkg/assets"
 	"github.com/tgracchus/assetuploader/pkg/auerr"
 	"github.com/tgracchus/assetuploader/pkg/job"
+	"github.com/tgracchus/assetuploader/pkg/s3test"
 	"github.com/tgracchus/assetuploader/pkg/schedule"
 	"github.com/tgracchus/assetuploader/pkg/util"
 )
@@ -27,26 +37,52 @@ var tickPeriod = 500 * time.Millisecond
 var waitTimeout = 6 * time.Second
 var waitTime = 1 * time.Second
 
-// TestS3AssetManager requires to set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY env variables.
+// TestS3AssetManager runs against the fake s3 server unless AWS_BUCKET is set,
+// then it requires to set AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY env variables.
 func TestS3AssetManager(t *testing.T) {
-	region := os.Getenv("AWS_REGION")
-	bucket := os.Getenv("AWS_BUCKET")
-	credentials := credentials.NewEnvCredentials()
-	session, err := assets.NewAwsSession(credentials, region)
-	if err != nil {
-		t.Fatal(err)
-	}
-	svc := assets.NewS3Client(session, region)
-
+	svc, bucket, expectedHost, expectedPathPrefix := newTestS3Client(t)
 	upsert, query := job.NewMemoryStore(job.MillisKeys)
 
 	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
-	manager := assets.News3AssetManager(svc, scheduler, expirationDuration)
+	manager := assets.NewAssetManager(assets.NewS3Storage(svc), scheduler, expirationDuration)
 	t.Run("TestUpdateIt", newTestUpdateIt(manager, bucket))
 	t.Run("TestOverwrite", newTestOverwrite(manager, bucket))
 	t.Run("TestUpdateItFileDoesNotExist", newTestUpdateItFileDoesNotExist(manager, bucket))
-	t.Run("TestPutUrl", newTestPutUrl(manager, bucket, region))
+	t.Run("TestPutUrl", newTestPutUrl(manager, bucket, expectedHost, expectedPathPrefix))
+	t.Run("TestMultipart", newTestMultipart(manager, bucket))
+	t.Run("TestResumable", newTestResumable(manager, bucket))
+	t.Run("TestProxyUpload", newTestProxyUpload(manager, bucket))
+	t.Run("TestProxyDownload", newTestProxyDownload(manager, bucket))
+	t.Run("TestPutUrlConstraints", newTestPutUrlConstraints(manager, bucket))
+	t.Run("TestPutUrlChecksum", newTestPutUrlChecksum(manager, bucket))
+	t.Run("TestDeleteAndRestore", newTestDeleteAndRestore(manager, bucket))
+	t.Run("TestList", newTestList(manager, bucket))
+
+}
 
+func newTestS3Client(t *testing.T) (*s3.S3, string, string, string) {
+	region := os.Getenv("AWS_REGION")
+	bucket := os.Getenv("AWS_BUCKET")
+	if bucket != "" {
+		session, err := assets.NewAwsSession(credentials.NewEnvCredentials(), region)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return assets.NewS3Client(session, region), bucket, bucket + ".s3." + region + ".amazonaws.com", "/"
+	}
+	region = "eu-west-1"
+	bucket = "testBucket"
+	server := s3test.NewServer(region, "accessKey", "secretKey")
+	server.CreateBucket(bucket)
+	session, err := assets.NewAwsSession(credentials.NewStaticCredentials("accessKey", "secretKey", ""), region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assets.NewS3ClientWithEndpoint(session, region, server.URL), bucket, serverURL.Hostname(), "/" + bucket + "/"
 }
 
 func newTestUpdateIt(manager assets.AssetManager, bucket string) func(t *testing.T) {
@@ -56,10 +92,11 @@ func newTestUpdateIt(manager assets.AssetManager, bucket string) func(t *testing
 			t.Fatal(err)
 		}
 		ctx := context.Background()
-		putUrl, err := manager.PutURL(ctx, bucket, assetId)
+		upload, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
+		putUrl := upload.URLs[0]
 		req, err := http.NewRequest("PUT", putUrl.String(), strings.NewReader("CONTENT"))
 		if err != nil {
 			fmt.Println("error creating request", putUrl.String())
@@ -77,7 +114,7 @@ func newTestUpdateIt(manager assets.AssetManager, bucket string) func(t *testing
 		if err != nil {
 			t.Fatal(err)
 		}
-		getUrl := waitForGet(ctx, t, manager, bucket, assetId)
+		getUrl := waitForGet(ctx, t, manager, bucket, assetId).URL
 		req, err = http.NewRequest("GET", getUrl.String(), nil)
 		if err != nil {
 			fmt.Println("error creating request", getUrl.String())
@@ -108,10 +145,11 @@ func newTestOverwrite(manager assets.AssetManager, bucket string) func(t *testin
 			t.Fatal(err)
 		}
 		ctx := context.Background()
-		putURL, err := manager.PutURL(ctx, bucket, assetId)
+		upload, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
+		putURL := upload.URLs[0]
 
 		req, err := http.NewRequest("PUT", putURL.String(), strings.NewReader("CONTENT"))
 		if err != nil {
@@ -130,7 +168,7 @@ func newTestOverwrite(manager assets.AssetManager, bucket string) func(t *testin
 		if err != nil {
 			t.Fatal(err)
 		}
-		getUrl := waitForGet(ctx, t, manager, bucket, assetId)
+		getUrl := waitForGet(ctx, t, manager, bucket, assetId).URL
 		req, err = http.NewRequest("GET", getUrl.String(), nil)
 		if err != nil {
 			fmt.Println("error creating request", getUrl.String())
@@ -153,6 +191,325 @@ func newTestOverwrite(manager assets.AssetManager, bucket string) func(t *testin
 		}
 	}
 }
+func newTestPutUrlConstraints(manager assets.AssetManager, bucket string) func(t *testing.T) {
+	return func(t *testing.T) {
+		assetId, err := uuid.NewRandom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		upload, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{ContentType: "text/plain", ContentLength: 7}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		putURL := upload.URLs[0]
+		put := func(contentType string, content string) int {
+			req, err := http.NewRequest("PUT", putURL.String(), strings.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", contentType)
+			response, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return response.StatusCode
+		}
+		// The declared content type and length are signed
+		if code := put("image/png", "CONTENT"); code != http.StatusForbidden {
+			t.Fatalf("Put with another content type should be forbidden, got %d", code)
+		}
+		if code := put("text/plain", "CONTENTS"); code != http.StatusForbidden {
+			t.Fatalf("Put with another content length should be forbidden, got %d", code)
+		}
+		if code := put("text/plain", "CONTENT"); code != http.StatusOK {
+			t.Fatalf("Error put with code %d", code)
+		}
+		err = manager.Uploaded(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForGet(ctx, t, manager, bucket, assetId)
+	}
+}
+
+func newTestPutUrlChecksum(manager assets.AssetManager, bucket string) func(t *testing.T) {
+	return func(t *testing.T) {
+		assetId, err := uuid.NewRandom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		checksum := newChecksum("CONTENT")
+		upload, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{Checksum: checksum}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		putURL := upload.URLs[0]
+		put := func(content string) int {
+			req, err := http.NewRequest("PUT", putURL.String(), strings.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-MD5", checksum.MD5)
+			req.Header.Set("X-Amz-Content-Sha256", checksum.SHA256)
+			response, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return response.StatusCode
+		}
+		// The declared checksum is signed and checked against the content
+		if code := put("CORRUPT"); code != http.StatusBadRequest {
+			t.Fatalf("Put with another content should be rejected, got %d", code)
+		}
+		if code := put("CONTENT"); code != http.StatusOK {
+			t.Fatalf("Error put with code %d", code)
+		}
+		err = manager.Uploaded(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		download := waitForGet(ctx, t, manager, bucket, assetId)
+		if download.Checksum != checksum {
+			t.Fatalf("Checksum should be %+v, not %+v", checksum, download.Checksum)
+		}
+	}
+}
+
+func newTestDeleteAndRestore(manager assets.AssetManager, bucket string) func(t *testing.T) {
+	return func(t *testing.T) {
+		assetId, err := uuid.NewRandom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		_, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = manager.Delete(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = manager.Uploaded(ctx, bucket, assetId)
+		if !auerr.Is(err, auerr.ErrorNotFound) {
+			t.Fatalf("Deleted asset should not be found, got %v", err)
+		}
+		_, err = manager.Restore(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = manager.PutMetadata(ctx, bucket, assetId, assets.Metadata{Owner: "owner"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestList(manager assets.AssetManager, bucket string) func(t *testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		// The bucket is shared, so only the assets labeled by this test are listed
+		run := uuid.New().String()
+		for i := 0; i < 3; i++ {
+			assetId := uuid.New()
+			_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = manager.PutMetadata(ctx, bucket, assetId, assets.Metadata{Labels: map[string]string{"run": run}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		filter := assets.ListFilter{States: []assets.AssetState{assets.StateCreated}, Labels: map[string]string{"run": run}}
+		listed := 0
+		cursor := ""
+		for {
+			page, err := manager.List(ctx, bucket, filter, cursor, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listed += len(page.Assets)
+			if page.Cursor == "" {
+				break
+			}
+			cursor = page.Cursor
+		}
+		if listed != 3 {
+			t.Fatalf("Listed assets should be 3, not %d", listed)
+		}
+	}
+}
+
+func newTestMultipart(manager assets.AssetManager, bucket string) func(t *testing.T) {
+	return func(t *testing.T) {
+		assetId, err := uuid.NewRandom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		upload, err := manager.MultipartPutURLs(ctx, bucket, assetId, 2, assets.PutConstraints{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partURLs := upload.URLs
+		if len(partURLs) != 2 {
+			t.Fatalf("We expected 2 part urls, not %d", len(partURLs))
+		}
+		// Every part but the last one should be at least 5MB
+		firstPart := strings.Repeat("A", 5*1024*1024)
+		for i, part := range []string{firstPart, "CONTENT"} {
+			req, err := http.NewRequest("PUT", partURLs[i].String(), strings.NewReader(part))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != 200 {
+				t.Fatalf("Error put part with code %d", response.StatusCode)
+			}
+		}
+		err = manager.Uploaded(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		getUrl := waitForGet(ctx, t, manager, bucket, assetId).URL
+		response, err := http.Get(getUrl.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Error get with code %d", response.StatusCode)
+		}
+		bodyBytes, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bodyBytes) != firstPart+"CONTENT" {
+			t.Fatalf("Body should be the parts content, not %d bytes", len(bodyBytes))
+		}
+	}
+}
+
+func newTestResumable(manager assets.AssetManager, bucket string) func(t *testing.T) {
+	return func(t *testing.T) {
+		assetId, err := uuid.NewRandom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		content := strings.Repeat("A", 5*1024*1024) + "CONTENT"
+		_, err = manager.CreateResumableUpload(ctx, bucket, assetId, assets.PutConstraints{ContentLength: int64(len(content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first chunk fills a part and leaves the rest pending, the second one completes it
+		offset := int64(0)
+		for _, chunk := range []string{content[:5*1024*1024+3], content[5*1024*1024+3:]} {
+			progress, err := manager.WriteChunk(ctx, bucket, assetId, offset, strings.NewReader(chunk))
+			if err != nil {
+				t.Fatal(err)
+			}
+			offset = progress.Offset
+		}
+		if offset != int64(len(content)) {
+			t.Fatalf("Upload offset should be %d, not %d", len(content), offset)
+		}
+		getUrl := waitForGet(ctx, t, manager, bucket, assetId).URL
+		response, err := http.Get(getUrl.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bodyBytes) != content {
+			t.Fatalf("Body should be the chunks content, not %d bytes", len(bodyBytes))
+		}
+	}
+}
+
+func newTestProxyUpload(manager assets.AssetManager, bucket string) func(t *testing.T) {
+	return func(t *testing.T) {
+		assetId, err := uuid.NewRandom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		// Over a part, so it is streamed in two of them
+		content := strings.Repeat("A", 5*1024*1024) + "CONTENT"
+		_, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{ContentType: "text/plain", Checksum: newChecksum(content)}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = manager.PutContent(ctx, bucket, assetId, "text/plain", -1, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		getUrl := waitForGet(ctx, t, manager, bucket, assetId).URL
+		response, err := http.Get(getUrl.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyBytes, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bodyBytes) != content {
+			t.Fatalf("Body should be the put content, not %d bytes", len(bodyBytes))
+		}
+	}
+}
+
+func newTestProxyDownload(manager assets.AssetManager, bucket string) func(t *testing.T) {
+	return func(t *testing.T) {
+		assetId, err := uuid.NewRandom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		_, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{ContentType: "text/plain"}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = manager.PutContent(ctx, bucket, assetId, "", -1, strings.NewReader("CONTENT"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForGet(ctx, t, manager, bucket, assetId)
+		content, err := manager.GetContent(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer content.Body.Close()
+		if content.Size != 7 || content.ContentType != "text/plain" || content.ETag == "" || content.LastModified.IsZero() {
+			t.Fatalf("Content should be the uploaded object, not %+v", content)
+		}
+		assertContentRange(t, content.Body, 4, 3, "ENT")
+		assertContentRange(t, content.Body, 1, 3, "ONT")
+	}
+}
+
+// assertContentRange reads length bytes of the content from offset.
+func assertContentRange(t *testing.T, content io.ReadSeeker, offset int64, length int64, expected string) {
+	_, err := content.Seek(offset, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(content, length))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != expected {
+		t.Fatalf("Content from %d should be %s, not %s", offset, expected, body)
+	}
+}
+
 func newTestUpdateItFileDoesNotExist(manager assets.AssetManager, bucket string) func(t *testing.T) {
 	return func(t *testing.T) {
 		assetId, err := uuid.NewRandom()
@@ -167,28 +524,1916 @@ func newTestUpdateItFileDoesNotExist(manager assets.AssetManager, bucket string)
 	}
 }
 
-func newTestPutUrl(manager assets.AssetManager, bucket string, region string) func(t *testing.T) {
+func newTestPutUrl(manager assets.AssetManager, bucket string, expectedHostName string, expectedPathPrefix string) func(t *testing.T) {
 	return func(t *testing.T) {
 		assetId, err := uuid.NewRandom()
 		if err != nil {
 			t.Fatal(err)
 		}
 		ctx := context.Background()
-		putURL, err := manager.PutURL(ctx, bucket, assetId)
+		upload, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
-		expectedHostName := bucket + ".s3." + region + ".amazonaws.com"
+		putURL := upload.URLs[0]
 		if putURL.Hostname() != expectedHostName {
 			t.Fatalf("Hostname should be %s, not %s", expectedHostName, putURL.Hostname())
 		}
-		expectedPath := "/temp/" + assetId.String()
+		expectedPath := expectedPathPrefix + "temp/" + assetId.String()
 		if putURL.Path != expectedPath {
 			t.Fatalf("Path should be %s, not %s", expectedPath, putURL.Path)
 		}
 	}
 }
 
+func TestAssetManagerWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId, err := uuid.NewRandom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putURL := upload.URLs[0]
+	expectedPath := "/" + bucket + "/temp/" + assetId.String()
+	if putURL.Path != expectedPath {
+		t.Fatalf("Path should be %s, not %s", expectedPath, putURL.Path)
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Asset should not be found before it is uploaded, got %v", err)
+	}
+	err = storage.Put(ctx, bucket, "temp/"+assetId.String(), strings.NewReader("CONTENT"), nil, assets.Encryption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.body(bucket, "uploaded/"+assetId.String()) != "CONTENT" {
+		t.Fatal("Asset content should be copied to uploaded")
+	}
+	download, err := manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPath = "/" + bucket + "/uploaded/" + assetId.String()
+	if download.URL.Path != expectedPath {
+		t.Fatalf("Path should be %s, not %s", expectedPath, download.URL.Path)
+	}
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("Asset should be already uploaded, got %v", err)
+	}
+}
+
+func TestImmediatePromotionWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	// The urls do not expire during the test, so only immediate promotions happen
+	manager := assets.NewAssetManager(storage, scheduler, time.Hour)
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId, incompleteId := uuid.New(), uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.PutURL(ctx, bucket, incompleteId, assets.PutConstraints{ContentLength: 1024}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	storage.upload(bucket, "temp/"+incompleteId.String(), "CONTENT", "")
+	for _, id := range []uuid.UUID{assetId, incompleteId} {
+		err = manager.Uploaded(ctx, bucket, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if err != nil {
+		t.Fatalf("Uploaded asset should be promoted right away, got %v", err)
+	}
+	// An object without the declared length may still be uploading, so it waits for the delayed promotion
+	status, err := manager.Status(ctx, bucket, incompleteId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != assets.StateUploading {
+		t.Fatalf("Incomplete asset should be uploading, not %s", status.State)
+	}
+}
+
+func TestUploadedAssetNotFoundWithFakeStorage(t *testing.T) {
+	manager := assets.NewAssetManager(newFakeStorage(), schedule.NewImmediateScheduler(), expirationDuration)
+	assetId, err := uuid.NewRandom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Uploaded(context.Background(), "testBucket", assetId)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+}
+
+func TestMultipartWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration, assets.WithMultipartAbortDelay(time.Hour))
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId, err := uuid.NewRandom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := manager.MultipartPutURLs(ctx, bucket, assetId, 2, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partURLs := upload.URLs
+	uploadID := partURLs[0].Query().Get("uploadId")
+	storage.uploadPart(uploadID, 1, "CON")
+	storage.uploadPart(uploadID, 2, "TENT")
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.body(bucket, "temp/"+assetId.String()) != "CONTENT" {
+		t.Fatal("Multipart upload should be completed when the asset is marked as uploaded")
+	}
+	// The completed upload is promoted right away
+	if storage.body(bucket, "uploaded/"+assetId.String()) != "CONTENT" {
+		t.Fatal("Completed multipart upload should be promoted when the asset is marked as uploaded")
+	}
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("Asset should be already uploaded, got %v", err)
+	}
+	_, err = manager.MultipartPutURLs(ctx, bucket, assetId, assets.MaxParts+1, assets.PutConstraints{}, 0)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+}
+
+func TestAbandonedMultipartIsAborted(t *testing.T) {
+	storage := newFakeStorage()
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId, err := uuid.NewRandom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The immediate scheduler runs the abort job right away
+	_, err = manager.MultipartPutURLs(ctx, bucket, assetId, 2, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+}
+
+func TestUploadPolicyWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	policy := assets.UploadPolicy{MaxSize: 10, ContentTypes: []string{"text/plain", "image/png"}}
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration, assets.WithUploadPolicy(policy))
+	bucket := "testBucket"
+	ctx := context.Background()
+
+	// Declared constraints out of the policy are rejected
+	for _, constraints := range []assets.PutConstraints{
+		{ContentType: "text/plain"},
+		{ContentType: "text/plain", ContentLength: 11},
+		{ContentType: "image/gif", ContentLength: 7},
+		{ContentType: "text/plain; charset=utf-8", ContentLength: 7},
+		{ContentLength: 7},
+	} {
+		_, err := manager.PutURL(ctx, bucket, uuid.New(), constraints, 0)
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("We expected a bad input error for %+v, got %v", constraints, err)
+		}
+	}
+
+	// An upload matching its declared constraints is promoted
+	assetId := uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{ContentType: "text/plain", ContentLength: 7}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "text/plain")
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An upload not matching them fails
+	assetId = uuid.New()
+	_, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{ContentType: "image/png", ContentLength: 7}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENTS", "image/png")
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Failed asset should not be found, got %v", err)
+	}
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("Failed asset should not be marked as uploaded again, got %v", err)
+	}
+	if storage.body(bucket, "uploaded/"+assetId.String()) != "" {
+		t.Fatal("Failed asset content should not be copied to uploaded")
+	}
+}
+
+func TestChecksumWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+	checksum := newChecksum("CONTENT")
+
+	// Malformed checksums are rejected
+	for _, malformed := range []assets.Checksum{{MD5: "CONTENT"}, {SHA256: "CONTENT"}, {MD5: checksum.SHA256}} {
+		_, err := manager.PutURL(ctx, bucket, uuid.New(), assets.PutConstraints{Checksum: malformed}, 0)
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("We expected a bad input error for %+v, got %v", malformed, err)
+		}
+	}
+
+	// The content is checked against the checksum before being promoted
+	for content, promoted := range map[string]bool{"CONTENT": true, "CORRUPT": false} {
+		assetId := uuid.New()
+		_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{Checksum: checksum}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.upload(bucket, "temp/"+assetId.String(), content, "")
+		err = manager.Uploaded(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		download, err := manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+		if !promoted {
+			if !auerr.Is(err, auerr.ErrorNotFound) {
+				t.Fatalf("Asset with a wrong checksum should not be found, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if download.Checksum != checksum {
+			t.Fatalf("Checksum should be %+v, not %+v", checksum, download.Checksum)
+		}
+	}
+}
+
+func TestMetadataWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+
+	// Unknown assets have no metadata
+	_, err := manager.UpdateMetadata(ctx, bucket, uuid.New(), assets.MetadataUpdate{})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+	err = manager.PutMetadata(ctx, bucket, uuid.New(), assets.Metadata{Owner: "owner"})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+
+	assetId := uuid.New()
+	_, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.PutMetadata(ctx, bucket, assetId, assets.Metadata{Labels: map[string]string{"": "empty"}})
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	err = manager.PutMetadata(ctx, bucket, assetId, assets.Metadata{
+		Filename: "cat.png",
+		Owner:    "owner",
+		Labels:   map[string]string{"animal": "cat", "color": "white"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, color := "other", "black"
+	updated, err := manager.UpdateMetadata(ctx, bucket, assetId, assets.MetadataUpdate{
+		Owner:  &owner,
+		Labels: map[string]*string{"animal": nil, "color": &color},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := assets.Metadata{Filename: "cat.png", Owner: "other", Labels: map[string]string{"color": "black"}}
+	if !reflect.DeepEqual(*updated, expected) {
+		t.Fatalf("Metadata should be %+v, not %+v", expected, *updated)
+	}
+
+	// The metadata is returned with the download
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	download, err := manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(download.Metadata, expected) {
+		t.Fatalf("Metadata should be %+v, not %+v", expected, download.Metadata)
+	}
+}
+
+// slowStorage is a fakeStorage slow to read and write, so the concurrent requests overlap.
+type slowStorage struct {
+	*fakeStorage
+}
+
+func (s slowStorage) Get(ctx context.Context, bucket string, key string, encryption assets.Encryption) (io.ReadCloser, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.fakeStorage.Get(ctx, bucket, key, encryption)
+}
+
+func (s slowStorage) Put(ctx context.Context, bucket string, key string, body io.ReadSeeker, tags map[string]string, encryption assets.Encryption) error {
+	time.Sleep(10 * time.Millisecond)
+	return s.fakeStorage.Put(ctx, bucket, key, body, tags, encryption)
+}
+
+func TestConcurrentMetadataUpdatesWithFakeStorage(t *testing.T) {
+	manager := assets.NewAssetManager(slowStorage{newFakeStorage()}, schedule.NewImmediateScheduler(), expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every update sets its own label, so none of them should be lost
+	updates := 40
+	errs := make(chan error, updates)
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := strconv.Itoa(i)
+			_, err := manager.UpdateMetadata(ctx, bucket, assetId, assets.MetadataUpdate{Labels: map[string]*string{"label-" + value: &value}})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	owner := "owner"
+	metadata, err := manager.UpdateMetadata(ctx, bucket, assetId, assets.MetadataUpdate{Owner: &owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Labels) != updates || metadata.Labels["label-7"] != "7" {
+		t.Fatalf("Metadata should have the %d labels, not %+v", updates, metadata.Labels)
+	}
+}
+
+func TestDeleteAndRestoreWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	purgeDelay := time.Second
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration, assets.WithPurgeDelay(purgeDelay))
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.PutMetadata(ctx, bucket, assetId, assets.Metadata{Owner: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+
+	// Deleted assets are not found
+	err = manager.Delete(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.UpdateMetadata(ctx, bucket, assetId, assets.MetadataUpdate{})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Deleted asset should not be found, got %v", err)
+	}
+	err = manager.Delete(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Deleted asset should not be found, got %v", err)
+	}
+
+	// Until restored, the restored asset is not purged
+	_, err = manager.Restore(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.Restore(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("We expected a conflict error, got %v", err)
+	}
+	time.Sleep(purgeDelay + 2*tickPeriod)
+	_, err = manager.UpdateMetadata(ctx, bucket, assetId, assets.MetadataUpdate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the purge delay is over, the asset objects are removed
+	err = manager.Delete(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		_, err := manager.Status(ctx, bucket, assetId)
+		if !auerr.Is(err, auerr.ErrorNotFound) {
+			return errors.New("Asset is not purged yet")
+		}
+		return nil
+	}, waitTime, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"temp/"} {
+		_, err := storage.Head(ctx, bucket, key+assetId.String(), assets.Encryption{})
+		if !auerr.Is(err, auerr.ErrorNotFound) {
+			t.Fatalf("Object %s should be purged, got %v", key, err)
+		}
+	}
+	_, err = manager.Restore(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Purged asset should not be found, got %v", err)
+	}
+}
+
+func TestPurgeAfterRestartWithFileRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := newFakeStorage()
+	repository, err := assets.NewFileRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Its scheduler never runs the jobs, so the purge job is lost with the restart
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	stopped := schedule.NewSimpleScheduler(upsert, query, time.Hour)
+	manager := assets.NewAssetManager(storage, stopped, expirationDuration, assets.WithRepository(repository), assets.WithPurgeDelay(time.Second))
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	err = manager.Delete(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarted with the state of the file repository, the purge is resumed
+	repository, err = assets.NewFileRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upsert, query = job.NewMemoryStore(job.MillisKeys)
+	manager = assets.NewAssetManager(storage, schedule.NewSimpleScheduler(upsert, query, tickPeriod), expirationDuration,
+		assets.WithRepository(repository), assets.WithPurgeDelay(time.Second))
+	err = manager.ResumePurges(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		_, err := repository.Get(ctx, bucket, assetId)
+		if !auerr.Is(err, auerr.ErrorNotFound) {
+			return errors.New("Asset is not purged yet")
+		}
+		return nil
+	}, waitTime, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.Head(ctx, bucket, "temp/"+assetId.String(), assets.Encryption{})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Asset objects should be purged, got %v", err)
+	}
+}
+
+func TestRestoreUploadingWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, time.Second)
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Still in flight, so its promotion is scheduled
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Delete(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The promotion job runs while the asset is deleted, so it is promoted again once restored
+	time.Sleep(time.Second + 2*tickPeriod)
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	state, err := manager.Restore(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != assets.StateUploading {
+		t.Fatalf("State should be uploading, not %s", state)
+	}
+	err = util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		status, err := manager.Status(ctx, bucket, assetId)
+		if err != nil {
+			return err
+		}
+		if status.State != assets.StateUploaded {
+			return errors.New("Asset is not uploaded yet")
+		}
+		return nil
+	}, waitTime, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration, assets.WithPurgeDelay(time.Hour))
+	bucket := "testBucket"
+	ctx := context.Background()
+	pending, uploaded, deleted := uuid.New(), uuid.New(), uuid.New()
+	for _, assetId := range []uuid.UUID{pending, uploaded, deleted} {
+		_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := manager.PutMetadata(ctx, bucket, uploaded, assets.Metadata{Owner: "owner", Labels: map[string]string{"animal": "cat"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+uploaded.String(), "CONTENT", "")
+	err = manager.Uploaded(ctx, bucket, uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForGet(ctx, t, manager, bucket, uploaded)
+	err = manager.Delete(ctx, bucket, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states := func(filter assets.ListFilter) map[string]assets.AssetState {
+		page, err := manager.List(ctx, bucket, filter, "", assets.MaxListLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := make(map[string]assets.AssetState)
+		for _, asset := range page.Assets {
+			listed[asset.ID] = asset.State
+		}
+		return listed
+	}
+	expected := map[string]assets.AssetState{pending.String(): assets.StateCreated, uploaded.String(): assets.StateUploaded, deleted.String(): assets.StateDeleted}
+	if listed := states(assets.ListFilter{}); !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("Listed assets should be %v, not %v", expected, listed)
+	}
+	expected = map[string]assets.AssetState{pending.String(): assets.StateCreated, deleted.String(): assets.StateDeleted}
+	if listed := states(assets.ListFilter{States: []assets.AssetState{"created", "deleted"}}); !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("Listed assets should be %v, not %v", expected, listed)
+	}
+	expected = map[string]assets.AssetState{uploaded.String(): assets.StateUploaded}
+	if listed := states(assets.ListFilter{Labels: map[string]string{"animal": ""}}); !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("Listed assets should be %v, not %v", expected, listed)
+	}
+	if listed := states(assets.ListFilter{Labels: map[string]string{"animal": "dog"}}); len(listed) != 0 {
+		t.Fatalf("No asset should be listed, not %v", listed)
+	}
+	if listed := states(assets.ListFilter{CreatedAfter: time.Now().Add(time.Hour)}); len(listed) != 0 {
+		t.Fatalf("No asset should be listed, not %v", listed)
+	}
+	if listed := states(assets.ListFilter{CreatedBefore: time.Now().Add(time.Hour)}); len(listed) != 3 {
+		t.Fatalf("Every asset should be listed, not %v", listed)
+	}
+
+	// Pages follow each other until there is no cursor
+	ids := make([]string, 0)
+	cursor := ""
+	for {
+		page, err := manager.List(ctx, bucket, assets.ListFilter{}, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, asset := range page.Assets {
+			ids = append(ids, asset.ID)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		cursor = page.Cursor
+	}
+	if len(ids) != 3 {
+		t.Fatalf("Every asset should be listed once, not %v", ids)
+	}
+	page, err := manager.List(ctx, bucket, assets.ListFilter{Labels: map[string]string{"animal": "cat"}}, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedMetadata := assets.Metadata{Owner: "owner", Labels: map[string]string{"animal": "cat"}}
+	if len(page.Assets) != 1 || !reflect.DeepEqual(page.Assets[0].Metadata, expectedMetadata) {
+		t.Fatalf("Listed asset metadata should be %+v, not %+v", expectedMetadata, page.Assets)
+	}
+	if page.Assets[0].Size != int64(len("CONTENT")) || page.Assets[0].UpdatedAt.IsZero() {
+		t.Fatalf("Listed asset should have the size and update date of its record, not %+v", page.Assets[0])
+	}
+
+	_, err = manager.List(ctx, bucket, assets.ListFilter{}, "", assets.MaxListLimit+1)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	_, err = manager.List(ctx, bucket, assets.ListFilter{States: []assets.AssetState{"unknown"}}, "", 10)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+}
+
+func TestStatusWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+	_, err := manager.Status(ctx, bucket, uuid.New())
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+
+	assetId, missingId, failedId := uuid.New(), uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{assetId, missingId} {
+		_, err = manager.PutURL(ctx, bucket, id, assets.PutConstraints{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = manager.PutURL(ctx, bucket, failedId, assets.PutConstraints{ContentLength: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := manager.Status(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != assets.StateCreated || status.CreatedAt.IsZero() || !status.PromoteAt.IsZero() {
+		t.Fatalf("Asset should be created, not %+v", status)
+	}
+
+	// Once marked as uploaded, uploads still in flight wait for the promotion
+	storage.upload(bucket, "temp/"+failedId.String(), "CONTENT", "text/plain")
+	for _, id := range []uuid.UUID{assetId, missingId, failedId} {
+		err = manager.Uploaded(ctx, bucket, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	status, err = manager.Status(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != assets.StateUploading || status.PromoteAt.IsZero() || status.Size != 0 {
+		t.Fatalf("Asset should be uploading, not %+v", status)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "text/plain")
+
+	waitForGet(ctx, t, manager, bucket, assetId)
+	status, err = manager.Status(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := assets.AssetStatus{State: assets.StateUploaded, Size: int64(len("CONTENT")), ContentType: "text/plain", CreatedAt: status.CreatedAt, UpdatedAt: status.UpdatedAt}
+	if !reflect.DeepEqual(*status, expected) {
+		t.Fatalf("Status should be %+v, not %+v", expected, *status)
+	}
+
+	// Failed promotions keep their reason
+	err = util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		for _, id := range []uuid.UUID{missingId, failedId} {
+			status, err := manager.Status(ctx, bucket, id)
+			if err != nil {
+				return err
+			}
+			if status.Error == "" {
+				return errors.New("Promotion is not attempted yet")
+			}
+		}
+		return nil
+	}, waitTime, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err = manager.Status(ctx, bucket, missingId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != assets.StateUploading || !strings.Contains(status.Error, "not found") {
+		t.Fatalf("Asset without content should keep the promotion error, not %+v", status)
+	}
+	status, err = manager.Status(ctx, bucket, failedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != assets.StateFailed || !status.PromoteAt.IsZero() || status.Error != "content length does not match the declared one" {
+		t.Fatalf("Asset should be failed, not %+v", status)
+	}
+}
+
+func TestHistoryWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.History(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+	_, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Marked before the upload, the promotion fails and is retried once marked again.
+	// The immediate scheduler runs the job right away and returns its error.
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := manager.History(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make([]assets.EventType, 0, len(events))
+	for i, event := range events {
+		if i > 0 && event.At.Before(events[i-1].At) {
+			t.Fatalf("Events should be ordered, not %+v", events)
+		}
+		types = append(types, event.Type)
+	}
+	expected := []assets.EventType{
+		assets.EventURLsIssued,
+		assets.EventUploadReported, assets.EventPromotionScheduled, assets.EventPromotionExecuted, assets.EventPromotionFailed,
+		assets.EventUploadReported, assets.EventPromotionExecuted, assets.EventPromotionSucceeded,
+		assets.EventDownloadURLIssued,
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("Events should be %v, not %v", expected, types)
+	}
+	if !strings.Contains(events[4].Detail, "not found") || events[8].Detail != "expires in 15s" {
+		t.Fatalf("Events should have their detail, not %+v", events)
+	}
+
+	// The reads are kept apart from the lifecycle events, so they do not push them out of the history
+	for i := 0; i < 1100; i++ {
+		_, err = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err = manager.History(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 8+assets.MaxReadEvents || events[0].Type != assets.EventURLsIssued || events[8].Type != assets.EventDownloadURLIssued {
+		t.Fatalf("History should keep the lifecycle and the last reads, not %d events starting with %+v", len(events), events[0])
+	}
+}
+
+func TestWaitProcessedWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+	err := manager.WaitProcessed(ctx, bucket, uuid.New(), time.Second)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+	assetId := uuid.New()
+	_, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.WaitProcessed(ctx, bucket, assetId, assets.MaxWait+time.Second)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+
+	// Not processed within the wait
+	start := time.Now()
+	err = manager.WaitProcessed(ctx, bucket, assetId, tickPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < tickPeriod {
+		t.Fatalf("Wait should last %s, not %s", tickPeriod, elapsed)
+	}
+
+	// Woken up by the promotion job, way before the wait runs out
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	start = time.Now()
+	err = manager.WaitProcessed(ctx, bucket, assetId, assets.MaxWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > waitTimeout {
+		t.Fatalf("Wait should end with the promotion, not after %s", elapsed)
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Processed assets do not wait
+	start = time.Now()
+	err = manager.WaitProcessed(ctx, bucket, assetId, assets.MaxWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Processed asset should not wait, waited %s", elapsed)
+	}
+}
+
+func TestExpirationBoundsWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration,
+		assets.WithUploadExpirationBounds(assets.ExpirationBounds{Min: 10 * time.Second, Max: time.Minute}),
+		assets.WithDownloadExpiration(30*time.Second, assets.ExpirationBounds{Min: 5 * time.Second, Max: time.Minute}),
+	)
+	bucket := "testBucket"
+	ctx := context.Background()
+	// expiresAt checks the expiry of urls signed in between start and now
+	expiresAt := func(start time.Time, expiresAt time.Time, expected time.Duration) {
+		if expiresAt.Before(start.Add(expected)) || expiresAt.After(time.Now().Add(expected)) {
+			t.Fatalf("Urls should expire in %s, not at %s", expected, expiresAt)
+		}
+	}
+	_, err := manager.PutURL(ctx, bucket, uuid.New(), assets.PutConstraints{}, -time.Second)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	// The default expiration is clamped too
+	start := time.Now()
+	upload, err := manager.PutURL(ctx, bucket, uuid.New(), assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt(start, upload.ExpiresAt, 10*time.Second)
+	start = time.Now()
+	upload, err = manager.MultipartPutURLs(ctx, bucket, uuid.New(), 2, assets.PutConstraints{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt(start, upload.ExpiresAt, time.Minute)
+
+	assetId := uuid.New()
+	upload, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 20*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upload.URLs) != 1 {
+		t.Fatalf("We expected 1 upload url, not %d", len(upload.URLs))
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, -time.Second)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	for requested, expected := range map[time.Duration]time.Duration{0: 30 * time.Second, time.Second: 5 * time.Second, 20 * time.Second: 20 * time.Second, time.Hour: time.Minute} {
+		start = time.Now()
+		download, err := manager.GetURL(ctx, bucket, assetId, requested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expiresAt(start, download.ExpiresAt, expected)
+	}
+}
+
+func TestResumableUploadWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration, assets.WithResumablePartSize(4))
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.CreateResumableUpload(ctx, bucket, assetId, assets.PutConstraints{ContentLength: -1})
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	progress, err := manager.CreateResumableUpload(ctx, bucket, assetId, assets.PutConstraints{ContentLength: 10, ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Offset != 0 || progress.Length != 10 || !progress.ExpiresAt.After(time.Now()) {
+		t.Fatalf("Upload progress should be empty, not %+v", progress)
+	}
+
+	// An interrupted chunk keeps what was received
+	progress, err = manager.WriteChunk(ctx, bucket, assetId, 0, io.MultiReader(strings.NewReader("CONTE"), &failingReader{}))
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	progress, err = manager.Progress(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Offset != 5 {
+		t.Fatalf("Upload offset should be 5, not %d", progress.Offset)
+	}
+	_, err = manager.WriteChunk(ctx, bucket, assetId, 0, strings.NewReader("CONTE"))
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("We expected a conflict error, got %v", err)
+	}
+	progress, err = manager.WriteChunk(ctx, bucket, assetId, 5, strings.NewReader("NT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Offset != 7 {
+		t.Fatalf("Upload offset should be 7, not %d", progress.Offset)
+	}
+	status, err := manager.Status(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != assets.StateCreated {
+		t.Fatalf("Asset should be created until complete, not %s", status.State)
+	}
+
+	// The last chunk hands the asset off to the promotion, bytes beyond the length are ignored
+	progress, err = manager.WriteChunk(ctx, bucket, assetId, 7, strings.NewReader("!!!IGNORED"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Offset != 10 {
+		t.Fatalf("Upload offset should be 10, not %d", progress.Offset)
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := storage.body(bucket, "uploaded/"+assetId.String()); content != "CONTENT!!!" {
+		t.Fatalf("Uploaded content should be CONTENT!!!, not %s", content)
+	}
+	_, err = storage.Head(ctx, bucket, "pending/"+assetId.String(), assets.Encryption{})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Pending chunk should be removed, got %v", err)
+	}
+	_, err = manager.WriteChunk(ctx, bucket, assetId, 10, strings.NewReader(""))
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("We expected a conflict error, got %v", err)
+	}
+
+	// An empty upload is uploaded once created
+	emptyId := uuid.New()
+	progress, err = manager.CreateResumableUpload(ctx, bucket, emptyId, assets.PutConstraints{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Offset != 0 || progress.Length != 0 {
+		t.Fatalf("Upload progress should be complete, not %+v", progress)
+	}
+	waitForGet(ctx, t, manager, bucket, emptyId)
+	if content := storage.body(bucket, "uploaded/"+emptyId.String()); content != "" {
+		t.Fatalf("Uploaded content should be empty, not %s", content)
+	}
+
+	// Other assets are not resumable uploads
+	otherId := uuid.New()
+	_, err = manager.PutURL(ctx, bucket, otherId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.Progress(ctx, bucket, otherId)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+}
+
+func TestProxyUploadWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	policy := assets.UploadPolicy{MaxSize: 10, ContentTypes: []string{"text/plain", "image/png"}}
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration, assets.WithResumablePartSize(4), assets.WithUploadPolicy(policy))
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{ContentLength: 7, ContentType: "text/plain", Checksum: newChecksum("CONTENT")}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The content is rejected before being promoted, so the asset is still created and it can be put again
+	for _, put := range []struct {
+		contentType string
+		length      int64
+		content     io.Reader
+	}{
+		{"image/png", -1, strings.NewReader("CONTENT")},
+		{"text/plain", 8, strings.NewReader("CONTENTS")},
+		{"text/plain", -1, strings.NewReader("CONTENTS")},
+		{"text/plain", -1, strings.NewReader("CONTEN")},
+		{"text/plain", -1, strings.NewReader("content")},
+		{"text/plain", -1, io.MultiReader(strings.NewReader("CONTE"), &failingReader{})},
+	} {
+		err = manager.PutContent(ctx, bucket, assetId, put.contentType, put.length, put.content)
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("We expected a bad input error, got %v", err)
+		}
+		status, err := manager.Status(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != assets.StateCreated {
+			t.Fatalf("Asset should be created, not %s", status.State)
+		}
+	}
+	if len(storage.uploads) != 0 {
+		t.Fatalf("Rejected uploads should be aborted, not %d left", len(storage.uploads))
+	}
+
+	// Without content type, the declared one is used
+	err = manager.PutContent(ctx, bucket, assetId, "", -1, strings.NewReader("CONTENT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := storage.body(bucket, "uploaded/"+assetId.String()); content != "CONTENT" {
+		t.Fatalf("Uploaded content should be CONTENT, not %s", content)
+	}
+	events, err := manager.History(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[1].Type != assets.EventUploadProxied {
+		t.Fatalf("Second event should be %s, not %s", assets.EventUploadProxied, events[1].Type)
+	}
+	err = manager.PutContent(ctx, bucket, assetId, "", -1, strings.NewReader("CONTENT"))
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("We expected a conflict error, got %v", err)
+	}
+
+	// Multipart assets are uploaded by their parts
+	multipartId := uuid.New()
+	_, err = manager.MultipartPutURLs(ctx, bucket, multipartId, 2, assets.PutConstraints{ContentLength: 10, ContentType: "text/plain"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.PutContent(ctx, bucket, multipartId, "text/plain", -1, strings.NewReader("CONTENT"))
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+}
+
+func TestProxyUploadLimitWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration, assets.WithResumablePartSize(4), assets.WithMaxProxiedSize(5))
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without declared length nor max size, the content is limited by the server
+	for _, length := range []int64{7, -1} {
+		err = manager.PutContent(ctx, bucket, assetId, "text/plain", length, strings.NewReader("CONTENT"))
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("We expected a bad input error, got %v", err)
+		}
+	}
+	if len(storage.uploads) != 0 {
+		t.Fatalf("Rejected uploads should be aborted, not %d left", len(storage.uploads))
+	}
+
+	// The checksum computed while streaming is reported like a declared one
+	err = manager.PutContent(ctx, bucket, assetId, "text/plain", -1, strings.NewReader("CONT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	download, err := manager.GetURL(ctx, bucket, assetId, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := newChecksum("CONT"); download.Checksum != expected {
+		t.Fatalf("Download checksum should be %+v, not %+v", expected, download.Checksum)
+	}
+	page, err := manager.List(ctx, bucket, assets.ListFilter{}, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Assets) != 1 || page.Assets[0].Checksum != download.Checksum {
+		t.Fatalf("Listed checksum should be %+v, not %+v", download.Checksum, page.Assets)
+	}
+}
+
+func TestProxyDownloadWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.PutMetadata(ctx, bucket, assetId, assets.Metadata{Filename: "content.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.GetContent(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+	err = manager.PutContent(ctx, bucket, assetId, "text/plain", 7, strings.NewReader("CONTENT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := manager.GetContent(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Body.Close()
+	if content.Size != 7 || content.ContentType != "text/plain" || content.Metadata.Filename != "content.txt" {
+		t.Fatalf("Content should be the uploaded one, not %+v", content)
+	}
+	// Reads continue from the last one, seeks start over from the new offset
+	assertContentRange(t, content.Body, 0, 2, "CO")
+	body, err := ioutil.ReadAll(content.Body)
+	if err != nil || string(body) != "NTENT" {
+		t.Fatalf("Rest of the content should be NTENT, not %s %v", body, err)
+	}
+	assertContentRange(t, content.Body, 3, 10, "TENT")
+	end, err := content.Body.Seek(-2, io.SeekEnd)
+	if err != nil || end != 5 {
+		t.Fatalf("Offset should be 5, not %d %v", end, err)
+	}
+	_, err = content.Body.Seek(-1, io.SeekStart)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	events, err := manager.History(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := events[len(events)-1]; last.Type != assets.EventContentRequested {
+		t.Fatalf("Last event should be %s, not %s", assets.EventContentRequested, last.Type)
+	}
+}
+
+// failingReader fails every read, like an interrupted connection.
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// notCancellingScheduler runs the cancelled jobs too, as if they were cancelled too late.
+type notCancellingScheduler struct {
+	schedule.SimpleScheduler
+}
+
+func (s *notCancellingScheduler) Cancel(ctx context.Context, job job.Job) error {
+	return nil
+}
+
+func TestRevokeWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := &notCancellingScheduler{schedule.NewSimpleScheduler(upsert, query, tickPeriod)}
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration, assets.WithMultipartAbortDelay(time.Hour))
+	bucket := "testBucket"
+	ctx := context.Background()
+	uploading, multipart, promoted := uuid.New(), uuid.New(), uuid.New()
+	// Not complete, so it waits for its delayed promotion
+	_, err := manager.PutURL(ctx, bucket, uploading, assets.PutConstraints{ContentLength: 1024}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+uploading.String(), "CONTENT", "")
+	err = manager.Uploaded(ctx, bucket, uploading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Revoke(ctx, bucket, uploading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := manager.Status(ctx, bucket, uploading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != assets.StateRevoked || !status.PromoteAt.IsZero() {
+		t.Fatalf("Asset should be revoked without a promotion, not %+v", status)
+	}
+	_, err = storage.Head(ctx, bucket, "temp/"+uploading.String(), assets.Encryption{})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Uploaded content should be discarded, got %v", err)
+	}
+	err = manager.Uploaded(ctx, bucket, uploading)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("Revoked asset should not be marked as uploaded, got %v", err)
+	}
+	_, err = manager.GetURL(ctx, bucket, uploading, 0)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Revoked asset should not be found, got %v", err)
+	}
+	err = manager.Revoke(ctx, bucket, uploading)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("Asset should be already revoked, got %v", err)
+	}
+
+	// The parts can not be uploaded anymore
+	upload, err := manager.MultipartPutURLs(ctx, bucket, multipart, 2, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Revoke(ctx, bucket, multipart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadID := upload.URLs[0].Query().Get("uploadId")
+	err = storage.UploadPart(ctx, bucket, "temp/"+multipart.String(), uploadID, 1, strings.NewReader("CON"), assets.Encryption{})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Multipart upload should be aborted, got %v", err)
+	}
+
+	// Processed assets can not be revoked
+	_, err = manager.PutURL(ctx, bucket, promoted, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+promoted.String(), "CONTENT", "")
+	err = manager.Uploaded(ctx, bucket, promoted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Revoke(ctx, bucket, promoted)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("Uploaded asset should not be revoked, got %v", err)
+	}
+	err = manager.Revoke(ctx, bucket, uuid.New())
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+
+	// The leaked url still uploads, but the promotion job refuses the revoked asset and discards it
+	storage.upload(bucket, "temp/"+uploading.String(), "CONTENT", "")
+	time.Sleep(expirationDuration + waitTime)
+	_, err = storage.Head(ctx, bucket, "temp/"+uploading.String(), assets.Encryption{})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Uploaded content should be discarded by the promotion, got %v", err)
+	}
+	_, err = storage.Head(ctx, bucket, "uploaded/"+uploading.String(), assets.Encryption{})
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Revoked asset should not be promoted, got %v", err)
+	}
+	status, err = manager.Status(ctx, bucket, uploading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != assets.StateRevoked {
+		t.Fatalf("Asset should stay revoked, not %s", status.State)
+	}
+}
+
+func TestGarbageCollectionWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	// A negative retention makes the assets abandoned as soon as they are created
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration, assets.WithGarbageRetention(-time.Hour))
+	bucket := "testBucket"
+	ctx := context.Background()
+	abandoned, promoted, notMarked, failed, revoked := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	for _, assetId := range []uuid.UUID{abandoned, promoted, notMarked, revoked} {
+		_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := manager.PutURL(ctx, bucket, failed, assets.PutConstraints{ContentLength: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.PutMetadata(ctx, bucket, abandoned, assets.Metadata{Owner: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, assetId := range []uuid.UUID{promoted, notMarked, failed} {
+		storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	}
+	for _, assetId := range []uuid.UUID{promoted, failed} {
+		err = manager.Uploaded(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Uploaded with a leaked url, once revoked
+	err = manager.Revoke(ctx, bucket, revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+revoked.String(), "CONTENT", "")
+
+	// A dry run only reports
+	expected := &assets.GarbageReport{DryRun: true, AbandonedAssets: []string{abandoned.String()}, PromotedTemps: []string{promoted.String()}, RevokedTemps: []string{revoked.String()}}
+	report, err := manager.CollectGarbage(ctx, bucket, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("Report should be %+v, not %+v", expected, report)
+	}
+	_, err = manager.Status(ctx, bucket, abandoned)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected.DryRun = false
+	report, err = manager.CollectGarbage(ctx, bucket, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("Report should be %+v, not %+v", expected, report)
+	}
+	_, err = manager.Status(ctx, bucket, abandoned)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("Abandoned asset should be removed, got %v", err)
+	}
+	for _, key := range []string{"temp/" + promoted.String(), "temp/" + revoked.String()} {
+		_, err = storage.Head(ctx, bucket, key, assets.Encryption{})
+		if !auerr.Is(err, auerr.ErrorNotFound) {
+			t.Fatalf("Object %s should be removed, got %v", key, err)
+		}
+	}
+	// The rest of the assets are untouched
+	for _, assetId := range []uuid.UUID{promoted, notMarked, failed} {
+		_, err = manager.Status(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = manager.GetURL(ctx, bucket, promoted, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = manager.CollectGarbage(ctx, bucket, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.AbandonedAssets) != 0 || len(report.PromotedTemps) != 0 || len(report.RevokedTemps) != 0 {
+		t.Fatalf("Nothing should be left to collect, not %+v", report)
+	}
+}
+
+func TestScheduledGarbageCollection(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration)
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForGet(ctx, t, manager, bucket, assetId)
+	err = manager.ScheduleGarbageCollection(ctx, bucket, 0, false)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	err = manager.ScheduleGarbageCollection(ctx, bucket, tickPeriod, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		_, err := storage.Head(ctx, bucket, "temp/"+assetId.String(), assets.Encryption{})
+		if !auerr.Is(err, auerr.ErrorNotFound) {
+			return errors.New("Temp object is not collected yet")
+		}
+		return nil
+	}, waitTime, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadWatcherWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, time.Hour)
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId, notUploadedId := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{assetId, notUploadedId} {
+		_, err := manager.PutURL(ctx, bucket, id, assets.PutConstraints{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := manager.ScheduleUploadWatcher(ctx, bucket, 0)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	err = manager.ScheduleUploadWatcher(ctx, bucket, tickPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client uploads but never marks the asset as uploaded
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	waitForGet(ctx, t, manager, bucket, assetId)
+	status, err := manager.Status(ctx, bucket, notUploadedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != assets.StateCreated {
+		t.Fatalf("Asset without object should be created, not %s", status.State)
+	}
+}
+
+func TestStorageClassWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	policy := assets.StorageClassPolicy{
+		Default: assets.StorageClassStandardIA,
+		Rules:   []assets.StorageClassRule{{MinSize: 8, StorageClass: assets.StorageClassIntelligentTiering}},
+	}
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration, assets.WithStorageClassPolicy(policy))
+	bucket := "testBucket"
+	ctx := context.Background()
+	for _, storageClass := range []assets.StorageClass{"COLD", assets.StorageClassGlacier, "deep_archive"} {
+		_, err := manager.PutURL(ctx, bucket, uuid.New(), assets.PutConstraints{StorageClass: storageClass}, 0)
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("Storage class %s should be a bad input, not %v", storageClass, err)
+		}
+	}
+	for _, test := range []struct {
+		name      string
+		requested assets.StorageClass
+		content   string
+		expected  assets.StorageClass
+	}{
+		{"TestDefault", "", "CONTENT", assets.StorageClassStandardIA},
+		{"TestRule", "", "CONTENTS", assets.StorageClassIntelligentTiering},
+		{"TestRequested", "onezone_ia", "CONTENTS", assets.StorageClassOneZoneIA},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assetId := uuid.New()
+			_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{StorageClass: test.requested}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			storage.upload(bucket, "temp/"+assetId.String(), test.content, "")
+			err = manager.Uploaded(ctx, bucket, assetId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if storageClass := storage.storageClass(bucket, "uploaded/"+assetId.String()); storageClass != test.expected {
+				t.Fatalf("Storage class should be %s, not %s", test.expected, storageClass)
+			}
+			status, err := manager.Status(ctx, bucket, assetId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.StorageClass != test.expected {
+				t.Fatalf("Status storage class should be %s, not %s", test.expected, status.StorageClass)
+			}
+		})
+	}
+}
+
+func TestS3ArchiveAndRestore(t *testing.T) {
+	region, bucket := "eu-west-1", "testBucket"
+	server := s3test.NewServer(region, "accessKey", "secretKey")
+	defer server.Close()
+	server.CreateBucket(bucket)
+	server.SetRestoreDelay(2 * tickPeriod)
+	session, err := assets.NewAwsSession(credentials.NewStaticCredentials("accessKey", "secretKey", ""), region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := assets.NewS3ClientWithEndpoint(session, region, server.URL)
+	svc.Config.HTTPClient = server.Client()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	manager := assets.NewAssetManager(
+		assets.NewS3Storage(svc),
+		schedule.NewSimpleScheduler(upsert, query, tickPeriod),
+		expirationDuration,
+		assets.WithStorageClassPolicy(assets.StorageClassPolicy{Default: assets.StorageClassStandardIA}),
+		assets.WithArchive(2*time.Second, assets.StorageClassGlacier),
+		assets.WithRestoreCheckPeriod(tickPeriod),
+	)
+	ctx := context.Background()
+	assetId := uuid.New()
+	upload, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEncryptedRequest(t, server.Client(), http.MethodPut, upload.URLs[0], upload.Headers, http.StatusOK)
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := waitForGet(ctx, t, manager, bucket, assetId)
+	assertStorageClass(t, server, bucket, "uploaded/"+assetId.String(), "STANDARD_IA")
+	_, err = manager.Restore(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("Uploaded asset should not be restored, got %v", err)
+	}
+
+	// Once old enough, the asset is archived and can not be downloaded
+	err = manager.ScheduleArchive(ctx, bucket, 0)
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	// Periodic jobs are named after their date in seconds, so they need a period of a second at least
+	err = manager.ScheduleArchive(ctx, bucket, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		status, err := manager.Status(ctx, bucket, assetId)
+		if err != nil {
+			return err
+		}
+		if status.State != assets.StateArchived {
+			return errors.New("Asset is not archived yet")
+		}
+		return nil
+	}, waitTime, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStorageClass(t, server, bucket, "uploaded/"+assetId.String(), "GLACIER")
+	_, err = manager.GetURL(ctx, bucket, assetId, 0)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("Archived asset should be a conflict, got %v", err)
+	}
+	assertEncryptedRequest(t, server.Client(), http.MethodGet, download.URL, nil, http.StatusForbidden)
+
+	// The restore is tracked until the asset is copied out of the archive
+	state, err := manager.Restore(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != assets.StateRestoring {
+		t.Fatalf("State should be restoring, not %s", state)
+	}
+	_, err = manager.GetURL(ctx, bucket, assetId, 0)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("Restoring asset should be a conflict, got %v", err)
+	}
+
+	// Deleted while restoring, its restore is checked again once the asset is restored
+	err = manager.Delete(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * tickPeriod)
+	state, err = manager.Restore(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != assets.StateRestoring {
+		t.Fatalf("State should be restoring, not %s", state)
+	}
+	err = util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		events, err := manager.History(ctx, bucket, assetId)
+		if err != nil {
+			return err
+		}
+		if events[len(events)-1].Type != assets.EventArchiveRestored {
+			return errors.New("Asset is not restored yet")
+		}
+		return nil
+	}, waitTime, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStorageClass(t, server, bucket, "uploaded/"+assetId.String(), "STANDARD_IA")
+	download, err = manager.GetURL(ctx, bucket, assetId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEncryptedRequest(t, server.Client(), http.MethodGet, download.URL, nil, http.StatusOK)
+}
+
+func TestResumeRestoresWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	repository := assets.NewMemoryRepository()
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	// A restore started before a restart, whose check job was lost with it
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	err := storage.Copy(ctx, bucket, "temp/"+assetId.String(), "uploaded/"+assetId.String(), nil, assets.Encryption{}, assets.StorageClassGlacier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.RestoreArchived(ctx, bucket, "uploaded/"+assetId.String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	err = repository.Create(ctx, &assets.AssetRecord{Bucket: bucket, ID: assetId, State: assets.StateRestoring, RestoreCheckAt: now, CreatedAt: now, UpdatedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checked once resumed, with no archive scheduled
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	manager := assets.NewAssetManager(storage, schedule.NewSimpleScheduler(upsert, query, tickPeriod), expirationDuration, assets.WithRepository(repository))
+	err = manager.ResumeRestores(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		status, err := manager.Status(ctx, bucket, assetId)
+		if err != nil {
+			return err
+		}
+		if status.State != assets.StateUploaded {
+			return errors.New("Asset is not restored yet")
+		}
+		return nil
+	}, waitTime, waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.storageClass(bucket, "uploaded/"+assetId.String()).Archived() {
+		t.Fatal("Restored asset should be copied out of the archive")
+	}
+}
+
+func assertStorageClass(t *testing.T, server *s3test.Server, bucket string, key string, expected string) {
+	storageClass, ok := server.ObjectStorageClass(bucket, key)
+	if !ok || storageClass != expected {
+		t.Fatalf("Storage class should be %s, not %s", expected, storageClass)
+	}
+}
+
+func newChecksum(content string) assets.Checksum {
+	md5Sum := md5.Sum([]byte(content))
+	sha256Sum := sha256.Sum256([]byte(content))
+	return assets.Checksum{MD5: base64.StdEncoding.EncodeToString(md5Sum[:]), SHA256: hex.EncodeToString(sha256Sum[:])}
+}
+
+func TestS3CopyByParts(t *testing.T) {
+	svc, bucket, _, _ := newTestS3Client(t)
+	restore := assets.SetMaxCopyObjectSize(4, 3)
+	defer restore()
+	storage := assets.NewS3Storage(svc)
+	ctx := context.Background()
+	srcKey := "temp/" + uuid.New().String()
+	dstKey := "uploaded/" + uuid.New().String()
+	err := storage.Put(ctx, bucket, srcKey, strings.NewReader("CONTENT"), nil, assets.Encryption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Copy(ctx, bucket, srcKey, dstKey, map[string]string{"status": "uploaded"}, assets.Encryption{}, assets.StorageClassDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := storage.Head(ctx, bucket, dstKey, assets.Encryption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("CONTENT")) {
+		t.Fatalf("Size should be %d, not %d", len("CONTENT"), info.Size)
+	}
+	tags, err := storage.Tags(ctx, bucket, dstKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["status"] != "uploaded" {
+		t.Fatalf("Status tag should be uploaded, not %s", tags["status"])
+	}
+}
+
+func TestS3Encryption(t *testing.T) {
+	region, bucket := "eu-west-1", "testBucket"
+	// SSE-C keys are only sent over https
+	server := s3test.NewTLSServer(region, "accessKey", "secretKey")
+	defer server.Close()
+	server.CreateBucket(bucket)
+	session, err := assets.NewAwsSession(credentials.NewStaticCredentials("accessKey", "secretKey", ""), region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := assets.NewS3ClientWithEndpoint(session, region, server.URL)
+	svc.Config.HTTPClient = server.Client()
+	// Promotions copy by parts, so every part copy carries the encryption too
+	restore := assets.SetMaxCopyObjectSize(4, 3)
+	defer restore()
+	key := []byte(strings.Repeat("k", assets.CustomerKeySize))
+	keyMD5 := md5.Sum(key)
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	manager := assets.NewAssetManager(
+		assets.NewS3Storage(svc),
+		schedule.NewSimpleScheduler(upsert, query, tickPeriod),
+		expirationDuration,
+		assets.WithEncryption(assets.Encryption{Mode: assets.EncryptionS3}),
+		assets.WithCustomerKeys(map[string][]byte{"key": key}),
+	)
+	ctx := context.Background()
+	for _, test := range []struct {
+		name       string
+		encryption assets.Encryption
+		expected   s3test.Encryption
+	}{
+		{"TestDefault", assets.Encryption{}, s3test.Encryption{Algorithm: "AES256"}},
+		{"TestKMS", assets.Encryption{Mode: assets.EncryptionKMS, KMSKeyID: "kmsKey"}, s3test.Encryption{Algorithm: "aws:kms", KMSKeyID: "kmsKey"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assetId := uuid.New()
+			upload, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{Encryption: test.encryption}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEncryptedRequest(t, server.Client(), http.MethodPut, upload.URLs[0], upload.Headers, http.StatusOK)
+			err = manager.Uploaded(ctx, bucket, assetId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			download := waitForGet(ctx, t, manager, bucket, assetId)
+			encryption, ok := server.ObjectEncryption(bucket, "uploaded/"+assetId.String())
+			if !ok || encryption != test.expected {
+				t.Fatalf("Encryption should be %v, not %v", test.expected, encryption)
+			}
+			assertEncryptedRequest(t, server.Client(), http.MethodGet, download.URL, nil, http.StatusOK)
+		})
+	}
+	t.Run("TestCustomer", func(t *testing.T) {
+		// The key is held by the service, so there are no urls and the content goes through it
+		assetId := uuid.New()
+		encryption := assets.Encryption{Mode: assets.EncryptionCustomer, CustomerKeyID: "key"}
+		upload, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{Encryption: encryption}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(upload.URLs) != 0 || len(upload.Headers) != 0 {
+			t.Fatalf("SSE-C assets should have neither urls nor headers, not %+v", upload)
+		}
+		err = manager.PutContent(ctx, bucket, assetId, "", -1, strings.NewReader("CONTENT"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := s3test.Encryption{CustomerKeyMD5: base64.StdEncoding.EncodeToString(keyMD5[:])}
+		if encryption, ok := server.ObjectEncryption(bucket, "uploaded/"+assetId.String()); !ok || encryption != expected {
+			t.Fatalf("Encryption should be %v, not %v", expected, encryption)
+		}
+		_, err = manager.GetURL(ctx, bucket, assetId, 0)
+		if !auerr.Is(err, auerr.ErrorForbidden) {
+			t.Fatalf("We expected a forbidden error, got %v", err)
+		}
+		content, err := manager.GetContent(ctx, bucket, assetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer content.Body.Close()
+		assertContentRange(t, content.Body, 0, 7, "CONTENT")
+		_, err = manager.MultipartPutURLs(ctx, bucket, uuid.New(), 1, assets.PutConstraints{Encryption: encryption}, 0)
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("We expected a bad input error, got %v", err)
+		}
+	})
+	t.Run("TestInvalid", func(t *testing.T) {
+		for _, encryption := range []assets.Encryption{
+			{Mode: "SSE-X"},
+			{KMSKeyID: "kmsKey"},
+			{Mode: assets.EncryptionS3, KMSKeyID: "kmsKey"},
+			{Mode: assets.EncryptionKMS, CustomerKeyID: "key"},
+			{Mode: assets.EncryptionCustomer, CustomerKeyID: "missing"},
+		} {
+			_, err := manager.PutURL(ctx, bucket, uuid.New(), assets.PutConstraints{Encryption: encryption}, 0)
+			if !auerr.Is(err, auerr.ErrorBadInput) {
+				t.Fatalf("Encryption %v should be a bad input, not %v", encryption, err)
+			}
+		}
+	})
+}
+
+func assertEncryptedRequest(t *testing.T, client *http.Client, method string, url *url.URL, headers map[string]string, status int) {
+	var body io.Reader
+	if method == http.MethodPut {
+		body = strings.NewReader("CONTENT")
+	}
+	req, err := http.NewRequest(method, url.String(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for header, value := range headers {
+		req.Header.Set(header, value)
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != status {
+		t.Fatalf("%s status should be %d, not %d", method, status, response.StatusCode)
+	}
+	if method == http.MethodGet && status == http.StatusOK {
+		content, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "CONTENT" {
+			t.Fatalf("Content should be CONTENT, not %s", string(content))
+		}
+	}
+}
+
 func TestSessionEmptyCredentials(t *testing.T) {
 	cred := &credentials.Credentials{}
 	region := os.Getenv("TEST_REGION")
@@ -211,13 +2456,13 @@ func TestSessionNilCredentials(t *testing.T) {
 	}
 }
 
-func waitForGet(ctx context.Context, t *testing.T, manager assets.AssetManager, bucket string, assetId uuid.UUID) *url.URL {
-	var getUrl *url.URL
+func waitForGet(ctx context.Context, t *testing.T, manager assets.AssetManager, bucket string, assetId uuid.UUID) *assets.Download {
+	var download *assets.Download
 	var ierr error
 	err := util.WaitUntilWithContext(
 		ctx,
 		func(ctx context.Context) error {
-			getUrl, ierr = manager.GetURL(ctx, bucket, assetId, 15)
+			download, ierr = manager.GetURL(ctx, bucket, assetId, 15*time.Second)
 			if ierr != nil {
 				return ierr
 			}
@@ -229,5 +2474,5 @@ func waitForGet(ctx context.Context, t *testing.T, manager assets.AssetManager,
 	if err != nil {
 		t.Fatal(err)
 	}
-	return getUrl
+	return download
 }
@@ -0,0 +1,114 @@
+package assets
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+const maxLabels = 50
+const maxLabelKeyLength = 128
+const maxMetadataValueLength = 1024
+
+// Metadata is the user defined information of an asset.
+type Metadata struct {
+	Filename    string            `json:"filename,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// MetadataUpdate changes the metadata of an asset.
+// Nil fields are left as they are, labels with a nil value are removed.
+type MetadataUpdate struct {
+	Filename    *string
+	ContentType *string
+	Owner       *string
+	Labels      map[string]*string
+}
+
+func (ps *assetManager) PutMetadata(ctx context.Context, bucket string, assetID uuid.UUID, metadata Metadata) error {
+	err := CheckMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = ps.updateMetadata(ctx, bucket, assetID, func(current *Metadata) {
+		*current = metadata.copy()
+	})
+	return err
+}
+
+func (ps *assetManager) UpdateMetadata(ctx context.Context, bucket string, assetID uuid.UUID, update MetadataUpdate) (*Metadata, error) {
+	return ps.updateMetadata(ctx, bucket, assetID, func(metadata *Metadata) {
+		if update.Filename != nil {
+			metadata.Filename = *update.Filename
+		}
+		if update.ContentType != nil {
+			metadata.ContentType = *update.ContentType
+		}
+		if update.Owner != nil {
+			metadata.Owner = *update.Owner
+		}
+		for k, v := range update.Labels {
+			if v == nil {
+				delete(metadata.Labels, k)
+				continue
+			}
+			if metadata.Labels == nil {
+				metadata.Labels = make(map[string]string)
+			}
+			metadata.Labels[k] = *v
+		}
+	})
+}
+
+// updateMetadata changes the metadata kept in the asset record, within its update, so concurrent changes are not lost.
+func (ps *assetManager) updateMetadata(ctx context.Context, bucket string, assetID uuid.UUID, update func(metadata *Metadata)) (*Metadata, error) {
+	record, err := ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		// Deleted assets are only visible to restore them
+		if record.State == StateDeleted {
+			return auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", assetID.String())
+		}
+		update(&record.Metadata)
+		return CheckMetadata(record.Metadata)
+	})
+	if err != nil {
+		return nil, err
+	}
+	metadata := record.Metadata.copy()
+	return &metadata, nil
+}
+
+func (m Metadata) copy() Metadata {
+	if m.Labels != nil {
+		labels := make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		m.Labels = labels
+	}
+	return m
+}
+
+// CheckMetadata returns an error if the metadata exceeds the limits, so it can be checked before creating its asset.
+func CheckMetadata(metadata Metadata) error {
+	for name, value := range map[string]string{"Filename": metadata.Filename, "Content type": metadata.ContentType, "Owner": metadata.Owner} {
+		if utf8.RuneCountInString(value) > maxMetadataValueLength {
+			return auerr.FError(auerr.ErrorBadInput, "%s should be at most %d characters", name, maxMetadataValueLength)
+		}
+	}
+	if len(metadata.Labels) > maxLabels {
+		return auerr.FError(auerr.ErrorBadInput, "Labels should be at most %d, not %d", maxLabels, len(metadata.Labels))
+	}
+	for k, v := range metadata.Labels {
+		if k == "" || utf8.RuneCountInString(k) > maxLabelKeyLength {
+			return auerr.FError(auerr.ErrorBadInput, "Label keys should have between 1 and %d characters, not %s", maxLabelKeyLength, k)
+		}
+		if utf8.RuneCountInString(v) > maxMetadataValueLength {
+			return auerr.FError(auerr.ErrorBadInput, "Label %s should be at most %d characters", k, maxMetadataValueLength)
+		}
+	}
+	return nil
+}
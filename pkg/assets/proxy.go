@@ -0,0 +1,194 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// DefaultMaxProxiedSize is the maximum size of the content put through the service when no length is declared,
+// the maximum size of a single s3 put.
+const DefaultMaxProxiedSize = 5 * 1024 * 1024 * 1024
+
+// WithMaxProxiedSize sets the maximum size of the content put through the service when neither the asset
+// nor the upload policy limit its length.
+func WithMaxProxiedSize(size int64) Option {
+	return func(manager *assetManager) {
+		manager.maxProxiedSize = size
+	}
+}
+
+func (ps *assetManager) PutContent(ctx context.Context, bucket string, assetID uuid.UUID, contentType string, length int64, content io.Reader) error {
+	// Shares the lock of the resumable uploads, so the same content is not written twice at once
+	key := recordKey(bucket, assetID)
+	if !ps.writers.acquire(key) {
+		return auerr.FError(auerr.ErrorConflict, "Content of asset %s is already being written", assetID.String())
+	}
+	defer ps.writers.release(key)
+	record, err := ps.record(ctx, bucket, assetID)
+	if err != nil {
+		return err
+	}
+	if record.State != StateCreated {
+		return stateError(record)
+	}
+	if record.UploadID != "" {
+		return auerr.FError(auerr.ErrorBadInput, "Asset %s is uploaded in parts, its content can not be put at once", assetID.String())
+	}
+	if time.Now().After(record.CreatedAt.Add(record.Expiration)) {
+		return auerr.FError(auerr.ErrorNotFound, "Upload of asset %s expired", assetID.String())
+	}
+	contentType, err = ps.contentType(record, contentType)
+	if err != nil {
+		return err
+	}
+	limit := ps.proxiedLimit(record)
+	err = checkLength(record, length, limit)
+	if err != nil {
+		return err
+	}
+	encryption, err := ps.withKey(record.Constraints.Encryption)
+	if err != nil {
+		return err
+	}
+	checksum, err := ps.streamContent(ctx, bucket, record, contentType, content, limit, encryption)
+	if err != nil {
+		return err
+	}
+	// Kept like a declared checksum, so downloads can be checked against it
+	_, err = ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		// Deleted or revoked meanwhile
+		if record.State != StateCreated {
+			return stateError(record)
+		}
+		record.ContentChecksum = checksum
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return ps.uploaded(ctx, bucket, assetID, EventUploadProxied)
+}
+
+// proxiedLimit returns the maximum size of the content put through the service, the declared length if any.
+func (ps *assetManager) proxiedLimit(record *AssetRecord) int64 {
+	if declared := record.Constraints.ContentLength; declared > 0 {
+		return declared
+	}
+	if ps.policy.MaxSize > 0 {
+		return ps.policy.MaxSize
+	}
+	return ps.maxProxiedSize
+}
+
+// contentType returns the content type of the put content, rejecting the ones the promotion would fail.
+func (ps *assetManager) contentType(record *AssetRecord, contentType string) (string, error) {
+	declared := record.Constraints.ContentType
+	if contentType == "" {
+		contentType = declared
+	}
+	if declared != "" && contentType != declared {
+		return "", auerr.FError(auerr.ErrorBadInput, "Content type should be the declared %s, not %s", declared, contentType)
+	}
+	if len(ps.policy.ContentTypes) > 0 && !ps.allowedContentType(contentType) {
+		return "", auerr.FError(auerr.ErrorBadInput, "Content type %s is not allowed", contentType)
+	}
+	return contentType, nil
+}
+
+// checkLength returns an error if the known length of the put content is not the declared one, or exceeds the limit.
+func checkLength(record *AssetRecord, length int64, limit int64) error {
+	if declared := record.Constraints.ContentLength; declared > 0 && length >= 0 && length != declared {
+		return auerr.FError(auerr.ErrorBadInput, "Content length should be the declared %d, not %d", declared, length)
+	}
+	if limit > 0 && length > limit {
+		return auerr.FError(auerr.ErrorBadInput, "Content length should be at most %d, not %d", limit, length)
+	}
+	return nil
+}
+
+// streamContent writes the content to the upload of the asset by parts, so it is never held whole in memory,
+// and returns its checksum. The upload is only completed when the content has the declared length and checksum,
+// and is within the limit, otherwise it is discarded.
+func (ps *assetManager) streamContent(ctx context.Context, bucket string, record *AssetRecord, contentType string, content io.Reader, limit int64, encryption Encryption) (Checksum, error) {
+	key := temporalPath + record.ID.String()
+	uploadID, err := ps.storage.CreateMultipartUpload(ctx, bucket, key, contentType, encryption)
+	if err != nil {
+		return Checksum{}, err
+	}
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		abortErr := ps.storage.AbortMultipartUpload(ctx, bucket, key, uploadID)
+		if abortErr != nil {
+			// Aborted by the lifecycle rule of the bucket anyway
+			log.Println(abortErr.Error())
+		}
+	}()
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	reader := io.TeeReader(content, io.MultiWriter(md5Hash, sha256Hash))
+	if limit > 0 {
+		// One byte over the limit is enough to tell it was exceeded
+		reader = io.LimitReader(reader, limit+1)
+	}
+	part := bytes.NewBuffer(make([]byte, 0, ps.resumablePartSize))
+	received := int64(0)
+	// An empty content is stored as an empty part, since an upload needs one at least
+	for partNumber := int64(1); ; partNumber++ {
+		part.Reset()
+		read, readErr := io.CopyN(part, reader, ps.resumablePartSize)
+		if readErr != nil && readErr != io.EOF {
+			return Checksum{}, auerr.CError(auerr.ErrorBadInput, readErr)
+		}
+		received += read
+		if limit > 0 && received > limit {
+			return Checksum{}, auerr.FError(auerr.ErrorBadInput, "Content of asset %s should be at most %d bytes", record.ID.String(), limit)
+		}
+		if read > 0 || partNumber == 1 {
+			err = ps.storage.UploadPart(ctx, bucket, key, uploadID, partNumber, bytes.NewReader(part.Bytes()), encryption)
+			if err != nil {
+				return Checksum{}, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	err = checkContent(record, received, md5Hash, sha256Hash)
+	if err != nil {
+		return Checksum{}, err
+	}
+	err = ps.storage.CompleteMultipartUpload(ctx, bucket, key, uploadID)
+	if err != nil {
+		return Checksum{}, err
+	}
+	completed = true
+	return Checksum{MD5: base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)), SHA256: hex.EncodeToString(sha256Hash.Sum(nil))}, nil
+}
+
+// checkContent returns an error if the received content does not have the declared length or checksum.
+func checkContent(record *AssetRecord, received int64, md5Hash hash.Hash, sha256Hash hash.Hash) error {
+	if declared := record.Constraints.ContentLength; declared > 0 && received != declared {
+		return auerr.FError(auerr.ErrorBadInput, "Content of asset %s has %d bytes, not the declared %d", record.ID.String(), received, declared)
+	}
+	if declared := record.Constraints.Checksum.MD5; declared != "" && declared != base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)) {
+		return auerr.FError(auerr.ErrorBadInput, "Content md5 of asset %s does not match the declared one", record.ID.String())
+	}
+	if declared := record.Constraints.Checksum.SHA256; declared != "" && declared != hex.EncodeToString(sha256Hash.Sum(nil)) {
+		return auerr.FError(auerr.ErrorBadInput, "Content sha256 of asset %s does not match the declared one", record.ID.String())
+	}
+	return nil
+}
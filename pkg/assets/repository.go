@@ -0,0 +1,245 @@
+package assets
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// AssetState is a state of the asset lifecycle.
+type AssetState string
+
+const (
+	// StateCreated is the state of an asset whose upload urls were created.
+	StateCreated AssetState = "created"
+	// StateUploading is the state of an asset marked as uploaded, waiting for its upload to be done.
+	StateUploading AssetState = "uploading"
+	// StateProcessing is the state of an asset whose upload is being checked and moved to the uploaded folder.
+	StateProcessing AssetState = "processing"
+	// StateUploaded is the state of an asset ready to be downloaded.
+	StateUploaded AssetState = "uploaded"
+	// StateFailed is the state of an asset whose upload does not comply with its declared values or the policy.
+	StateFailed AssetState = "failed"
+	// StateRevoked is the state of an asset whose upload urls were revoked before it was processed, it is never promoted.
+	StateRevoked AssetState = "revoked"
+	// StateArchived is the state of an uploaded asset moved to the archive tier, it has to be restored to be downloaded.
+	StateArchived AssetState = "archived"
+	// StateRestoring is the state of an archived asset whose restore was started, it is uploaded again once done.
+	StateRestoring AssetState = "restoring"
+	// StateDeleted is the state of a deleted asset, waiting to be purged.
+	StateDeleted AssetState = "deleted"
+)
+
+// States are all the asset states.
+var States = []AssetState{StateCreated, StateUploading, StateProcessing, StateUploaded, StateFailed, StateRevoked, StateArchived, StateRestoring, StateDeleted}
+
+// transitions are the states every state can move to. Deleted assets go back to the state they had.
+var transitions = map[AssetState][]AssetState{
+	StateCreated:    {StateUploading, StateProcessing, StateRevoked, StateDeleted},
+	StateUploading:  {StateUploading, StateProcessing, StateRevoked, StateDeleted},
+	StateProcessing: {StateUploading, StateUploaded, StateFailed, StateDeleted},
+	StateUploaded:   {StateArchived, StateDeleted},
+	StateFailed:     {StateDeleted},
+	StateRevoked:    {StateDeleted},
+	StateArchived:   {StateRestoring, StateDeleted},
+	StateRestoring:  {StateUploaded, StateArchived, StateDeleted},
+	StateDeleted:    {StateCreated, StateUploading, StateProcessing, StateUploaded, StateFailed, StateRevoked, StateArchived, StateRestoring},
+}
+
+// AssetRecord is the lifecycle state of an asset, kept in an AssetRepository.
+type AssetRecord struct {
+	Bucket string     `json:"bucket"`
+	ID     uuid.UUID  `json:"id"`
+	State  AssetState `json:"state"`
+	// Constraints are the declared ones, signed into the upload urls.
+	Constraints PutConstraints `json:"constraints"`
+	// Expiration is how long the upload urls are valid since the asset creation,
+	// or how long the chunks of a resumable upload are accepted.
+	Expiration time.Duration `json:"expiration"`
+	// UploadID is the id of the multipart upload, empty for single part uploads.
+	UploadID string `json:"uploadId,omitempty"`
+	// Resumable uploads are sent by chunks through the service. Offset is how many bytes have been received,
+	// Parts how many parts have been uploaded and Pending how many received bytes wait to fill the next part.
+	Resumable bool  `json:"resumable,omitempty"`
+	Offset    int64 `json:"offset,omitempty"`
+	Parts     int64 `json:"parts,omitempty"`
+	Pending   int64 `json:"pending,omitempty"`
+	// Size and ContentType are the ones of the uploaded content, known once it is processed.
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	// ContentChecksum is the one computed when the content was put through the service.
+	ContentChecksum Checksum `json:"contentChecksum"`
+	// PromoteAt is when the asset is processed if its upload is not done when marked as uploaded.
+	PromoteAt time.Time `json:"promoteAt,omitempty"`
+	// Metadata is the user defined information of the asset.
+	Metadata Metadata `json:"metadata"`
+	// StorageClass is the one of the uploaded content, empty for the default one of the bucket.
+	StorageClass StorageClass `json:"storageClass,omitempty"`
+	// RestoreCheckAt is when the progress of the restore of an archived asset is checked next, zero unless it is restoring.
+	RestoreCheckAt time.Time `json:"restoreCheckAt,omitempty"`
+	// Error is why the asset failed or why its last processing did not succeed.
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// History are the states the asset went through, oldest first.
+	History []Transition `json:"history"`
+	// Events are what happened to the asset, oldest first.
+	Events []Event `json:"events,omitempty"`
+}
+
+// Transition is a state an asset moved to and when.
+type Transition struct {
+	State AssetState `json:"state"`
+	At    time.Time  `json:"at"`
+}
+
+// DeletedAt returns when the asset was deleted, zero if it is not.
+func (r *AssetRecord) DeletedAt() time.Time {
+	if r.State != StateDeleted || len(r.History) == 0 {
+		return time.Time{}
+	}
+	return r.History[len(r.History)-1].At
+}
+
+// restoreState returns the state a deleted asset had before being deleted.
+func (r *AssetRecord) restoreState() AssetState {
+	for i := len(r.History) - 1; i >= 0; i-- {
+		if r.History[i].State != StateDeleted {
+			return r.History[i].State
+		}
+	}
+	return StateCreated
+}
+
+// moveTo changes the state of the record, if the state machine allows it.
+func (r *AssetRecord) moveTo(state AssetState, at time.Time) error {
+	allowed := false
+	for _, next := range transitions[r.State] {
+		allowed = allowed || next == state
+	}
+	if !allowed {
+		return auerr.FError(auerr.ErrorConflict, "Asset %s can not move from %s to %s", r.ID.String(), r.State, state)
+	}
+	r.State = state
+	r.UpdatedAt = at
+	r.History = append(r.History, Transition{State: state, At: at})
+	return nil
+}
+
+// checksum returns the declared checksum of the content, completed with the one computed when it was put through the service.
+func (r *AssetRecord) checksum() Checksum {
+	checksum := r.Constraints.Checksum
+	if checksum.MD5 == "" {
+		checksum.MD5 = r.ContentChecksum.MD5
+	}
+	if checksum.SHA256 == "" {
+		checksum.SHA256 = r.ContentChecksum.SHA256
+	}
+	return checksum
+}
+
+func (r *AssetRecord) copy() *AssetRecord {
+	record := *r
+	record.History = append([]Transition(nil), r.History...)
+	record.Events = append([]Event(nil), r.Events...)
+	record.Metadata = r.Metadata.copy()
+	return &record
+}
+
+// AssetRepository keeps the lifecycle state of the assets.
+// Implementations should return auerr errors, with ErrorNotFound when the asset does not exist.
+type AssetRepository interface {
+	// Create stores a new record, it returns ErrorConflict if the asset already exists.
+	Create(ctx context.Context, record *AssetRecord) error
+	// Get returns the record of the asset.
+	Get(ctx context.Context, bucket string, assetID uuid.UUID) (*AssetRecord, error)
+	// Update applies update to the record of the asset and stores it, atomically.
+	// If update returns an error, the record is left as it was and the error is returned.
+	Update(ctx context.Context, bucket string, assetID uuid.UUID, update func(record *AssetRecord) error) (*AssetRecord, error)
+	// Delete removes the record of the asset.
+	Delete(ctx context.Context, bucket string, assetID uuid.UUID) error
+	// List returns, ordered by id, up to limit records with an id greater than startAfter.
+	// It also returns if there are more records to list.
+	List(ctx context.Context, bucket string, startAfter string, limit int64) ([]*AssetRecord, bool, error)
+}
+
+// NewMemoryRepository creates an AssetRepository which keeps the records in memory.
+func NewMemoryRepository() AssetRepository {
+	return &memoryRepository{records: make(map[string]*AssetRecord)}
+}
+
+type memoryRepository struct {
+	mutex   sync.Mutex
+	records map[string]*AssetRecord
+}
+
+func (m *memoryRepository) Create(ctx context.Context, record *AssetRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := recordKey(record.Bucket, record.ID)
+	if _, ok := m.records[key]; ok {
+		return auerr.FError(auerr.ErrorConflict, "Asset %s already exists", record.ID.String())
+	}
+	m.records[key] = record.copy()
+	return nil
+}
+
+func (m *memoryRepository) Get(ctx context.Context, bucket string, assetID uuid.UUID) (*AssetRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	record, ok := m.records[recordKey(bucket, assetID)]
+	if !ok {
+		return nil, auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", assetID.String())
+	}
+	return record.copy(), nil
+}
+
+func (m *memoryRepository) Update(ctx context.Context, bucket string, assetID uuid.UUID, update func(record *AssetRecord) error) (*AssetRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := recordKey(bucket, assetID)
+	record, ok := m.records[key]
+	if !ok {
+		return nil, auerr.FError(auerr.ErrorNotFound, "Asset %s is not found", assetID.String())
+	}
+	updated := record.copy()
+	err := update(updated)
+	if err != nil {
+		return nil, err
+	}
+	m.records[key] = updated
+	return updated.copy(), nil
+}
+
+func (m *memoryRepository) Delete(ctx context.Context, bucket string, assetID uuid.UUID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.records, recordKey(bucket, assetID))
+	return nil
+}
+
+func (m *memoryRepository) List(ctx context.Context, bucket string, startAfter string, limit int64) ([]*AssetRecord, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	records := make([]*AssetRecord, 0)
+	for _, record := range m.records {
+		if record.Bucket == bucket && record.ID.String() > startAfter {
+			records = append(records, record.copy())
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID.String() < records[j].ID.String()
+	})
+	if int64(len(records)) > limit {
+		return records[:limit], true, nil
+	}
+	return records, false, nil
+}
+
+func recordKey(bucket string, assetID uuid.UUID) string {
+	return bucket + "/" + assetID.String()
+}
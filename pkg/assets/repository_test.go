@@ -0,0 +1,201 @@
+package assets_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+	"github.com/tgracchus/assetuploader/pkg/job"
+	"github.com/tgracchus/assetuploader/pkg/schedule"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	testRepository(t, assets.NewMemoryRepository())
+}
+
+func TestFileRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+	repository, err := assets.NewFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRepository(t, repository)
+
+	// The records survive a reload
+	ctx := context.Background()
+	records, _, err := repository.List(ctx, "bucket", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := assets.NewFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadedRecords, _, err := reloaded.List(ctx, "bucket", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || !reflect.DeepEqual(records, reloadedRecords) {
+		t.Fatalf("Reloaded records should be %+v, not %+v", records, reloadedRecords)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(path, "bucket", records[0].ID.String()+".json"), []byte("not json"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = assets.NewFileRepository(path)
+	if !auerr.Is(err, auerr.ErrorInternalError) {
+		t.Fatalf("We expected an internal error, got %v", err)
+	}
+}
+
+func testRepository(t *testing.T, repository assets.AssetRepository) {
+	ctx := context.Background()
+	createdAt := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	for _, id := range ids {
+		err := repository.Create(ctx, &assets.AssetRecord{Bucket: "bucket", ID: id, State: assets.StateCreated, CreatedAt: createdAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := repository.Create(ctx, &assets.AssetRecord{Bucket: "bucket", ID: ids[0], State: assets.StateCreated})
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("We expected a conflict error, got %v", err)
+	}
+	// The same id in another bucket is another asset
+	err = repository.Create(ctx, &assets.AssetRecord{Bucket: "other", ID: ids[0], State: assets.StateCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := repository.Update(ctx, "bucket", ids[0], func(record *assets.AssetRecord) error {
+		record.Error = "error"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Error != "error" {
+		t.Fatalf("Updated record should have its error, not %+v", updated)
+	}
+	// A failed update leaves the record as it was
+	_, err = repository.Update(ctx, "bucket", ids[0], func(record *assets.AssetRecord) error {
+		record.Error = "lost"
+		return auerr.CError(auerr.ErrorConflict, errors.New("conflict"))
+	})
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("We expected a conflict error, got %v", err)
+	}
+	record, err := repository.Get(ctx, "bucket", ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Error != "error" || !record.CreatedAt.Equal(createdAt) {
+		t.Fatalf("Record should be left as it was, not %+v", record)
+	}
+
+	// Listed by id, in pages
+	listed := make([]uuid.UUID, 0)
+	startAfter := ""
+	for {
+		records, more, err := repository.List(ctx, "bucket", startAfter, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range records {
+			listed = append(listed, record.ID)
+		}
+		if !more {
+			break
+		}
+		startAfter = records[len(records)-1].ID.String()
+	}
+	if len(listed) != len(ids) {
+		t.Fatalf("Listed records should be %d, not %v", len(ids), listed)
+	}
+	for i := 1; i < len(listed); i++ {
+		if listed[i-1].String() >= listed[i].String() {
+			t.Fatalf("Listed records should be ordered by id, not %v", listed)
+		}
+	}
+
+	err = repository.Delete(ctx, "bucket", ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repository.Get(ctx, "bucket", ids[0])
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+	_, err = repository.Update(ctx, "bucket", ids[0], func(record *assets.AssetRecord) error { return nil })
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+	_, err = repository.Get(ctx, "other", ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateHistoryWithFakeStorage(t *testing.T) {
+	storage := newFakeStorage()
+	repository := assets.NewMemoryRepository()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	manager := assets.NewAssetManager(storage, scheduler, expirationDuration,
+		assets.WithRepository(repository), assets.WithPurgeDelay(time.Hour))
+	bucket := "testBucket"
+	ctx := context.Background()
+	assetId := uuid.New()
+	_, err := manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.upload(bucket, "temp/"+assetId.String(), "CONTENT", "")
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Delete(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.Restore(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := repository.Get(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make([]assets.AssetState, 0)
+	for _, transition := range record.History {
+		states = append(states, transition.State)
+	}
+	expected := []assets.AssetState{assets.StateCreated, assets.StateProcessing, assets.StateUploaded, assets.StateDeleted, assets.StateUploaded}
+	if !reflect.DeepEqual(states, expected) {
+		t.Fatalf("States should be %v, not %v", expected, states)
+	}
+	if !record.UpdatedAt.Equal(record.History[len(record.History)-1].At) {
+		t.Fatalf("Record should be updated at its last transition, not %s", record.UpdatedAt)
+	}
+	// Uploaded assets can not be processed again
+	err = manager.Uploaded(ctx, bucket, assetId)
+	if !auerr.Is(err, auerr.ErrorConflict) {
+		t.Fatalf("We expected a conflict error, got %v", err)
+	}
+}
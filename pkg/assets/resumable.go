@@ -0,0 +1,259 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+	"github.com/tgracchus/assetuploader/pkg/job"
+)
+
+// DefaultResumablePartSize is the size of the parts a resumable upload is stored in, the minimum one of s3.
+const DefaultResumablePartSize = 5 * 1024 * 1024
+
+// pendingPath keeps the received bytes of a resumable upload which do not fill a part yet.
+const pendingPath = "pending/"
+
+// WithResumablePartSize sets the size of the parts a resumable upload is stored in.
+// s3 rejects parts smaller than 5MB, except the last one.
+func WithResumablePartSize(size int64) Option {
+	return func(manager *assetManager) {
+		manager.resumablePartSize = size
+	}
+}
+
+// UploadProgress is how much of a resumable upload has been received.
+type UploadProgress struct {
+	Offset int64
+	Length int64
+	// ExpiresAt is when the upload is aborted if it is not complete.
+	ExpiresAt time.Time
+}
+
+func (r *AssetRecord) progress() *UploadProgress {
+	return &UploadProgress{Offset: r.Offset, Length: r.Constraints.ContentLength, ExpiresAt: r.CreatedAt.Add(r.Expiration)}
+}
+
+// writers are the resumable uploads with a chunk being written, by asset.
+type writers struct {
+	mutex sync.Mutex
+	keys  map[string]bool
+}
+
+func newWriters() *writers {
+	return &writers{keys: make(map[string]bool)}
+}
+
+// acquire returns false if a chunk of the asset is already being written.
+func (w *writers) acquire(key string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.keys[key] {
+		return false
+	}
+	w.keys[key] = true
+	return true
+}
+
+func (w *writers) release(key string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.keys, key)
+}
+
+func (ps *assetManager) CreateResumableUpload(ctx context.Context, bucket string, assetID uuid.UUID, constraints PutConstraints) (*UploadProgress, error) {
+	constraints, err := ps.checkConstraints(constraints, true)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := ps.withKey(constraints.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	createdAt := time.Now().UTC()
+	key := temporalPath + assetID.String()
+	uploadID, err := ps.storage.CreateMultipartUpload(ctx, bucket, key, constraints.ContentType, encryption)
+	if err != nil {
+		return nil, err
+	}
+	// The chunks are accepted until the upload is aborted
+	record := newRecord(bucket, assetID, createdAt, constraints, ps.putExpirationTime+ps.multipartAbortDelay, uploadID, "resumable upload")
+	record.Resumable = true
+	err = ps.repository.Create(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	abortJob := job.NewFixedDateJob(assetID.String()+"-abort", ps.newAbortFunction(bucket, key, uploadID), createdAt.Add(record.Expiration))
+	err = ps.scheduler.Schedule(ctx, *abortJob)
+	if err != nil {
+		return nil, err
+	}
+	// An empty upload is complete once created, stored as an empty part since an upload needs one at least
+	if constraints.ContentLength == 0 {
+		record, err = ps.uploadPart(ctx, bucket, record, nil, 0, encryption)
+		if err != nil {
+			return nil, err
+		}
+		err = ps.Uploaded(ctx, bucket, assetID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return record.progress(), nil
+}
+
+func (ps *assetManager) Progress(ctx context.Context, bucket string, assetID uuid.UUID) (*UploadProgress, error) {
+	record, err := ps.resumableRecord(ctx, bucket, assetID)
+	if err != nil {
+		return nil, err
+	}
+	return record.progress(), nil
+}
+
+// resumableRecord returns the record of a resumable upload, other assets are not found.
+func (ps *assetManager) resumableRecord(ctx context.Context, bucket string, assetID uuid.UUID) (*AssetRecord, error) {
+	record, err := ps.record(ctx, bucket, assetID)
+	if err != nil {
+		return nil, err
+	}
+	if !record.Resumable {
+		return nil, auerr.FError(auerr.ErrorNotFound, "Resumable upload of asset %s is not found", assetID.String())
+	}
+	return record, nil
+}
+
+func (ps *assetManager) WriteChunk(ctx context.Context, bucket string, assetID uuid.UUID, offset int64, chunk io.Reader) (*UploadProgress, error) {
+	// Parts are numbered by the received bytes, so chunks of the same asset can not be written concurrently
+	key := recordKey(bucket, assetID)
+	if !ps.writers.acquire(key) {
+		return nil, auerr.FError(auerr.ErrorConflict, "A chunk of asset %s is already being written", assetID.String())
+	}
+	defer ps.writers.release(key)
+	record, err := ps.resumableRecord(ctx, bucket, assetID)
+	if err != nil {
+		return nil, err
+	}
+	if record.State != StateCreated {
+		return nil, stateError(record)
+	}
+	if record.Offset != offset {
+		return nil, auerr.FError(auerr.ErrorConflict, "Offset of asset %s is %d, not %d", assetID.String(), record.Offset, offset)
+	}
+	if time.Now().After(record.CreatedAt.Add(record.Expiration)) {
+		return nil, auerr.FError(auerr.ErrorNotFound, "Resumable upload of asset %s expired", assetID.String())
+	}
+	encryption, err := ps.withKey(record.Constraints.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	part, err := ps.pending(ctx, bucket, record, encryption)
+	if err != nil {
+		return nil, err
+	}
+	// Bytes beyond the declared length are ignored, the promotion fails if the content does not match it
+	length := record.Constraints.ContentLength
+	reader := io.LimitReader(chunk, length-record.Offset)
+	// A complete upload which could not be marked as uploaded is marked again
+	for record.Offset < length {
+		received, readErr := io.CopyN(part, reader, ps.resumablePartSize-int64(part.Len()))
+		if readErr == io.EOF {
+			readErr = nil
+		}
+		complete := record.Offset+received == length
+		if int64(part.Len()) < ps.resumablePartSize && !complete {
+			// Kept until the next chunk fills the part, even if the chunk was interrupted, so it is resumed from here
+			if received > 0 {
+				record, err = ps.keepPending(ctx, bucket, record, part.Bytes(), received, encryption)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if readErr != nil {
+				return nil, auerr.CError(auerr.ErrorBadInput, readErr)
+			}
+			return record.progress(), nil
+		}
+		record, err = ps.uploadPart(ctx, bucket, record, part.Bytes(), received, encryption)
+		if err != nil {
+			return nil, err
+		}
+		part.Reset()
+	}
+	err = ps.storage.Delete(ctx, bucket, pendingPath+assetID.String())
+	if err != nil {
+		// Removed along with the asset anyway
+		log.Println(err.Error())
+	}
+	err = ps.Uploaded(ctx, bucket, assetID)
+	if err != nil {
+		return nil, err
+	}
+	return record.progress(), nil
+}
+
+// pending returns a buffer with the received bytes which do not fill a part yet.
+func (ps *assetManager) pending(ctx context.Context, bucket string, record *AssetRecord, encryption Encryption) (*bytes.Buffer, error) {
+	part := bytes.NewBuffer(make([]byte, 0, ps.resumablePartSize))
+	if record.Pending == 0 {
+		return part, nil
+	}
+	content, err := ps.storage.Get(ctx, bucket, pendingPath+record.ID.String(), encryption)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	pending, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	if int64(len(pending)) != record.Pending {
+		return nil, auerr.FError(auerr.ErrorInternalError, "Pending chunk of asset %s has %d bytes, not %d", record.ID.String(), len(pending), record.Pending)
+	}
+	part.Write(pending)
+	return part, nil
+}
+
+// keepPending stores the received bytes which do not fill a part yet, encrypted as the rest of the content.
+func (ps *assetManager) keepPending(ctx context.Context, bucket string, record *AssetRecord, pending []byte, received int64, encryption Encryption) (*AssetRecord, error) {
+	err := ps.storage.Put(ctx, bucket, pendingPath+record.ID.String(), bytes.NewReader(pending), nil, encryption)
+	if err != nil {
+		return nil, err
+	}
+	return ps.received(ctx, bucket, record, received, func(record *AssetRecord) {
+		record.Pending = int64(len(pending))
+	})
+}
+
+// uploadPart stores the received bytes as the next part of the upload.
+func (ps *assetManager) uploadPart(ctx context.Context, bucket string, record *AssetRecord, part []byte, received int64, encryption Encryption) (*AssetRecord, error) {
+	err := ps.storage.UploadPart(ctx, bucket, temporalPath+record.ID.String(), record.UploadID, record.Parts+1, bytes.NewReader(part), encryption)
+	if err != nil {
+		return nil, err
+	}
+	return ps.received(ctx, bucket, record, received, func(record *AssetRecord) {
+		record.Parts++
+		record.Pending = 0
+	})
+}
+
+// received records the received bytes of a resumable upload, as long as nobody else wrote them meanwhile.
+func (ps *assetManager) received(ctx context.Context, bucket string, record *AssetRecord, received int64, f func(record *AssetRecord)) (*AssetRecord, error) {
+	offset := record.Offset
+	return ps.repository.Update(ctx, bucket, record.ID, func(record *AssetRecord) error {
+		if record.State != StateCreated {
+			return stateError(record)
+		}
+		if record.Offset != offset {
+			return auerr.FError(auerr.ErrorConflict, "Offset of asset %s is %d, not %d", record.ID.String(), record.Offset, offset)
+		}
+		record.Offset += received
+		f(record)
+		return nil
+	})
+}
@@ -0,0 +1,63 @@
+package assets
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+	"github.com/tgracchus/assetuploader/pkg/job"
+)
+
+func (ps *assetManager) Revoke(ctx context.Context, bucket string, assetID uuid.UUID) error {
+	var promoteAt time.Time
+	// Only the assets not processed yet can be revoked, so a running promotion is never undone
+	record, err := ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		if record.State != StateCreated && record.State != StateUploading {
+			return stateError(record)
+		}
+		now := time.Now().UTC()
+		promoteAt = record.PromoteAt
+		record.PromoteAt = time.Time{}
+		record.addEvent(EventRevoked, now, "")
+		return record.moveTo(StateRevoked, now)
+	})
+	if err != nil {
+		return err
+	}
+	ps.waiters.wake(recordKey(bucket, assetID))
+	// The promotion job refuses revoked assets anyway, it is cancelled so it does not run for nothing
+	if !promoteAt.IsZero() {
+		err = ps.scheduler.Cancel(ctx, *job.NewFixedDateJob(assetID.String(), nil, promoteAt))
+		if err != nil {
+			return err
+		}
+	}
+	// Parts can not be uploaded to an aborted upload, so its part urls stop working right away
+	if record.UploadID != "" {
+		err = ps.storage.AbortMultipartUpload(ctx, bucket, temporalPath+assetID.String(), record.UploadID)
+		if err != nil && !auerr.Is(err, auerr.ErrorNotFound) {
+			return err
+		}
+	}
+	if record.Resumable {
+		err = ps.storage.Delete(ctx, bucket, pendingPath+assetID.String())
+		if err != nil {
+			return err
+		}
+	}
+	// A single part url can not be revoked in the storage, whatever it uploads later is collected as garbage
+	return ps.storage.Delete(ctx, bucket, temporalPath+assetID.String())
+}
+
+// discardRevoked deletes the temporal object of a revoked asset, instead of promoting it.
+func (ps *assetManager) discardRevoked(ctx context.Context, bucket string, assetID uuid.UUID) error {
+	record, err := ps.repository.Get(ctx, bucket, assetID)
+	if err != nil {
+		return err
+	}
+	if record.State != StateRevoked {
+		return nil
+	}
+	return ps.storage.Delete(ctx, bucket, temporalPath+assetID.String())
+}
@@ -0,0 +1,75 @@
+package assets
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// AssetStatus is the lifecycle state of an asset.
+type AssetStatus struct {
+	State AssetState
+	// Size and ContentType are the ones of the uploaded content, zero until it is uploaded.
+	Size        int64
+	ContentType string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	// PromoteAt is when the asset is expected to be processed, zero unless its state is uploading.
+	PromoteAt time.Time
+	// StorageClass is the one of the uploaded content, empty for the default one of the bucket.
+	StorageClass StorageClass
+	// Error is why the asset failed or why its last processing did not succeed.
+	Error string
+}
+
+func (ps *assetManager) Status(ctx context.Context, bucket string, assetID uuid.UUID) (*AssetStatus, error) {
+	record, err := ps.repository.Get(ctx, bucket, assetID)
+	if err != nil {
+		return nil, err
+	}
+	assetStatus := &AssetStatus{
+		State:        record.State,
+		Size:         record.Size,
+		ContentType:  record.ContentType,
+		CreatedAt:    record.CreatedAt,
+		UpdatedAt:    record.UpdatedAt,
+		StorageClass: record.StorageClass,
+		Error:        record.Error,
+	}
+	if record.State == StateUploading {
+		assetStatus.PromoteAt = record.PromoteAt
+	}
+	// Until processed, the uploaded content is only known by the temporal folder
+	if record.State != StateCreated && record.State != StateUploading && record.State != StateProcessing {
+		return assetStatus, nil
+	}
+	encryption, err := ps.withKey(record.Constraints.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ps.storage.Head(ctx, bucket, temporalPath+assetID.String(), encryption)
+	if err != nil && !auerr.Is(err, auerr.ErrorNotFound) {
+		return nil, err
+	}
+	if info != nil {
+		assetStatus.Size = info.Size
+		assetStatus.ContentType = info.ContentType
+	}
+	return assetStatus, nil
+}
+
+// recordError keeps the error of a processing attempt in the asset record, so it can be queried with its status.
+// The asset goes back to uploading, so it can be processed again. It is best effort, the error is still returned by the job.
+func (ps *assetManager) recordError(ctx context.Context, bucket string, assetID uuid.UUID, err error) {
+	ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		if record.State != StateProcessing {
+			return auerr.FError(auerr.ErrorConflict, "Asset %s is %s", assetID.String(), record.State)
+		}
+		now := time.Now().UTC()
+		record.Error = err.Error()
+		record.addEvent(EventPromotionFailed, now, record.Error)
+		return record.moveTo(StateUploading, now)
+	})
+}
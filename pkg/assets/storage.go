@@ -0,0 +1,91 @@
+package assets
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"time"
+)
+
+// Storage is the object store where assets are kept.
+// Implementations should return auerr errors, with ErrorNotFound when the object does not exist.
+// The objects are written with the given encryption, and SSE-C ones can only be read with the key they were written with.
+type Storage interface {
+	// PresignPut creates an url to put an object under the given key which expires after expiration.
+	// The constraints are signed into the url, so puts with a different content type or length are rejected.
+	PresignPut(ctx context.Context, bucket string, key string, expiration time.Duration, constraints PutConstraints) (*url.URL, error)
+	// PresignGet creates an url to get the object under the given key which expires after expiration.
+	PresignGet(ctx context.Context, bucket string, key string, expiration time.Duration, encryption Encryption) (*url.URL, error)
+	// Put stores the body under the given key with the given tags.
+	Put(ctx context.Context, bucket string, key string, body io.ReadSeeker, tags map[string]string, encryption Encryption) error
+	// Get returns the content of the object under the given key, it should be closed after reading it.
+	Get(ctx context.Context, bucket string, key string, encryption Encryption) (io.ReadCloser, error)
+	// GetRange returns length bytes, at most, of the content of the object under the given key from offset, it should be closed after reading it.
+	// The length should be positive and the offset within the object.
+	GetRange(ctx context.Context, bucket string, key string, offset int64, length int64, encryption Encryption) (io.ReadCloser, error)
+	// Tags returns the tags of the object under the given key.
+	Tags(ctx context.Context, bucket string, key string) (map[string]string, error)
+	// SetTags replaces the tags of the object under the given key, leaving its content as it is.
+	SetTags(ctx context.Context, bucket string, key string, tags map[string]string) error
+	// Copy copies the object under srcKey to dstKey replacing its tags with the given ones, both have the same encryption.
+	// The copy is stored in the given storage class, the default one of the bucket if empty.
+	// srcKey and dstKey can be the same to change the storage class of an object.
+	Copy(ctx context.Context, bucket string, srcKey string, dstKey string, tags map[string]string, encryption Encryption, storageClass StorageClass) error
+	// Head returns the information of the object under the given key.
+	Head(ctx context.Context, bucket string, key string, encryption Encryption) (*ObjectInfo, error)
+	// List returns, in lexicographical order, up to limit keys starting with prefix and greater than startAfter.
+	// It also returns if there are more keys to list.
+	List(ctx context.Context, bucket string, prefix string, startAfter string, limit int64) ([]string, bool, error)
+	// Delete removes the object under the given key.
+	Delete(ctx context.Context, bucket string, key string) error
+	// CreateMultipartUpload starts a multipart upload for the given key and returns its upload id.
+	// The assembled object gets the given content type, if not empty, and encryption.
+	CreateMultipartUpload(ctx context.Context, bucket string, key string, contentType string, encryption Encryption) (string, error)
+	// PresignUploadPart creates an url to put the part partNumber of a multipart upload which expires after expiration.
+	// The encryption should be the one the upload was created with.
+	PresignUploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, expiration time.Duration, encryption Encryption) (*url.URL, error)
+	// UploadPart stores the body as the part partNumber of a multipart upload, with the encryption it was created with.
+	UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, body io.ReadSeeker, encryption Encryption) error
+	// CompleteMultipartUpload assembles the uploaded parts of a multipart upload into the object under the given key.
+	CompleteMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error
+	// AbortMultipartUpload discards a multipart upload and its uploaded parts.
+	AbortMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error
+	// RestoreArchived starts restoring a temporary copy of an archived object for the given days, so it can be read or copied meanwhile.
+	// Its progress is returned by Head, restoring an object already being restored is not an error.
+	RestoreArchived(ctx context.Context, bucket string, key string, days int64) error
+	// CheckBucket returns an error if the bucket can not be reached.
+	CheckBucket(ctx context.Context, bucket string) error
+}
+
+// ObjectInfo is the information of a stored object.
+type ObjectInfo struct {
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	// StorageClass is empty for the default one of the bucket.
+	StorageClass StorageClass
+	// Restoring tells if a restore of the archived object is in progress, and Restored if its temporary copy can be read.
+	Restoring bool
+	Restored  bool
+}
+
+// PutConstraints are the content type, length and checksum a put is restricted to. Zero values are not restricted.
+type PutConstraints struct {
+	ContentType   string
+	ContentLength int64
+	Checksum      Checksum
+	// Encryption is the one of the put content, signed too.
+	Encryption Encryption
+	// StorageClass is the one the asset is promoted to, chosen by the storage class policy if empty.
+	// It is not signed, the upload itself is kept in the default class until promoted.
+	StorageClass StorageClass
+}
+
+// Checksum is the digest of an object content. Empty values are unknown.
+type Checksum struct {
+	// MD5 is base64 encoded, as in the Content-MD5 header.
+	MD5 string
+	// SHA256 is hex encoded, as in the X-Amz-Content-Sha256 header.
+	SHA256 string
+}
@@ -0,0 +1,284 @@
+package assets_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// fakeStorage is an in memory assets.Storage for tests.
+type fakeStorage struct {
+	mutex        sync.Mutex
+	objects      map[string]fakeObject
+	uploads      map[string]map[int64][]byte
+	uploadsTypes map[string]string
+}
+
+type fakeObject struct {
+	body         []byte
+	tags         map[string]string
+	contentType  string
+	lastModified time.Time
+	storageClass assets.StorageClass
+	// restored tells if an archived object can be read, it is restored right away.
+	restored bool
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		objects:      make(map[string]fakeObject),
+		uploads:      make(map[string]map[int64][]byte),
+		uploadsTypes: make(map[string]string),
+	}
+}
+
+// upload stores content as it would be uploaded with a presigned put url.
+func (f *fakeStorage) upload(bucket string, key string, content string, contentType string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.objects[bucket+"/"+key] = fakeObject{body: []byte(content), contentType: contentType, lastModified: time.Now()}
+}
+
+func (f *fakeStorage) body(bucket string, key string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return string(f.objects[bucket+"/"+key].body)
+}
+
+func (f *fakeStorage) PresignPut(ctx context.Context, bucket string, key string, expiration time.Duration, constraints assets.PutConstraints) (*url.URL, error) {
+	return url.Parse("http://fake/" + bucket + "/" + key + "?method=PUT")
+}
+
+func (f *fakeStorage) PresignGet(ctx context.Context, bucket string, key string, expiration time.Duration, encryption assets.Encryption) (*url.URL, error) {
+	return url.Parse("http://fake/" + bucket + "/" + key + "?method=GET")
+}
+
+func (f *fakeStorage) Put(ctx context.Context, bucket string, key string, body io.ReadSeeker, tags map[string]string, encryption assets.Encryption) error {
+	var content []byte
+	if body != nil {
+		var err error
+		content, err = ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.objects[bucket+"/"+key] = fakeObject{body: content, tags: copyTags(tags), lastModified: time.Now()}
+	return nil
+}
+
+func (f *fakeStorage) Get(ctx context.Context, bucket string, key string, encryption assets.Encryption) (io.ReadCloser, error) {
+	object, err := f.readableObject(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(object.body)), nil
+}
+
+func (f *fakeStorage) GetRange(ctx context.Context, bucket string, key string, offset int64, length int64, encryption assets.Encryption) (io.ReadCloser, error) {
+	object, err := f.readableObject(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	end := offset + length
+	if end > int64(len(object.body)) {
+		end = int64(len(object.body))
+	}
+	return ioutil.NopCloser(bytes.NewReader(object.body[offset:end])), nil
+}
+
+func (f *fakeStorage) Tags(ctx context.Context, bucket string, key string) (map[string]string, error) {
+	object, err := f.object(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return copyTags(object.tags), nil
+}
+
+func (f *fakeStorage) SetTags(ctx context.Context, bucket string, key string, tags map[string]string) error {
+	object, err := f.object(bucket, key)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	object.tags = copyTags(tags)
+	f.objects[bucket+"/"+key] = object
+	return nil
+}
+
+func (f *fakeStorage) Copy(ctx context.Context, bucket string, srcKey string, dstKey string, tags map[string]string, encryption assets.Encryption, storageClass assets.StorageClass) error {
+	object, err := f.readableObject(bucket, srcKey)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.objects[bucket+"/"+dstKey] = fakeObject{body: object.body, tags: copyTags(tags), contentType: object.contentType, lastModified: time.Now(), storageClass: storageClass}
+	return nil
+}
+
+func (f *fakeStorage) Head(ctx context.Context, bucket string, key string, encryption assets.Encryption) (*assets.ObjectInfo, error) {
+	object, err := f.object(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &assets.ObjectInfo{
+		Size:         int64(len(object.body)),
+		ContentType:  object.contentType,
+		LastModified: object.lastModified,
+		StorageClass: object.storageClass,
+		Restored:     object.restored,
+	}, nil
+}
+
+func (f *fakeStorage) List(ctx context.Context, bucket string, prefix string, startAfter string, limit int64) ([]string, bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	keys := make([]string, 0)
+	for path := range f.objects {
+		key := strings.TrimPrefix(path, bucket+"/")
+		if key != path && strings.HasPrefix(key, prefix) && key > startAfter {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if int64(len(keys)) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
+
+func (f *fakeStorage) Delete(ctx context.Context, bucket string, key string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.objects, bucket+"/"+key)
+	return nil
+}
+
+func (f *fakeStorage) CreateMultipartUpload(ctx context.Context, bucket string, key string, contentType string, encryption assets.Encryption) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	uploadID := strconv.Itoa(len(f.uploads) + 1)
+	f.uploads[uploadID] = make(map[int64][]byte)
+	f.uploadsTypes[uploadID] = contentType
+	return uploadID, nil
+}
+
+func (f *fakeStorage) PresignUploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, expiration time.Duration, encryption assets.Encryption) (*url.URL, error) {
+	return url.Parse(fmt.Sprintf("http://fake/%s/%s?uploadId=%s&partNumber=%d", bucket, key, uploadID, partNumber))
+}
+
+func (f *fakeStorage) uploadPart(uploadID string, partNumber int64, content string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.uploads[uploadID][partNumber] = []byte(content)
+}
+
+func (f *fakeStorage) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, body io.ReadSeeker, encryption assets.Encryption) error {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		return auerr.FError(auerr.ErrorNotFound, "Upload %s is not found", uploadID)
+	}
+	parts[partNumber] = content
+	return nil
+}
+
+func (f *fakeStorage) CompleteMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		return auerr.FError(auerr.ErrorNotFound, "Upload %s is not found", uploadID)
+	}
+	content := make([]byte, 0)
+	for partNumber := int64(1); partNumber <= int64(len(parts)); partNumber++ {
+		content = append(content, parts[partNumber]...)
+	}
+	f.objects[bucket+"/"+key] = fakeObject{body: content, contentType: f.uploadsTypes[uploadID], lastModified: time.Now()}
+	delete(f.uploads, uploadID)
+	return nil
+}
+
+func (f *fakeStorage) AbortMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.uploads[uploadID]; !ok {
+		return auerr.FError(auerr.ErrorNotFound, "Upload %s is not found", uploadID)
+	}
+	delete(f.uploads, uploadID)
+	return nil
+}
+
+func (f *fakeStorage) RestoreArchived(ctx context.Context, bucket string, key string, days int64) error {
+	object, err := f.object(bucket, key)
+	if err != nil {
+		return err
+	}
+	if !object.storageClass.Archived() {
+		return auerr.FError(auerr.ErrorConflict, "Object %s/%s is not archived", bucket, key)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	object.restored = true
+	f.objects[bucket+"/"+key] = object
+	return nil
+}
+
+func (f *fakeStorage) CheckBucket(ctx context.Context, bucket string) error {
+	return nil
+}
+
+func (f *fakeStorage) storageClass(bucket string, key string) assets.StorageClass {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.objects[bucket+"/"+key].storageClass
+}
+
+// readableObject returns the object, unless it is archived and not restored.
+func (f *fakeStorage) readableObject(bucket string, key string) (fakeObject, error) {
+	object, err := f.object(bucket, key)
+	if err != nil {
+		return object, err
+	}
+	if object.storageClass.Archived() && !object.restored {
+		return object, auerr.FError(auerr.ErrorConflict, "Object %s/%s is archived", bucket, key)
+	}
+	return object, nil
+}
+
+func (f *fakeStorage) object(bucket string, key string) (fakeObject, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	object, ok := f.objects[bucket+"/"+key]
+	if !ok {
+		return fakeObject{}, auerr.FError(auerr.ErrorNotFound, "Object %s/%s is not found", bucket, key)
+	}
+	return object, nil
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	copied := make(map[string]string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,170 @@
+package assets
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// Tenant is a team served by the service, identified by its api keys, with the assets kept apart in its own bucket and prefix.
+type Tenant struct {
+	ID      string   `json:"id"`
+	APIKeys []string `json:"apiKeys"`
+	Bucket  string   `json:"bucket"`
+	// Prefix is prepended to every key of the tenant, so tenants can share a bucket. Empty keeps the keys at the root.
+	Prefix string `json:"prefix,omitempty"`
+	// Region is the one of the bucket, the default one of the service if empty.
+	Region string `json:"region,omitempty"`
+}
+
+// ReadTenants reads the tenants of a json file with a list of them, once checked.
+func ReadTenants(path string) ([]Tenant, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	var tenants []Tenant
+	err = json.Unmarshal(content, &tenants)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorBadInput, err)
+	}
+	return tenants, CheckTenants(tenants)
+}
+
+// CheckTenants checks every tenant has an id, a bucket and api keys, neither the ids nor the keys are shared,
+// and tenants sharing a bucket do not share their keys either.
+func CheckTenants(tenants []Tenant) error {
+	if len(tenants) == 0 {
+		return auerr.SError(auerr.ErrorBadInput, "There should be at least one tenant")
+	}
+	ids := make(map[string]bool)
+	apiKeys := make(map[string]bool)
+	for i, tenant := range tenants {
+		if tenant.ID == "" || tenant.Bucket == "" || len(tenant.APIKeys) == 0 {
+			return auerr.FError(auerr.ErrorBadInput, "Tenant %d should have an id, a bucket and api keys", i)
+		}
+		if ids[tenant.ID] {
+			return auerr.FError(auerr.ErrorBadInput, "Tenant %s is repeated", tenant.ID)
+		}
+		ids[tenant.ID] = true
+		for _, apiKey := range tenant.APIKeys {
+			if apiKey == "" || apiKeys[apiKey] {
+				return auerr.FError(auerr.ErrorBadInput, "Api keys of tenant %s should not be empty nor shared", tenant.ID)
+			}
+			apiKeys[apiKey] = true
+		}
+		for _, other := range tenants[:i] {
+			if other.Bucket == tenant.Bucket && overlaps(other.Prefix, tenant.Prefix) {
+				return auerr.FError(auerr.ErrorBadInput, "Tenants %s and %s share the bucket %s, so they need disjoint prefixes", other.ID, tenant.ID, tenant.Bucket)
+			}
+		}
+	}
+	return nil
+}
+
+// overlaps tells if the keys under one prefix can be under the other one.
+func overlaps(prefix string, other string) bool {
+	return strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix)
+}
+
+// NewPrefixedStorage creates a Storage keeping every object of the given one under prefix, so it is isolated from the rest of the bucket.
+// The keys it lists are relative to prefix too.
+func NewPrefixedStorage(storage Storage, prefix string) Storage {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	return &prefixedStorage{storage: storage, prefix: prefix}
+}
+
+type prefixedStorage struct {
+	storage Storage
+	prefix  string
+}
+
+func (p *prefixedStorage) PresignPut(ctx context.Context, bucket string, key string, expiration time.Duration, constraints PutConstraints) (*url.URL, error) {
+	return p.storage.PresignPut(ctx, bucket, p.prefix+key, expiration, constraints)
+}
+
+func (p *prefixedStorage) PresignGet(ctx context.Context, bucket string, key string, expiration time.Duration, encryption Encryption) (*url.URL, error) {
+	return p.storage.PresignGet(ctx, bucket, p.prefix+key, expiration, encryption)
+}
+
+func (p *prefixedStorage) Put(ctx context.Context, bucket string, key string, body io.ReadSeeker, tags map[string]string, encryption Encryption) error {
+	return p.storage.Put(ctx, bucket, p.prefix+key, body, tags, encryption)
+}
+
+func (p *prefixedStorage) Get(ctx context.Context, bucket string, key string, encryption Encryption) (io.ReadCloser, error) {
+	return p.storage.Get(ctx, bucket, p.prefix+key, encryption)
+}
+
+func (p *prefixedStorage) GetRange(ctx context.Context, bucket string, key string, offset int64, length int64, encryption Encryption) (io.ReadCloser, error) {
+	return p.storage.GetRange(ctx, bucket, p.prefix+key, offset, length, encryption)
+}
+
+func (p *prefixedStorage) Tags(ctx context.Context, bucket string, key string) (map[string]string, error) {
+	return p.storage.Tags(ctx, bucket, p.prefix+key)
+}
+
+func (p *prefixedStorage) SetTags(ctx context.Context, bucket string, key string, tags map[string]string) error {
+	return p.storage.SetTags(ctx, bucket, p.prefix+key, tags)
+}
+
+func (p *prefixedStorage) Copy(ctx context.Context, bucket string, srcKey string, dstKey string, tags map[string]string, encryption Encryption, storageClass StorageClass) error {
+	return p.storage.Copy(ctx, bucket, p.prefix+srcKey, p.prefix+dstKey, tags, encryption, storageClass)
+}
+
+func (p *prefixedStorage) Head(ctx context.Context, bucket string, key string, encryption Encryption) (*ObjectInfo, error) {
+	return p.storage.Head(ctx, bucket, p.prefix+key, encryption)
+}
+
+func (p *prefixedStorage) List(ctx context.Context, bucket string, prefix string, startAfter string, limit int64) ([]string, bool, error) {
+	if startAfter != "" {
+		startAfter = p.prefix + startAfter
+	}
+	keys, more, err := p.storage.List(ctx, bucket, p.prefix+prefix, startAfter, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, p.prefix)
+	}
+	return keys, more, nil
+}
+
+func (p *prefixedStorage) Delete(ctx context.Context, bucket string, key string) error {
+	return p.storage.Delete(ctx, bucket, p.prefix+key)
+}
+
+func (p *prefixedStorage) CreateMultipartUpload(ctx context.Context, bucket string, key string, contentType string, encryption Encryption) (string, error) {
+	return p.storage.CreateMultipartUpload(ctx, bucket, p.prefix+key, contentType, encryption)
+}
+
+func (p *prefixedStorage) PresignUploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, expiration time.Duration, encryption Encryption) (*url.URL, error) {
+	return p.storage.PresignUploadPart(ctx, bucket, p.prefix+key, uploadID, partNumber, expiration, encryption)
+}
+
+func (p *prefixedStorage) UploadPart(ctx context.Context, bucket string, key string, uploadID string, partNumber int64, body io.ReadSeeker, encryption Encryption) error {
+	return p.storage.UploadPart(ctx, bucket, p.prefix+key, uploadID, partNumber, body, encryption)
+}
+
+func (p *prefixedStorage) CompleteMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	return p.storage.CompleteMultipartUpload(ctx, bucket, p.prefix+key, uploadID)
+}
+
+func (p *prefixedStorage) AbortMultipartUpload(ctx context.Context, bucket string, key string, uploadID string) error {
+	return p.storage.AbortMultipartUpload(ctx, bucket, p.prefix+key, uploadID)
+}
+
+func (p *prefixedStorage) RestoreArchived(ctx context.Context, bucket string, key string, days int64) error {
+	return p.storage.RestoreArchived(ctx, bucket, p.prefix+key, days)
+}
+
+func (p *prefixedStorage) CheckBucket(ctx context.Context, bucket string) error {
+	return p.storage.CheckBucket(ctx, bucket)
+}
@@ -0,0 +1,54 @@
+package assets_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+func TestCheckTenants(t *testing.T) {
+	valid := assets.Tenant{ID: "a", APIKeys: []string{"key-a"}, Bucket: "bucket", Prefix: "a/"}
+	err := assets.CheckTenants([]assets.Tenant{valid, {ID: "b", APIKeys: []string{"key-b"}, Bucket: "bucket", Prefix: "b/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tenants := range map[string][]assets.Tenant{
+		"TestEmpty":            nil,
+		"TestWithoutBucket":    {{ID: "a", APIKeys: []string{"key-a"}}},
+		"TestWithoutKeys":      {{ID: "a", Bucket: "bucket"}},
+		"TestRepeatedID":       {valid, {ID: "a", APIKeys: []string{"key-b"}, Bucket: "other"}},
+		"TestSharedKey":        {valid, {ID: "b", APIKeys: []string{"key-a"}, Bucket: "other"}},
+		"TestOverlappedPrefix": {valid, {ID: "b", APIKeys: []string{"key-b"}, Bucket: "bucket"}},
+	} {
+		err := assets.CheckTenants(tenants)
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("%s should be a bad input, not %v", name, err)
+		}
+	}
+}
+
+func TestPrefixedStorage(t *testing.T) {
+	storage := newFakeStorage()
+	storage.upload("bucket", "a/uploaded/1", "CONTENT", "")
+	storage.upload("bucket", "a/uploaded/2", "CONTENT", "")
+	storage.upload("bucket", "b/uploaded/3", "CONTENT", "")
+	prefixed := assets.NewPrefixedStorage(storage, "a")
+	ctx := context.Background()
+	keys, more, err := prefixed.List(ctx, "bucket", "uploaded/", "uploaded/1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more || !reflect.DeepEqual(keys, []string{"uploaded/2"}) {
+		t.Fatalf("Keys should be the ones of the prefix after the start, not %v", keys)
+	}
+	err = prefixed.Delete(ctx, "bucket", "uploaded/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.body("bucket", "a/uploaded/1") != "" || storage.body("bucket", "b/uploaded/3") != "CONTENT" {
+		t.Fatal("Only the object under the prefix should be deleted")
+	}
+}
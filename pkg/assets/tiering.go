@@ -0,0 +1,411 @@
+package assets
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+	"github.com/tgracchus/assetuploader/pkg/job"
+)
+
+// StorageClass is the storage tier the content of an asset is kept in.
+type StorageClass string
+
+const (
+	// StorageClassDefault leaves the content in the default storage class of the bucket.
+	StorageClassDefault StorageClass = ""
+	// StorageClassStandard is the frequently accessed tier.
+	StorageClassStandard StorageClass = "STANDARD"
+	// StorageClassStandardIA is the infrequently accessed tier.
+	StorageClassStandardIA StorageClass = "STANDARD_IA"
+	// StorageClassOneZoneIA is the infrequently accessed tier kept in a single availability zone.
+	StorageClassOneZoneIA StorageClass = "ONEZONE_IA"
+	// StorageClassIntelligentTiering moves the content between tiers by its access pattern.
+	StorageClassIntelligentTiering StorageClass = "INTELLIGENT_TIERING"
+	// StorageClassGlacier is an archive tier, its content has to be restored to be read.
+	StorageClassGlacier StorageClass = "GLACIER"
+	// StorageClassDeepArchive is the cheapest archive tier, with the slowest restores.
+	StorageClassDeepArchive StorageClass = "DEEP_ARCHIVE"
+)
+
+// StorageClasses are all the storage classes an asset can be kept in.
+var StorageClasses = []StorageClass{
+	StorageClassStandard,
+	StorageClassStandardIA,
+	StorageClassOneZoneIA,
+	StorageClassIntelligentTiering,
+	StorageClassGlacier,
+	StorageClassDeepArchive,
+}
+
+// restoreDays is how long the temporary copy of a restored archived object is kept, enough to copy it out of the archive.
+const restoreDays = 1
+
+// DefaultRestoreCheckPeriod is how often the progress of the restore of an archived asset is checked by default.
+const DefaultRestoreCheckPeriod = 15 * time.Minute
+
+// Archived tells if the content in the storage class has to be restored to be read.
+func (c StorageClass) Archived() bool {
+	return c == StorageClassGlacier || c == StorageClassDeepArchive
+}
+
+// ParseStorageClass returns the storage class of the given name, in any case. Empty is the default one.
+func ParseStorageClass(name string) (StorageClass, error) {
+	if name == "" {
+		return StorageClassDefault, nil
+	}
+	for _, storageClass := range StorageClasses {
+		if strings.EqualFold(name, string(storageClass)) {
+			return storageClass, nil
+		}
+	}
+	return StorageClassDefault, auerr.FError(auerr.ErrorBadInput, "Storage class should be one of %v, not %s", StorageClasses, name)
+}
+
+// StorageClassPolicy chooses the storage class of the assets promoted without one requested.
+type StorageClassPolicy struct {
+	// Default is the storage class of the assets no rule applies to, the default one of the bucket if empty.
+	Default StorageClass
+	// Rules choose the storage class by the asset size, the one with the greatest MinSize not over it applies.
+	Rules []StorageClassRule
+}
+
+// StorageClassRule is the storage class of the assets of at least MinSize bytes.
+type StorageClassRule struct {
+	MinSize      int64
+	StorageClass StorageClass
+}
+
+// ParseStorageClassRules parses rules written as minSize=CLASS, like 1048576=STANDARD_IA.
+func ParseStorageClassRules(values []string) ([]StorageClassRule, error) {
+	rules := make([]StorageClassRule, 0, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, auerr.FError(auerr.ErrorBadInput, "Storage class rule %s should be minSize=CLASS", value)
+		}
+		minSize, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || minSize < 0 {
+			return nil, auerr.FError(auerr.ErrorBadInput, "Min size of the storage class rule %s should be a positive number of bytes", value)
+		}
+		storageClass, err := ParseStorageClass(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, StorageClassRule{MinSize: minSize, StorageClass: storageClass})
+	}
+	return rules, nil
+}
+
+// storageClass returns the storage class of an asset of the given size.
+func (p StorageClassPolicy) storageClass(size int64) StorageClass {
+	rules := append([]StorageClassRule(nil), p.Rules...)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].MinSize > rules[j].MinSize
+	})
+	for _, rule := range rules {
+		if size >= rule.MinSize {
+			return rule.StorageClass
+		}
+	}
+	return p.Default
+}
+
+// WithStorageClassPolicy sets the storage class of the assets promoted without one requested, the default one of the bucket if not set.
+// Archive classes are not allowed, assets are archived by the archive job.
+func WithStorageClassPolicy(policy StorageClassPolicy) Option {
+	return func(manager *assetManager) {
+		manager.storageClassPolicy = policy
+	}
+}
+
+// WithArchive sets how long after being uploaded an asset is moved to the given archive storage class by the archive job.
+func WithArchive(after time.Duration, storageClass StorageClass) Option {
+	return func(manager *assetManager) {
+		manager.archiveAfter = after
+		manager.archiveStorageClass = storageClass
+	}
+}
+
+// WithRestoreCheckPeriod sets how often the progress of the restore of an archived asset is checked, every 15 minutes by default.
+func WithRestoreCheckPeriod(period time.Duration) Option {
+	return func(manager *assetManager) {
+		manager.restoreCheckPeriod = period
+	}
+}
+
+// checkStorageClass returns the requested storage class of an asset normalized, once checked it can be promoted to.
+func checkStorageClass(storageClass StorageClass) (StorageClass, error) {
+	parsed, err := ParseStorageClass(string(storageClass))
+	if err != nil {
+		return storageClass, err
+	}
+	if parsed.Archived() {
+		return storageClass, auerr.FError(auerr.ErrorBadInput, "Storage class %s is an archive one, assets are only archived by the archive job", parsed)
+	}
+	return parsed, nil
+}
+
+// promotionStorageClass returns the storage class an asset is promoted to, the requested one or the one chosen by the policy.
+func (ps *assetManager) promotionStorageClass(record *AssetRecord, size int64) StorageClass {
+	if record.Constraints.StorageClass != StorageClassDefault {
+		return record.Constraints.StorageClass
+	}
+	return ps.storageClassPolicy.storageClass(size)
+}
+
+func (ps *assetManager) ScheduleArchive(ctx context.Context, bucket string, period time.Duration) error {
+	if period <= 0 {
+		return auerr.FError(auerr.ErrorBadInput, "Archive period should be positive, not %s", period)
+	}
+	if ps.archiveAfter <= 0 || !ps.archiveStorageClass.Archived() {
+		return auerr.SError(auerr.ErrorBadInput, "Archive requires a positive age and an archive storage class")
+	}
+	return ps.schedulePeriodic(ctx, "archive-"+bucket, period, time.Now().UTC().Add(period), func(ctx context.Context) error {
+		archived, err := ps.archiveAssets(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if len(archived) > 0 {
+			log.Printf("Archived assets of %s %v", bucket, archived)
+		}
+		resumed, err := ps.resumeRestores(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if len(resumed) > 0 {
+			log.Printf("Resumed restores of %s, checked %v", bucket, resumed)
+		}
+		return nil
+	})
+}
+
+// archiveAssets moves to the archive storage class the assets uploaded longer than the archive age ago.
+func (ps *assetManager) archiveAssets(ctx context.Context, bucket string) ([]string, error) {
+	archived := make([]string, 0)
+	now := time.Now().UTC()
+	err := ps.listRecords(ctx, bucket, func(record *AssetRecord) error {
+		if record.State != StateUploaded || now.Before(record.uploadedAt().Add(ps.archiveAfter)) {
+			return nil
+		}
+		err := ps.archive(ctx, bucket, record)
+		if err != nil {
+			// Retried on the next run
+			log.Println(err.Error())
+			return nil
+		}
+		archived = append(archived, record.ID.String())
+		return nil
+	})
+	return archived, err
+}
+
+// uploadedAt returns when the asset was last uploaded, by its promotion or its restore from the archive.
+func (r *AssetRecord) uploadedAt() time.Time {
+	for i := len(r.History) - 1; i >= 0; i-- {
+		if r.History[i].State == StateUploaded {
+			return r.History[i].At
+		}
+	}
+	return r.UpdatedAt
+}
+
+// archive copies the uploaded object in place to the archive storage class, and marks the asset as archived.
+func (ps *assetManager) archive(ctx context.Context, bucket string, record *AssetRecord) error {
+	encryption, err := ps.withKey(record.Constraints.Encryption)
+	if err != nil {
+		return err
+	}
+	key := uploadedPath + record.ID.String()
+	err = ps.storage.Copy(ctx, bucket, key, key, map[string]string{status: uploaded}, encryption, ps.archiveStorageClass)
+	// An archived object can not be copied, it was archived by a previous run which did not mark the asset
+	if err != nil && !auerr.Is(err, auerr.ErrorConflict) {
+		return ps.assetError(err, record.ID)
+	}
+	updated, err := ps.repository.Update(ctx, bucket, record.ID, func(record *AssetRecord) error {
+		if record.State != StateUploaded {
+			return auerr.FError(auerr.ErrorConflict, "Asset %s is %s", record.ID.String(), record.State)
+		}
+		now := time.Now().UTC()
+		record.StorageClass = ps.archiveStorageClass
+		record.addEvent(EventArchived, now, string(ps.archiveStorageClass))
+		return record.moveTo(StateArchived, now)
+	})
+	if err != nil {
+		return err
+	}
+	ps.notify(ctx, updated, EventArchived, string(ps.archiveStorageClass))
+	return nil
+}
+
+// restoreArchived starts the restore of an archived asset, whose progress is checked by a scheduled job until it is uploaded again.
+func (ps *assetManager) restoreArchived(ctx context.Context, bucket string, assetID uuid.UUID) (AssetState, error) {
+	checkAt := time.Now().UTC().Add(ps.restoreCheckPeriod)
+	record, err := ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		if record.State == StateRestoring {
+			// Already started, its job keeps checking it
+			return nil
+		}
+		if record.State != StateArchived {
+			return auerr.FError(auerr.ErrorConflict, "Asset %s is neither deleted nor archived", assetID.String())
+		}
+		now := time.Now().UTC()
+		record.RestoreCheckAt = checkAt
+		record.addEvent(EventArchiveRestoreStarted, now, "")
+		return record.moveTo(StateRestoring, now)
+	})
+	if err != nil {
+		return "", err
+	}
+	if !record.RestoreCheckAt.Equal(checkAt) {
+		return record.State, nil
+	}
+	err = ps.startRestore(ctx, bucket, record)
+	if err != nil {
+		// Back to archived, so the restore can be requested again
+		ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+			if record.State != StateRestoring || !record.RestoreCheckAt.Equal(checkAt) {
+				return auerr.FError(auerr.ErrorConflict, "Asset %s is %s", assetID.String(), record.State)
+			}
+			record.RestoreCheckAt = time.Time{}
+			record.Error = err.Error()
+			return record.moveTo(StateArchived, time.Now().UTC())
+		})
+		return "", err
+	}
+	return StateRestoring, ps.scheduleRestoreCheck(ctx, bucket, assetID, checkAt)
+}
+
+func (ps *assetManager) startRestore(ctx context.Context, bucket string, record *AssetRecord) error {
+	err := ps.storage.RestoreArchived(ctx, bucket, uploadedPath+record.ID.String(), restoreDays)
+	return ps.assetError(err, record.ID)
+}
+
+// scheduleRestoreCheck schedules the check of the restore progress at the given date,
+// the one recorded so only the last scheduled check goes on.
+func (ps *assetManager) scheduleRestoreCheck(ctx context.Context, bucket string, assetID uuid.UUID, checkAt time.Time) error {
+	checkJob := job.NewFixedDateJob(
+		assetID.String()+"-restore-"+checkAt.Format(time.RFC3339Nano),
+		ps.newRestoreCheckFunction(bucket, assetID, checkAt),
+		checkAt,
+	)
+	return ps.scheduler.Schedule(ctx, *checkJob)
+}
+
+// newRestoreCheckFunction checks the restore of an archived asset. Once restored, its object is copied out of the archive
+// and the asset is uploaded again, otherwise it is checked again later.
+func (ps *assetManager) newRestoreCheckFunction(bucket string, assetID uuid.UUID, checkAt time.Time) job.Function {
+	return func(ctx context.Context) error {
+		record, err := ps.repository.Get(ctx, bucket, assetID)
+		if auerr.Is(err, auerr.ErrorNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.State != StateRestoring || !record.RestoreCheckAt.Equal(checkAt) {
+			// Done, deleted, or checked by a later job
+			return nil
+		}
+		encryption, err := ps.withKey(record.Constraints.Encryption)
+		if err != nil {
+			return err
+		}
+		key := uploadedPath + assetID.String()
+		info, err := ps.storage.Head(ctx, bucket, key, encryption)
+		if err != nil {
+			return ps.nextRestoreCheck(ctx, bucket, assetID, checkAt, ps.assetError(err, assetID))
+		}
+		if info.Restoring {
+			return ps.nextRestoreCheck(ctx, bucket, assetID, checkAt, nil)
+		}
+		if !info.Restored && info.StorageClass.Archived() {
+			// The restore is gone, it expired or was never started, so it is started again
+			return ps.nextRestoreCheck(ctx, bucket, assetID, checkAt, ps.startRestore(ctx, bucket, record))
+		}
+		storageClass := ps.promotionStorageClass(record, record.Size)
+		err = ps.storage.Copy(ctx, bucket, key, key, map[string]string{status: uploaded}, encryption, storageClass)
+		if err != nil {
+			return ps.nextRestoreCheck(ctx, bucket, assetID, checkAt, ps.assetError(err, assetID))
+		}
+		updated, err := ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+			if record.State != StateRestoring {
+				return auerr.FError(auerr.ErrorConflict, "Asset %s is %s", assetID.String(), record.State)
+			}
+			now := time.Now().UTC()
+			record.StorageClass = storageClass
+			record.RestoreCheckAt = time.Time{}
+			record.Error = ""
+			record.addEvent(EventArchiveRestored, now, string(storageClass))
+			return record.moveTo(StateUploaded, now)
+		})
+		if err != nil {
+			return err
+		}
+		ps.waiters.wake(recordKey(bucket, assetID))
+		ps.notify(ctx, updated, EventArchiveRestored, string(storageClass))
+		return nil
+	}
+}
+
+// nextRestoreCheck schedules the next check of the restore, keeping the error of this one in the asset record.
+func (ps *assetManager) nextRestoreCheck(ctx context.Context, bucket string, assetID uuid.UUID, checkAt time.Time, checkErr error) error {
+	next := time.Now().UTC().Add(ps.restoreCheckPeriod)
+	_, err := ps.repository.Update(ctx, bucket, assetID, func(record *AssetRecord) error {
+		if record.State != StateRestoring || !record.RestoreCheckAt.Equal(checkAt) {
+			return auerr.FError(auerr.ErrorConflict, "Asset %s is %s", assetID.String(), record.State)
+		}
+		record.RestoreCheckAt = next
+		record.Error = ""
+		if checkErr != nil {
+			record.Error = checkErr.Error()
+		}
+		return nil
+	})
+	if auerr.Is(err, auerr.ErrorConflict) {
+		return checkErr
+	}
+	if err != nil {
+		return err
+	}
+	err = ps.scheduleRestoreCheck(ctx, bucket, assetID, next)
+	if err != nil {
+		return err
+	}
+	return checkErr
+}
+
+func (ps *assetManager) ResumeRestores(ctx context.Context, bucket string) error {
+	return ps.listRecords(ctx, bucket, func(record *AssetRecord) error {
+		if record.State != StateRestoring {
+			return nil
+		}
+		// The job is named after the check date, so it replaces the one still scheduled, if any
+		return ps.scheduleRestoreCheck(ctx, bucket, record.ID, record.RestoreCheckAt)
+	})
+}
+
+// resumeRestores checks the restoring assets whose check is overdue by a whole period,
+// since their job is lost if the service restarts meanwhile.
+func (ps *assetManager) resumeRestores(ctx context.Context, bucket string) ([]string, error) {
+	resumed := make([]string, 0)
+	now := time.Now().UTC()
+	err := ps.listRecords(ctx, bucket, func(record *AssetRecord) error {
+		if record.State != StateRestoring || record.RestoreCheckAt.Add(ps.restoreCheckPeriod).After(now) {
+			return nil
+		}
+		err := ps.newRestoreCheckFunction(bucket, record.ID, record.RestoreCheckAt)(ctx)
+		if err != nil {
+			// Kept in the asset status, and retried on the next check
+			log.Println(err.Error())
+		}
+		resumed = append(resumed, record.ID.String())
+		return nil
+	})
+	return resumed, err
+}
@@ -0,0 +1,83 @@
+package assets
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// MaxWait is the maximum time to wait for an asset to be processed.
+const MaxWait = time.Minute
+
+// waiters are the channels closed when the processing of an asset finishes, by asset.
+type waiters struct {
+	mutex    sync.Mutex
+	channels map[string][]chan struct{}
+}
+
+func newWaiters() *waiters {
+	return &waiters{channels: make(map[string][]chan struct{})}
+}
+
+func (w *waiters) add(key string) chan struct{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	done := make(chan struct{})
+	w.channels[key] = append(w.channels[key], done)
+	return done
+}
+
+func (w *waiters) remove(key string, done chan struct{}) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	channels := w.channels[key]
+	for i, channel := range channels {
+		if channel == done {
+			channels = append(channels[:i], channels[i+1:]...)
+			break
+		}
+	}
+	if len(channels) == 0 {
+		delete(w.channels, key)
+	} else {
+		w.channels[key] = channels
+	}
+}
+
+// wake wakes up everybody waiting for the asset.
+func (w *waiters) wake(key string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, done := range w.channels[key] {
+		close(done)
+	}
+	delete(w.channels, key)
+}
+
+func (ps *assetManager) WaitProcessed(ctx context.Context, bucket string, assetID uuid.UUID, wait time.Duration) error {
+	if wait < 0 || wait > MaxWait {
+		return auerr.FError(auerr.ErrorBadInput, "Wait should be between 0 and %s, not %s", MaxWait, wait)
+	}
+	key := recordKey(bucket, assetID)
+	// Registered before reading the state, so a processing finished in between is not missed
+	done := ps.waiters.add(key)
+	defer ps.waiters.remove(key, done)
+	record, err := ps.record(ctx, bucket, assetID)
+	if err != nil {
+		return err
+	}
+	if record.State != StateCreated && record.State != StateUploading && record.State != StateProcessing {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package assets
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+func (ps *assetManager) ScheduleUploadWatcher(ctx context.Context, bucket string, period time.Duration) error {
+	if period <= 0 {
+		return auerr.FError(auerr.ErrorBadInput, "Upload watcher period should be positive, not %s", period)
+	}
+	return ps.schedulePeriodic(ctx, "watch-"+bucket, period, time.Now().UTC().Add(period), func(ctx context.Context) error {
+		detected, err := ps.detectUploads(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if len(detected) > 0 {
+			log.Printf("Detected uploads of %s, marked as uploaded %v", bucket, detected)
+		}
+		resumed, err := ps.resumeUploads(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if len(resumed) > 0 {
+			log.Printf("Resumed uploads of %s, processed %v", bucket, resumed)
+		}
+		return nil
+	})
+}
+
+// detectUploads marks as uploaded the created assets with an uploaded object, as if the client did.
+// Multipart uploads have no object until completed, and only the client knows when all their parts are uploaded,
+// so they still need to be marked by it.
+func (ps *assetManager) detectUploads(ctx context.Context, bucket string) ([]string, error) {
+	detected := make([]string, 0)
+	err := ps.listAssetIDs(ctx, bucket, temporalPath, func(assetID uuid.UUID) error {
+		record, err := ps.repository.Get(ctx, bucket, assetID)
+		if auerr.Is(err, auerr.ErrorNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.State != StateCreated {
+			return nil
+		}
+		err = ps.uploaded(ctx, bucket, assetID, EventUploadDetected)
+		// Marked by the client meanwhile
+		if auerr.Is(err, auerr.ErrorConflict) || auerr.Is(err, auerr.ErrorNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		detected = append(detected, assetID.String())
+		return nil
+	})
+	return detected, err
+}
+
+// resumeUploads processes the uploading assets whose promotion date passed,
+// since their job is lost if the service restarts meanwhile. Processing is guarded by the asset state,
+// so it does not overlap with the job if it is still scheduled.
+func (ps *assetManager) resumeUploads(ctx context.Context, bucket string) ([]string, error) {
+	resumed := make([]string, 0)
+	now := time.Now().UTC()
+	err := ps.listRecords(ctx, bucket, func(record *AssetRecord) error {
+		if record.State != StateUploading || record.PromoteAt.After(now) {
+			return nil
+		}
+		err := ps.newUploadedFunction(bucket, record.ID)(ctx)
+		if err != nil {
+			// Kept in the asset status, and retried on the next run
+			log.Println(err.Error())
+			return nil
+		}
+		resumed = append(resumed, record.ID.String())
+		return nil
+	})
+	return resumed, err
+}
@@ -0,0 +1,523 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+	"github.com/tgracchus/assetuploader/pkg/job"
+	"github.com/tgracchus/assetuploader/pkg/schedule"
+)
+
+// SignatureHeader is the header of the webhook callbacks with the hex encoded hmac sha256 of the body, keyed by the webhook secret.
+const SignatureHeader = "X-Assetuploader-Signature"
+
+// DeliveryHeader is the header of the webhook callbacks with the delivery id, the same on every attempt.
+const DeliveryHeader = "X-Assetuploader-Delivery"
+
+// maxDeliveries is the maximum number of finished deliveries kept per webhook, the oldest ones are dropped first.
+const maxDeliveries = 1000
+
+// maxQueuedAttempts is the maximum number of due attempts waiting for a worker, the next ones are postponed.
+const maxQueuedAttempts = 1000
+
+// NotifiedEvents are the events the webhooks can be notified of.
+var NotifiedEvents = []EventType{EventPromotionSucceeded, EventPromotionFailed, EventDeleted, EventArchived, EventArchiveRestored}
+
+// Notification is an asset lifecycle event sent to the webhooks.
+type Notification struct {
+	Event   EventType  `json:"event"`
+	Bucket  string     `json:"bucket"`
+	AssetID string     `json:"asset_id"`
+	State   AssetState `json:"state"`
+	At      time.Time  `json:"at"`
+	Detail  string     `json:"detail,omitempty"`
+}
+
+// Notifier is notified of the asset lifecycle events.
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// WithNotifier sets who is notified when an asset is promoted, fails its promotion, is deleted, archived or restored from the archive.
+func WithNotifier(notifier Notifier) Option {
+	return func(manager *assetManager) {
+		manager.notifier = notifier
+	}
+}
+
+// notify notifies the event of the asset. It is best effort, so it never fails the lifecycle operation.
+func (ps *assetManager) notify(ctx context.Context, record *AssetRecord, eventType EventType, detail string) {
+	if ps.notifier == nil {
+		return
+	}
+	err := ps.notifier.Notify(ctx, Notification{
+		Event:   eventType,
+		Bucket:  record.Bucket,
+		AssetID: record.ID.String(),
+		State:   record.State,
+		At:      record.UpdatedAt,
+		Detail:  detail,
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Webhook is an url called back with the asset lifecycle events.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret is the key of the callbacks signature.
+	Secret string `json:"secret"`
+	// Events are the notified events, all of them if empty.
+	Events    []EventType `json:"events,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+// DeliveryStatus is the status of a webhook delivery.
+type DeliveryStatus string
+
+const (
+	// DeliveryPending is the status of a delivery not attempted yet, or waiting to be retried.
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliveryDelivered is the status of a delivery answered with a 2xx.
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryFailed is the status of a delivery which run out of attempts.
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// Delivery is a notification sent to a webhook.
+type Delivery struct {
+	ID           string
+	WebhookID    string
+	Notification Notification
+	Status       DeliveryStatus
+	Attempts     int
+	// LastError is why the last attempt did not succeed.
+	LastError string
+	// NextAttempt is when the delivery is retried, zero unless it is pending.
+	NextAttempt time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// WebhookOption sets an optional configuration of the WebhookNotifier.
+type WebhookOption func(notifier *WebhookNotifier)
+
+// WithDeliveryAttempts sets how many times a delivery is attempted before failing.
+func WithDeliveryAttempts(attempts int) WebhookOption {
+	return func(notifier *WebhookNotifier) {
+		notifier.attempts = attempts
+	}
+}
+
+// WithDeliveryBackoff sets how long after the first failed attempt a delivery is retried, doubled on every retry.
+func WithDeliveryBackoff(backoff time.Duration) WebhookOption {
+	return func(notifier *WebhookNotifier) {
+		notifier.backoff = backoff
+	}
+}
+
+// WithDeliveryWorkers sets how many deliveries are attempted at the same time.
+func WithDeliveryWorkers(workers int) WebhookOption {
+	return func(notifier *WebhookNotifier) {
+		notifier.workers = workers
+	}
+}
+
+// WithHTTPClient sets the client calling the webhooks.
+func WithHTTPClient(client *http.Client) WebhookOption {
+	return func(notifier *WebhookNotifier) {
+		notifier.client = client
+	}
+}
+
+// WithAllowedHosts sets the webhook hosts which can be called back even if they resolve to a non public address,
+// like a loopback, private or link-local one.
+func WithAllowedHosts(hosts ...string) WebhookOption {
+	return func(notifier *WebhookNotifier) {
+		for _, host := range hosts {
+			notifier.allowedHosts[strings.ToLower(host)] = true
+		}
+	}
+}
+
+// WebhookNotifier notifies the registered webhooks with signed json callbacks.
+// Deliveries are attempted by a pool of workers, so slow webhooks do not hold the scheduler,
+// which only triggers the attempts, retried with an exponential backoff.
+type WebhookNotifier struct {
+	mutex     sync.Mutex
+	scheduler schedule.SimpleScheduler
+	client    *http.Client
+	attempts  int
+	backoff   time.Duration
+	workers   int
+	// allowedHosts can be called back even if they resolve to a non public address.
+	allowedHosts map[string]bool
+	// queue are the due attempts, waiting for a worker.
+	queue    chan deliveryAttempt
+	webhooks map[string]*Webhook
+	// deliveries are the deliveries of every webhook, oldest first.
+	deliveries map[string][]*Delivery
+	persist    func(webhooks map[string]*Webhook) error
+}
+
+// NewWebhookNotifier creates a WebhookNotifier which keeps the webhooks in memory.
+// Unless WithHTTPClient is given, the callbacks only connect to public addresses, or to the allowed hosts.
+func NewWebhookNotifier(scheduler schedule.SimpleScheduler, options ...WebhookOption) *WebhookNotifier {
+	notifier := &WebhookNotifier{
+		scheduler:    scheduler,
+		attempts:     5,
+		backoff:      30 * time.Second,
+		workers:      4,
+		allowedHosts: make(map[string]bool),
+		queue:        make(chan deliveryAttempt, maxQueuedAttempts),
+		webhooks:     make(map[string]*Webhook),
+		deliveries:   make(map[string][]*Delivery),
+	}
+	for _, option := range options {
+		option(notifier)
+	}
+	if notifier.client == nil {
+		// The address is checked again when connecting, since the host may resolve to another one since registered
+		notifier.client = &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext:         notifier.dial,
+				TLSHandshakeTimeout: 10 * time.Second,
+				MaxIdleConns:        100,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+	for i := 0; i < notifier.workers; i++ {
+		go notifier.work()
+	}
+	return notifier
+}
+
+// NewFileWebhookNotifier creates a WebhookNotifier which keeps the webhooks in a file at path, created if missing.
+// Deliveries are only kept in memory, like the scheduled jobs, so the pending ones are lost on restart.
+func NewFileWebhookNotifier(path string, scheduler schedule.SimpleScheduler, options ...WebhookOption) (*WebhookNotifier, error) {
+	notifier := NewWebhookNotifier(scheduler, options...)
+	notifier.persist = func(webhooks map[string]*Webhook) error {
+		return writeJSON(path, webhooks)
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return notifier, nil
+	}
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	err = json.Unmarshal(content, &notifier.webhooks)
+	if err != nil {
+		return nil, auerr.CError(auerr.ErrorInternalError, err)
+	}
+	return notifier, nil
+}
+
+// Register adds a webhook called back with the given events, all of them if empty.
+// A random secret is generated if none is given.
+// The url host should resolve to public addresses only, unless it is an allowed host.
+func (n *WebhookNotifier) Register(ctx context.Context, webhookURL string, secret string, events []EventType) (*Webhook, error) {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, auerr.FError(auerr.ErrorBadInput, "Webhook url %s should be an absolute http or https url", webhookURL)
+	}
+	if !n.allowedHosts[strings.ToLower(parsed.Hostname())] {
+		_, err = n.publicAddresses(ctx, parsed.Hostname())
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, event := range events {
+		if !containsEvent(NotifiedEvents, event) {
+			return nil, auerr.FError(auerr.ErrorBadInput, "Event should be one of %v, not %s", NotifiedEvents, event)
+		}
+	}
+	if secret == "" {
+		key := make([]byte, 32)
+		_, err = io.ReadFull(rand.Reader, key)
+		if err != nil {
+			return nil, auerr.CError(auerr.ErrorInternalError, err)
+		}
+		secret = hex.EncodeToString(key)
+	}
+	webhook := &Webhook{ID: uuid.New().String(), URL: webhookURL, Secret: secret, Events: events, CreatedAt: time.Now().UTC()}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.webhooks[webhook.ID] = webhook
+	if n.persist != nil {
+		err = n.persist(n.webhooks)
+		if err != nil {
+			delete(n.webhooks, webhook.ID)
+			return nil, err
+		}
+	}
+	registered := *webhook
+	return &registered, nil
+}
+
+// Unregister removes the webhook and its deliveries, the pending ones are not attempted anymore.
+func (n *WebhookNotifier) Unregister(ctx context.Context, webhookID string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	webhook, ok := n.webhooks[webhookID]
+	if !ok {
+		return auerr.FError(auerr.ErrorNotFound, "Webhook %s is not found", webhookID)
+	}
+	delete(n.webhooks, webhookID)
+	if n.persist != nil {
+		err := n.persist(n.webhooks)
+		if err != nil {
+			n.webhooks[webhookID] = webhook
+			return err
+		}
+	}
+	delete(n.deliveries, webhookID)
+	return nil
+}
+
+// Webhooks returns the registered webhooks, oldest first.
+func (n *WebhookNotifier) Webhooks(ctx context.Context) []Webhook {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	webhooks := make([]Webhook, 0, len(n.webhooks))
+	for _, webhook := range n.webhooks {
+		webhooks = append(webhooks, *webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+	})
+	return webhooks
+}
+
+// Deliveries returns the deliveries of the webhook with the given status, or any if empty, oldest first.
+func (n *WebhookNotifier) Deliveries(ctx context.Context, webhookID string, status DeliveryStatus) ([]Delivery, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.webhooks[webhookID]; !ok {
+		return nil, auerr.FError(auerr.ErrorNotFound, "Webhook %s is not found", webhookID)
+	}
+	deliveries := make([]Delivery, 0)
+	for _, delivery := range n.deliveries[webhookID] {
+		if status == "" || delivery.Status == status {
+			deliveries = append(deliveries, *delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+// Notify schedules a delivery of the notification to every webhook registered for its event.
+func (n *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	now := time.Now().UTC()
+	scheduled := make([]*Delivery, 0)
+	n.mutex.Lock()
+	for _, webhook := range n.webhooks {
+		if len(webhook.Events) > 0 && !containsEvent(webhook.Events, notification.Event) {
+			continue
+		}
+		delivery := &Delivery{
+			ID:           uuid.New().String(),
+			WebhookID:    webhook.ID,
+			Notification: notification,
+			Status:       DeliveryPending,
+			NextAttempt:  now,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		}
+		n.addDelivery(delivery)
+		scheduled = append(scheduled, delivery)
+	}
+	n.mutex.Unlock()
+	// Scheduled out of the lock, since an immediate scheduler runs the delivery right away
+	for _, delivery := range scheduled {
+		err = n.scheduleDelivery(ctx, delivery.ID, delivery.WebhookID, body, 1, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addDelivery keeps the delivery, dropping the oldest finished ones over the limit.
+func (n *WebhookNotifier) addDelivery(delivery *Delivery) {
+	deliveries := append(n.deliveries[delivery.WebhookID], delivery)
+	for i := 0; len(deliveries) > maxDeliveries && i < len(deliveries); {
+		if deliveries[i].Status == DeliveryPending {
+			i++
+			continue
+		}
+		deliveries = append(deliveries[:i], deliveries[i+1:]...)
+	}
+	n.deliveries[delivery.WebhookID] = deliveries
+}
+
+// deliveryAttempt is an attempt of a delivery, waiting for a worker.
+type deliveryAttempt struct {
+	deliveryID string
+	webhookID  string
+	body       []byte
+	attempt    int
+}
+
+// scheduleDelivery schedules the attempt at date, when its job hands it to the workers.
+func (n *WebhookNotifier) scheduleDelivery(ctx context.Context, deliveryID string, webhookID string, body []byte, attempt int, date time.Time) error {
+	deliveryJob := job.NewFixedDateJob("webhook-"+deliveryID+"-"+strconv.Itoa(attempt)+"-"+date.Format(time.RFC3339Nano), func(ctx context.Context) error {
+		select {
+		case n.queue <- deliveryAttempt{deliveryID: deliveryID, webhookID: webhookID, body: body, attempt: attempt}:
+			return nil
+		default:
+			// The workers are behind, so the attempt is postponed without counting it
+			return n.scheduleDelivery(ctx, deliveryID, webhookID, body, attempt, time.Now().UTC().Add(n.backoff))
+		}
+	}, date)
+	return n.scheduler.Schedule(ctx, *deliveryJob)
+}
+
+// work attempts the queued deliveries, out of the scheduler jobs, whose context ends with them.
+func (n *WebhookNotifier) work() {
+	for queued := range n.queue {
+		err := n.deliver(context.Background(), queued.deliveryID, queued.webhookID, queued.body, queued.attempt)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// deliver attempts the delivery, and schedules the next attempt if it fails and there are attempts left.
+func (n *WebhookNotifier) deliver(ctx context.Context, deliveryID string, webhookID string, body []byte, attempt int) error {
+	n.mutex.Lock()
+	webhook, ok := n.webhooks[webhookID]
+	n.mutex.Unlock()
+	if !ok {
+		// Unregistered since scheduled
+		return nil
+	}
+	err := n.post(ctx, webhook, deliveryID, body)
+	now := time.Now().UTC()
+	nextAttempt := time.Time{}
+	n.mutex.Lock()
+	for _, delivery := range n.deliveries[webhookID] {
+		if delivery.ID != deliveryID {
+			continue
+		}
+		delivery.Attempts = attempt
+		delivery.UpdatedAt = now
+		switch {
+		case err == nil:
+			delivery.Status = DeliveryDelivered
+			delivery.LastError = ""
+			delivery.NextAttempt = time.Time{}
+		case attempt >= n.attempts:
+			delivery.Status = DeliveryFailed
+			delivery.LastError = err.Error()
+			delivery.NextAttempt = time.Time{}
+		default:
+			delivery.LastError = err.Error()
+			delivery.NextAttempt = now.Add(n.backoff * time.Duration(1<<uint(attempt-1)))
+			nextAttempt = delivery.NextAttempt
+		}
+	}
+	n.mutex.Unlock()
+	if !nextAttempt.IsZero() {
+		scheduleErr := n.scheduleDelivery(ctx, deliveryID, webhookID, body, attempt+1, nextAttempt)
+		if scheduleErr != nil {
+			return scheduleErr
+		}
+	}
+	return err
+}
+
+// post calls the webhook with the signed body, any response but a 2xx is an error.
+func (n *WebhookNotifier) post(ctx context.Context, webhook *Webhook, deliveryID string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(body)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	request.Header.Set(DeliveryHeader, deliveryID)
+	response, err := n.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return auerr.CError(auerr.ErrorInternalError, err)
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return auerr.FError(auerr.ErrorInternalError, "Webhook %s answered %d", webhook.ID, response.StatusCode)
+	}
+	return nil
+}
+
+// dial connects to the address only if its host is allowed or resolves to public addresses only.
+func (n *WebhookNotifier) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	if n.allowedHosts[strings.ToLower(host)] {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addresses, err := n.publicAddresses(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// Connected to the checked address, not to a new resolution of the host
+	return dialer.DialContext(ctx, network, net.JoinHostPort(addresses[0].String(), port))
+}
+
+// publicAddresses resolves the host, which should not resolve to any loopback, private, link-local or otherwise non public address.
+func (n *WebhookNotifier) publicAddresses(ctx context.Context, host string) ([]net.IP, error) {
+	resolved, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, auerr.FError(auerr.ErrorBadInput, "Webhook host %s can not be resolved: %s", host, err.Error())
+	}
+	addresses := make([]net.IP, 0, len(resolved))
+	for _, address := range resolved {
+		if !address.IP.IsGlobalUnicast() || address.IP.IsPrivate() {
+			return nil, auerr.FError(auerr.ErrorBadInput, "Webhook host %s resolves to the non public address %s", host, address.IP)
+		}
+		addresses = append(addresses, address.IP)
+	}
+	if len(addresses) == 0 {
+		return nil, auerr.FError(auerr.ErrorBadInput, "Webhook host %s resolves to no address", host)
+	}
+	return addresses, nil
+}
+
+func containsEvent(events []EventType, event EventType) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
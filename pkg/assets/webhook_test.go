@@ -0,0 +1,285 @@
+package assets_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+	"github.com/tgracchus/assetuploader/pkg/schedule"
+	"github.com/tgracchus/assetuploader/pkg/util"
+)
+
+// webhookServer records the notifications it receives, answering with status.
+type webhookServer struct {
+	mutex         sync.Mutex
+	secret        string
+	status        int
+	notifications []assets.Notification
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write(body)
+	if r.Header.Get(assets.SignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) || r.Header.Get(assets.DeliveryHeader) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	notification := assets.Notification{}
+	err = json.Unmarshal(body, &notification)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.notifications = append(s.notifications, notification)
+	w.WriteHeader(s.status)
+}
+
+func (s *webhookServer) received() []assets.Notification {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]assets.Notification(nil), s.notifications...)
+}
+
+func TestWebhookNotificationsWithFakeStorage(t *testing.T) {
+	server := &webhookServer{secret: "secret", status: http.StatusOK}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	// A single worker, so the notifications are received in order
+	notifier := assets.NewWebhookNotifier(schedule.NewImmediateScheduler(), assets.WithDeliveryWorkers(1), assets.WithAllowedHosts("127.0.0.1"))
+	ctx := context.Background()
+	webhook, err := notifier.Register(ctx, httpServer.URL, "secret", []assets.EventType{assets.EventPromotionSucceeded, assets.EventDeleted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := newFakeStorage()
+	manager := assets.NewAssetManager(storage, schedule.NewImmediateScheduler(), expirationDuration, assets.WithNotifier(notifier))
+	bucket := "testBucket"
+	assetId, failedId := uuid.New(), uuid.New()
+	_, err = manager.PutURL(ctx, bucket, assetId, assets.PutConstraints{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.PutURL(ctx, bucket, failedId, assets.PutConstraints{ContentLength: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uuid.UUID{assetId, failedId} {
+		storage.upload(bucket, "temp/"+id.String(), "CONTENT", "")
+		err = manager.Uploaded(ctx, bucket, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = manager.Delete(ctx, bucket, assetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed promotion is not one of the webhook events
+	deliveries := waitForDeliveries(ctx, t, notifier, webhook.ID, assets.DeliveryDelivered, 2)
+	received := server.received()
+	if len(received) != 2 {
+		t.Fatalf("Webhook should receive 2 notifications, not %+v", received)
+	}
+	if received[0].Event != assets.EventPromotionSucceeded || received[0].AssetID != assetId.String() ||
+		received[0].State != assets.StateUploaded || received[0].Bucket != bucket {
+		t.Fatalf("Promotion notification is not the expected one, %+v", received[0])
+	}
+	if received[1].Event != assets.EventDeleted || received[1].State != assets.StateDeleted {
+		t.Fatalf("Deletion notification is not the expected one, %+v", received[1])
+	}
+	if deliveries[0].Attempts != 1 {
+		t.Fatalf("Deliveries should be delivered at the first attempt, not %+v", deliveries)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	server := &webhookServer{secret: "secret", status: http.StatusInternalServerError}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	// The immediate scheduler triggers the retries right away
+	notifier := assets.NewWebhookNotifier(schedule.NewImmediateScheduler(), assets.WithDeliveryAttempts(3), assets.WithAllowedHosts("127.0.0.1"))
+	ctx := context.Background()
+	webhook, err := notifier.Register(ctx, httpServer.URL, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The delivery is attempted by the workers, so its errors are not the ones of the notification
+	err = notifier.Notify(ctx, assets.Notification{Event: assets.EventPromotionFailed, AssetID: uuid.New().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries := waitForDeliveries(ctx, t, notifier, webhook.ID, assets.DeliveryFailed, 1)
+	if received := server.received(); len(received) != 3 {
+		t.Fatalf("Webhook should be attempted 3 times, not %d", len(received))
+	}
+	if deliveries[0].Attempts != 3 || deliveries[0].LastError == "" || !deliveries[0].NextAttempt.IsZero() {
+		t.Fatalf("Delivery should be failed after 3 attempts, not %+v", deliveries)
+	}
+	deliveries, err = notifier.Deliveries(ctx, webhook.ID, assets.DeliveryPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 0 {
+		t.Fatalf("There should be no pending deliveries, not %+v", deliveries)
+	}
+
+	// A wrong secret is rejected by the webhook
+	wrongSecret, err := notifier.Register(ctx, httpServer.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrongSecret.Secret == "" {
+		t.Fatal("A secret should be generated")
+	}
+	server.mutex.Lock()
+	server.status = http.StatusOK
+	server.mutex.Unlock()
+	notifier.Notify(ctx, assets.Notification{Event: assets.EventDeleted})
+	waitForDeliveries(ctx, t, notifier, wrongSecret.ID, assets.DeliveryFailed, 1)
+}
+
+// waitForDeliveries waits until the webhook has count deliveries with the status, and returns them.
+func waitForDeliveries(ctx context.Context, t *testing.T, notifier *assets.WebhookNotifier, webhookID string, status assets.DeliveryStatus, count int) []assets.Delivery {
+	var deliveries []assets.Delivery
+	err := util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		var err error
+		deliveries, err = notifier.Deliveries(ctx, webhookID, status)
+		if err != nil {
+			return err
+		}
+		if len(deliveries) != count {
+			return errors.New("Deliveries are not done yet")
+		}
+		return nil
+	}, 10*time.Millisecond, waitTimeout)
+	if err != nil {
+		t.Fatalf("Webhook should have %d %s deliveries, not %+v: %v", count, status, deliveries, err)
+	}
+	return deliveries
+}
+
+func TestWebhookRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webhooks.json")
+	notifier, err := assets.NewFileWebhookNotifier(path, schedule.NewImmediateScheduler(), assets.WithAllowedHosts("localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, webhookURL := range []string{"", "/relative", "ftp://host/path"} {
+		_, err = notifier.Register(ctx, webhookURL, "", nil)
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("We expected a bad input error for %s, got %v", webhookURL, err)
+		}
+	}
+	_, err = notifier.Register(ctx, "http://localhost/hook", "", []assets.EventType{assets.EventURLsIssued})
+	if !auerr.Is(err, auerr.ErrorBadInput) {
+		t.Fatalf("We expected a bad input error, got %v", err)
+	}
+	webhook, err := notifier.Register(ctx, "http://localhost/hook", "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := notifier.Register(ctx, "http://localhost/other", "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = notifier.Unregister(ctx, other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = notifier.Unregister(ctx, other.ID)
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+	_, err = notifier.Deliveries(ctx, other.ID, "")
+	if !auerr.Is(err, auerr.ErrorNotFound) {
+		t.Fatalf("We expected a not found error, got %v", err)
+	}
+
+	// The webhooks survive a reload
+	reloaded, err := assets.NewFileWebhookNotifier(path, schedule.NewImmediateScheduler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks := reloaded.Webhooks(ctx)
+	if len(webhooks) != 1 || webhooks[0].ID != webhook.ID || webhooks[0].Secret != "secret" {
+		t.Fatalf("Reloaded webhooks should be %+v, not %+v", webhook, webhooks)
+	}
+}
+
+func TestWebhookNonPublicAddresses(t *testing.T) {
+	server := &webhookServer{secret: "secret", status: http.StatusOK}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webhooks.json")
+	notifier, err := assets.NewFileWebhookNotifier(path, schedule.NewImmediateScheduler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, webhookURL := range []string{httpServer.URL, "http://localhost/hook", "http://10.0.0.1/hook", "http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data", "http://0.0.0.0/hook", "http://[::1]/hook", "http://[fd00::1]/hook"} {
+		_, err = notifier.Register(ctx, webhookURL, "secret", nil)
+		if !auerr.Is(err, auerr.ErrorBadInput) {
+			t.Fatalf("We expected a bad input error for %s, got %v", webhookURL, err)
+		}
+	}
+
+	// An allowed host is registered, but it is not called back once it is not allowed anymore
+	allowed, err := assets.NewFileWebhookNotifier(path, schedule.NewImmediateScheduler(), assets.WithAllowedHosts("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook, err := allowed.Register(ctx, httpServer.URL, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := assets.NewFileWebhookNotifier(path, schedule.NewImmediateScheduler(), assets.WithDeliveryAttempts(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloaded.Notify(ctx, assets.Notification{Event: assets.EventDeleted, AssetID: uuid.New().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries := waitForDeliveries(ctx, t, reloaded, webhook.ID, assets.DeliveryFailed, 1)
+	if !strings.Contains(deliveries[0].LastError, "non public address") {
+		t.Fatalf("Delivery should fail for the non public address, not %+v", deliveries[0])
+	}
+	if received := server.received(); len(received) != 0 {
+		t.Fatalf("Webhook should not be called back, not %+v", received)
+	}
+}
@@ -18,6 +18,12 @@ const ErrorConflict = "ErrorConflict"
 // ErrorBadInput bad user input, validation error
 const ErrorBadInput = "ErrorBadInput"
 
+// ErrorForbidden operation not allowed, like an invalid or expired signature
+const ErrorForbidden = "ErrorForbidden"
+
+// ErrorUnauthorized caller not identified, like a missing or unknown api key
+const ErrorUnauthorized = "ErrorUnauthorized"
+
 // SError creates a new error with a stacktrace and a msg.
 func SError(code string, msg string) error {
 	return errors.Wrap(errors.New(code), msg)
@@ -32,3 +38,11 @@ func FError(code string, msg string, vars ...interface{}) error {
 func CError(code string, err error) error {
 	return errors.Wrap(errors.New(code), err.Error())
 }
+
+// Is reports whether err was created with the given code.
+func Is(err error, code string) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == code
+}
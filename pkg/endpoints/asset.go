@@ -1,8 +1,11 @@
 package endpoints
 
 import (
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/tgracchus/assetuploader/pkg/auerr"
 
@@ -13,28 +16,126 @@ import (
 
 const assetIDParam = "assetID"
 const timeoutQueryParam = "timeout"
+const waitQueryParam = "wait"
+const statusQueryParam = "status"
+const createdAfterQueryParam = "created_after"
+const createdBeforeQueryParam = "created_before"
+const labelQueryParam = "label"
+const cursorQueryParam = "cursor"
+const limitQueryParam = "limit"
 
-//RegisterAssetsEndpoints register to echo engine the assets endpoints.
-func RegisterAssetsEndpoints(e *echo.Echo, assetManager assets.AssetManager, bucket string) {
-	e.POST("/asset", newPostAssetEndpoint(assetManager, bucket))
-	e.PUT("/asset/:"+assetIDParam, newPutAssetEndpoint(assetManager, bucket))
-	e.GET("/asset/:"+assetIDParam, newGetAssetEndpoint(assetManager, bucket))
+// RegisterAssetsEndpoints register to echo engine the assets endpoints, served with the assets of the tenant of every request.
+func RegisterAssetsEndpoints(e *echo.Echo, tenants *TenantRouter) {
+	e.POST("/asset", tenants.assetEndpoint(newPostAssetEndpoint))
+	e.PUT("/asset/:"+assetIDParam, tenants.assetEndpoint(newPutAssetEndpoint))
+	e.PUT("/asset/:"+assetIDParam+"/content", tenants.assetEndpoint(newPutAssetContentEndpoint))
+	e.GET("/asset/:"+assetIDParam, tenants.assetEndpoint(newGetAssetEndpoint))
+	e.GET("/asset/:"+assetIDParam+"/content", tenants.assetEndpoint(newGetAssetContentEndpoint))
+	e.GET("/asset/:"+assetIDParam+"/status", tenants.assetEndpoint(newGetAssetStatusEndpoint))
+	e.GET("/asset/:"+assetIDParam+"/history", tenants.assetEndpoint(newGetAssetHistoryEndpoint))
+	e.PATCH("/asset/:"+assetIDParam+"/metadata", tenants.assetEndpoint(newPatchAssetMetadataEndpoint))
+	e.POST("/asset/:"+assetIDParam+"/revoke", tenants.assetEndpoint(newRevokeAssetEndpoint))
+	e.DELETE("/asset/:"+assetIDParam, tenants.assetEndpoint(newDeleteAssetEndpoint))
+	e.POST("/asset/:"+assetIDParam+"/restore", tenants.assetEndpoint(newRestoreAssetEndpoint))
+	e.GET("/assets", tenants.assetEndpoint(newListAssetsEndpoint))
 }
 
 func newPostAssetEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
 	return func(c echo.Context) error {
-		assetID := uuid.New()
-		url, err := assetManager.PutURL(c.Request().Context(), bucket, assetID)
+		// The body is optional, an empty one creates a single part asset
+		newAsset := new(postAssetBody)
+		if c.Request().ContentLength != 0 {
+			err := c.Bind(newAsset)
+			if err != nil {
+				return auerr.CError(auerr.ErrorBadInput, err)
+			}
+		}
+		// Checked before the asset is created, so an invalid one does not leave it behind
+		metadata := assets.Metadata{
+			Filename:    newAsset.Filename,
+			ContentType: newAsset.ContentType,
+			Owner:       newAsset.Owner,
+			Labels:      newAsset.Labels,
+		}
+		err := assets.CheckMetadata(metadata)
 		if err != nil {
 			return err
 		}
-		return c.JSON(http.StatusCreated, &postAssetResponse{UploadURL: url.String(), AssetID: assetID.String()})
+		assetID := uuid.New()
+		constraints := assets.PutConstraints{
+			ContentType:   newAsset.ContentType,
+			ContentLength: newAsset.ContentLength,
+			Checksum:      assets.Checksum{MD5: newAsset.ContentMD5, SHA256: newAsset.ContentSHA256},
+			Encryption: assets.Encryption{
+				Mode:          assets.EncryptionMode(newAsset.Encryption.Mode),
+				KMSKeyID:      newAsset.Encryption.KMSKeyID,
+				CustomerKeyID: newAsset.Encryption.CustomerKeyID,
+			},
+			StorageClass: assets.StorageClass(newAsset.StorageClass),
+		}
+		// Without expires_in, the upload urls get the default expiration
+		expiration := time.Duration(newAsset.ExpiresIn) * time.Second
+		response := &postAssetResponse{AssetID: assetID.String()}
+		var upload *assets.Upload
+		if newAsset.Parts > 0 {
+			upload, err = assetManager.MultipartPutURLs(c.Request().Context(), bucket, assetID, newAsset.Parts, constraints, expiration)
+			if err != nil {
+				return err
+			}
+			for _, url := range upload.URLs {
+				response.UploadURLs = append(response.UploadURLs, url.String())
+			}
+		} else {
+			upload, err = assetManager.PutURL(c.Request().Context(), bucket, assetID, constraints, expiration)
+			if err != nil {
+				return err
+			}
+			// SSE-C assets have no url, their content is put through PUT /asset/<asset-id>/content
+			if len(upload.URLs) > 0 {
+				response.UploadURL = upload.URLs[0].String()
+			}
+		}
+		response.ExpiresAt = upload.ExpiresAt.Format(time.RFC3339)
+		response.Headers = upload.Headers
+		if metadata.Filename != "" || metadata.ContentType != "" || metadata.Owner != "" || len(metadata.Labels) > 0 {
+			err := assetManager.PutMetadata(c.Request().Context(), bucket, assetID, metadata)
+			if err != nil {
+				return err
+			}
+		}
+		return c.JSON(http.StatusCreated, response)
 	}
 }
 
+type postAssetBody struct {
+	Parts         int64             `json:"parts"`
+	ExpiresIn     int64             `json:"expires_in"`
+	ContentType   string            `json:"content_type"`
+	ContentLength int64             `json:"content_length"`
+	ContentMD5    string            `json:"content_md5"`
+	ContentSHA256 string            `json:"content_sha256"`
+	Filename      string            `json:"filename"`
+	Owner         string            `json:"owner"`
+	Labels        map[string]string `json:"labels"`
+	// Without encryption, the asset gets the default one
+	Encryption assetEncryption `json:"encryption"`
+	// Without storage class, the asset is promoted to the one chosen by the storage class policy
+	StorageClass string `json:"storage_class"`
+}
+
+type assetEncryption struct {
+	Mode          string `json:"mode"`
+	KMSKeyID      string `json:"kms_key_id"`
+	CustomerKeyID string `json:"customer_key_id"`
+}
+
 type postAssetResponse struct {
-	UploadURL string `json:"upload_url"`
-	AssetID   string `json:"id"`
+	UploadURL  string   `json:"upload_url,omitempty"`
+	UploadURLs []string `json:"upload_urls,omitempty"`
+	ExpiresAt  string   `json:"expires_at"`
+	AssetID    string   `json:"id"`
+	// Headers are the ones the upload requests have to send along the urls
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 func newPutAssetEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
@@ -61,6 +162,22 @@ func newPutAssetEndpoint(assetManager assets.AssetManager, bucket string) func(c
 	}
 }
 
+// newPutAssetContentEndpoint streams the body as the content of the asset, for the clients which can not reach s3.
+func newPutAssetContentEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		request := c.Request()
+		err = assetManager.PutContent(request.Context(), bucket, assetID, request.Header.Get(echo.HeaderContentType), request.ContentLength, request.Body)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusAccepted, &putAssetResponse{Status: "Accepted"})
+	}
+}
+
 type putAssetBody struct {
 	Status string `json:"Status"`
 }
@@ -75,22 +192,338 @@ func newGetAssetEndpoint(assetManager assets.AssetManager, bucket string) func(c
 		if err != nil {
 			return auerr.CError(auerr.ErrorBadInput, err)
 		}
-		timeoutParam := c.QueryParam(timeoutQueryParam)
-		if timeoutParam == "" {
-			timeoutParam = "60"
+		// Without timeout, the download url gets the default expiration
+		var expiration time.Duration
+		if timeoutParam := c.QueryParam(timeoutQueryParam); timeoutParam != "" {
+			timeout, err := strconv.ParseInt(timeoutParam, 10, 64)
+			if err != nil || timeout <= 0 {
+				return auerr.FError(auerr.ErrorBadInput, "Timeout should be a positive number of seconds, not %s", timeoutParam)
+			}
+			expiration = time.Duration(timeout) * time.Second
+		}
+		// Hold the request until the asset is processed, so clients do not need to poll
+		if waitParam := c.QueryParam(waitQueryParam); waitParam != "" {
+			wait, err := time.ParseDuration(waitParam)
+			if err != nil {
+				return auerr.CError(auerr.ErrorBadInput, err)
+			}
+			err = assetManager.WaitProcessed(c.Request().Context(), bucket, assetID, wait)
+			if err != nil {
+				return err
+			}
 		}
-		timeout, err := strconv.ParseInt(timeoutParam, 10, 64)
+		download, err := assetManager.GetURL(c.Request().Context(), bucket, assetID, expiration)
 		if err != nil {
 			return err
 		}
-		url, err := assetManager.GetURL(c.Request().Context(), bucket, assetID, timeout)
+		return c.JSON(http.StatusOK, &getAssetResponse{
+			DownloadURL:   download.URL.String(),
+			ExpiresAt:     download.ExpiresAt.Format(time.RFC3339),
+			ContentMD5:    download.Checksum.MD5,
+			ContentSHA256: download.Checksum.SHA256,
+			Metadata:      newAssetMetadata(&download.Metadata),
+		})
+	}
+}
+
+type getAssetResponse struct {
+	DownloadURL   string         `json:"Download_url"`
+	ExpiresAt     string         `json:"expires_at"`
+	ContentMD5    string         `json:"content_md5,omitempty"`
+	ContentSHA256 string         `json:"content_sha256,omitempty"`
+	Metadata      *assetMetadata `json:"metadata"`
+}
+
+// newGetAssetContentEndpoint streams the content of the asset, for the clients which can not follow the download url to s3.
+// Range and conditional requests are served by http.ServeContent, with the etag and last modified date of the object.
+func newGetAssetContentEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		content, err := assetManager.GetContent(c.Request().Context(), bucket, assetID)
 		if err != nil {
 			return err
 		}
-		return c.JSON(http.StatusOK, &getAssetResponse{DownloadURL: url.String()})
+		defer content.Body.Close()
+		header := c.Response().Header()
+		// Without a known content type, it is not sniffed from the content, so it is not served as something else
+		contentType := content.ContentType
+		if contentType == "" {
+			contentType = content.Metadata.ContentType
+		}
+		if contentType == "" {
+			contentType = echo.MIMEOctetStream
+		}
+		header.Set(echo.HeaderContentType, contentType)
+		header.Set("X-Content-Type-Options", "nosniff")
+		if content.ETag != "" {
+			header.Set("ETag", content.ETag)
+		}
+		// Filenames which can not be encoded are left out
+		if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": content.Metadata.Filename}); content.Metadata.Filename != "" && disposition != "" {
+			header.Set(echo.HeaderContentDisposition, disposition)
+		}
+		http.ServeContent(c.Response(), c.Request(), "", content.LastModified, content.Body)
+		return nil
 	}
 }
 
-type getAssetResponse struct {
-	DownloadURL string `json:"Download_url"`
+func newGetAssetStatusEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		assetStatus, err := assetManager.Status(c.Request().Context(), bucket, assetID)
+		if err != nil {
+			return err
+		}
+		response := &getAssetStatusResponse{
+			AssetID:      assetID.String(),
+			Status:       string(assetStatus.State),
+			Size:         assetStatus.Size,
+			ContentType:  assetStatus.ContentType,
+			CreatedAt:    assetStatus.CreatedAt.Format(time.RFC3339),
+			UpdatedAt:    assetStatus.UpdatedAt.Format(time.RFC3339),
+			StorageClass: string(assetStatus.StorageClass),
+			Error:        assetStatus.Error,
+		}
+		if !assetStatus.PromoteAt.IsZero() {
+			response.PromoteAt = assetStatus.PromoteAt.Format(time.RFC3339)
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+type getAssetStatusResponse struct {
+	AssetID     string `json:"id"`
+	Status      string `json:"status"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+	PromoteAt   string `json:"promote_at,omitempty"`
+	// StorageClass is empty for the default one of the bucket
+	StorageClass string `json:"storage_class,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+func newGetAssetHistoryEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		events, err := assetManager.History(c.Request().Context(), bucket, assetID)
+		if err != nil {
+			return err
+		}
+		response := &getAssetHistoryResponse{AssetID: assetID.String(), Events: make([]*assetEvent, 0, len(events))}
+		for _, event := range events {
+			response.Events = append(response.Events, &assetEvent{
+				Type:   string(event.Type),
+				At:     event.At.Format(time.RFC3339Nano),
+				Detail: event.Detail,
+			})
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+type getAssetHistoryResponse struct {
+	AssetID string        `json:"id"`
+	Events  []*assetEvent `json:"events"`
+}
+
+type assetEvent struct {
+	Type   string `json:"type"`
+	At     string `json:"at"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func newPatchAssetMetadataEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		update := new(patchAssetMetadataBody)
+		err = c.Bind(update)
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		metadata, err := assetManager.UpdateMetadata(c.Request().Context(), bucket, assetID, assets.MetadataUpdate{
+			Filename:    update.Filename,
+			ContentType: update.ContentType,
+			Owner:       update.Owner,
+			Labels:      update.Labels,
+		})
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, newAssetMetadata(metadata))
+	}
+}
+
+// patchAssetMetadataBody follows json merge patch, missing fields are not changed and null labels are removed.
+type patchAssetMetadataBody struct {
+	Filename    *string            `json:"filename"`
+	ContentType *string            `json:"content_type"`
+	Owner       *string            `json:"owner"`
+	Labels      map[string]*string `json:"labels"`
+}
+
+type assetMetadata struct {
+	Filename    string            `json:"filename,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+func newAssetMetadata(metadata *assets.Metadata) *assetMetadata {
+	return &assetMetadata{
+		Filename:    metadata.Filename,
+		ContentType: metadata.ContentType,
+		Owner:       metadata.Owner,
+		Labels:      metadata.Labels,
+	}
+}
+
+func newDeleteAssetEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		err = assetManager.Delete(c.Request().Context(), bucket, assetID)
+		if err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func newRevokeAssetEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		err = assetManager.Revoke(c.Request().Context(), bucket, assetID)
+		if err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func newRestoreAssetEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		state, err := assetManager.Restore(c.Request().Context(), bucket, assetID)
+		if err != nil {
+			return err
+		}
+		// The restore of an archived asset goes on in the background
+		if state == assets.StateRestoring {
+			return c.NoContent(http.StatusAccepted)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func newListAssetsEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		filter := assets.ListFilter{}
+		for _, states := range c.QueryParams()[statusQueryParam] {
+			for _, state := range strings.Split(states, ",") {
+				filter.States = append(filter.States, assets.AssetState(state))
+			}
+		}
+		var err error
+		if createdAfter := c.QueryParam(createdAfterQueryParam); createdAfter != "" {
+			filter.CreatedAfter, err = time.Parse(time.RFC3339, createdAfter)
+			if err != nil {
+				return auerr.CError(auerr.ErrorBadInput, err)
+			}
+		}
+		if createdBefore := c.QueryParam(createdBeforeQueryParam); createdBefore != "" {
+			filter.CreatedBefore, err = time.Parse(time.RFC3339, createdBefore)
+			if err != nil {
+				return auerr.CError(auerr.ErrorBadInput, err)
+			}
+		}
+		// Labels are given as key:value, or just key to only require the label to exist
+		for _, label := range c.QueryParams()[labelQueryParam] {
+			if filter.Labels == nil {
+				filter.Labels = make(map[string]string)
+			}
+			parts := strings.SplitN(label, ":", 2)
+			if len(parts) == 2 {
+				filter.Labels[parts[0]] = parts[1]
+			} else {
+				filter.Labels[parts[0]] = ""
+			}
+		}
+		cursor := c.QueryParam(cursorQueryParam)
+		if cursor != "" {
+			_, err = uuid.Parse(cursor)
+			if err != nil {
+				return auerr.FError(auerr.ErrorBadInput, "Invalid cursor %s", cursor)
+			}
+		}
+		limitParam := c.QueryParam(limitQueryParam)
+		if limitParam == "" {
+			limitParam = "100"
+		}
+		limit, err := strconv.ParseInt(limitParam, 10, 64)
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		page, err := assetManager.List(c.Request().Context(), bucket, filter, cursor, limit)
+		if err != nil {
+			return err
+		}
+		response := &listAssetsResponse{Assets: make([]*listedAsset, 0, len(page.Assets)), NextCursor: page.Cursor}
+		for i := range page.Assets {
+			asset := &page.Assets[i]
+			response.Assets = append(response.Assets, &listedAsset{
+				AssetID:       asset.ID,
+				Status:        string(asset.State),
+				Size:          asset.Size,
+				ContentType:   asset.ContentType,
+				StorageClass:  string(asset.StorageClass),
+				ContentMD5:    asset.Checksum.MD5,
+				ContentSHA256: asset.Checksum.SHA256,
+				CreatedAt:     asset.CreatedAt.Format(time.RFC3339),
+				UpdatedAt:     asset.UpdatedAt.Format(time.RFC3339),
+				Metadata:      newAssetMetadata(&asset.Metadata),
+			})
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+type listAssetsResponse struct {
+	Assets     []*listedAsset `json:"assets"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+type listedAsset struct {
+	AssetID     string `json:"id"`
+	Status      string `json:"status"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	// StorageClass is empty for the default one of the bucket
+	StorageClass  string         `json:"storage_class,omitempty"`
+	ContentMD5    string         `json:"content_md5,omitempty"`
+	ContentSHA256 string         `json:"content_sha256,omitempty"`
+	CreatedAt     string         `json:"created_at"`
+	UpdatedAt     string         `json:"updated_at"`
+	Metadata      *assetMetadata `json:"metadata"`
 }
@@ -4,16 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/tgracchus/assetuploader/pkg/auerr"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
+	"github.com/tgracchus/assetuploader/pkg/assets"
 )
 
 func TestPostAsset(t *testing.T) {
@@ -37,6 +42,174 @@ func TestPostAsset(t *testing.T) {
 			//TODOassert.Equal(t, http.StatusCeated, rec.Body)
 		}
 	})
+	t.Run("TestCreateMultipartAssetOK", func(t *testing.T) {
+		body, err := json.Marshal(&postAssetBody{Parts: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/asset", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset")
+		assetManager := &mockAssetManager{postURLs: []*url.URL{putURL, putURL}}
+		post := newPostAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, post(c)) {
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			response := &postAssetResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, []string{"http://ok", "http://ok"}, response.UploadURLs)
+			assert.Empty(t, response.UploadURL)
+		}
+	})
+	t.Run("TestCreateAssetWithConstraintsOK", func(t *testing.T) {
+		body, err := json.Marshal(&postAssetBody{ContentType: "image/png", ContentLength: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/asset", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset")
+		assetManager := &mockAssetManager{postURL: putURL}
+		post := newPostAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, post(c)) {
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			assert.Equal(t, assets.PutConstraints{ContentType: "image/png", ContentLength: 1024}, assetManager.constraints)
+		}
+	})
+	t.Run("TestCreateAssetWithEncryptionOK", func(t *testing.T) {
+		body, err := json.Marshal(&postAssetBody{Encryption: assetEncryption{Mode: "SSE-KMS", KMSKeyID: "kmsKey"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/asset", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset")
+		headers := map[string]string{"X-Amz-Server-Side-Encryption": "aws:kms"}
+		assetManager := &mockAssetManager{postURL: putURL, headers: headers}
+		post := newPostAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, post(c)) {
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			expected := assets.Encryption{Mode: assets.EncryptionKMS, KMSKeyID: "kmsKey"}
+			assert.Equal(t, expected, assetManager.constraints.Encryption)
+			response := &postAssetResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, headers, response.Headers)
+		}
+	})
+	t.Run("TestCreateAssetWithCustomerEncryptionOK", func(t *testing.T) {
+		body, err := json.Marshal(&postAssetBody{Encryption: assetEncryption{Mode: "SSE-C", CustomerKeyID: "key"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/asset", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset")
+		assetManager := &mockAssetManager{}
+		post := newPostAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, post(c)) {
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			response := &postAssetResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Empty(t, response.UploadURL)
+			assert.Empty(t, response.Headers)
+		}
+	})
+	t.Run("TestCreateAssetWithStorageClassOK", func(t *testing.T) {
+		body, err := json.Marshal(&postAssetBody{StorageClass: "STANDARD_IA"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/asset", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset")
+		assetManager := &mockAssetManager{postURL: putURL}
+		post := newPostAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, post(c)) {
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			assert.Equal(t, assets.StorageClassStandardIA, assetManager.constraints.StorageClass)
+		}
+	})
+	t.Run("TestCreateAssetWithMetadataOK", func(t *testing.T) {
+		body, err := json.Marshal(&postAssetBody{
+			Filename:    "cat.png",
+			ContentType: "image/png",
+			Owner:       "owner",
+			Labels:      map[string]string{"animal": "cat"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/asset", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset")
+		assetManager := &mockAssetManager{postURL: putURL}
+		post := newPostAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, post(c)) {
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			expected := assets.Metadata{Filename: "cat.png", ContentType: "image/png", Owner: "owner", Labels: map[string]string{"animal": "cat"}}
+			assert.Equal(t, expected, assetManager.metadata)
+		}
+	})
+	t.Run("TestCreateAssetWithInvalidMetadata", func(t *testing.T) {
+		body, err := json.Marshal(&postAssetBody{ContentType: "image/png", Labels: map[string]string{"": "cat"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/asset", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset")
+		assetManager := &mockAssetManager{postURL: putURL}
+		post := newPostAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		err = post(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			// The asset is not created
+			assert.Equal(t, assets.PutConstraints{}, assetManager.constraints)
+		}
+	})
+	t.Run("TestCreateAssetWithExpirationOK", func(t *testing.T) {
+		body, err := json.Marshal(&postAssetBody{ExpiresIn: 120})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/asset", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset")
+		expiresAt := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+		assetManager := &mockAssetManager{postURL: putURL, expiresAt: expiresAt}
+		post := newPostAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, post(c)) {
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			assert.Equal(t, 2*time.Minute, assetManager.expiration)
+			response := &postAssetResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, "2019-01-02T03:04:05Z", response.ExpiresAt)
+		}
+	})
 	t.Run("TestCreateAssetIDError", func(t *testing.T) {
 		rec := httptest.NewRecorder()
 		c := e.NewContext(req, rec)
@@ -177,6 +350,169 @@ func TestPutAsset(t *testing.T) {
 	})
 }
 
+func TestPutAssetContent(t *testing.T) {
+	// Setup
+	e := echo.New()
+	t.Run("TestPutContentOK", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/asset/", strings.NewReader("content"))
+		req.Header.Set(echo.HeaderContentType, "image/png")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID/content")
+		c.SetParamNames("assetID")
+		c.SetParamValues(uuid.New().String())
+		assetManager := &mockAssetManager{}
+		put := newPutAssetContentEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, put(c)) {
+			assert.Equal(t, http.StatusAccepted, rec.Code)
+			assert.Equal(t, "image/png", assetManager.contentType)
+			assert.Equal(t, int64(len("content")), assetManager.length)
+			assert.Equal(t, "content", string(assetManager.content))
+		}
+	})
+	t.Run("TestPutContentTooLarge", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/asset/", strings.NewReader("content"))
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID/content")
+		c.SetParamNames("assetID")
+		c.SetParamValues(uuid.New().String())
+		assetManager := &mockAssetManager{putErr: auerr.SError(auerr.ErrorBadInput, "ErrorBadInput")}
+		put := newPutAssetContentEndpoint(assetManager, "testBucket")
+		// Assertions
+		err := put(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+	t.Run("TestPutContentAlreadyUploaded", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/asset/", strings.NewReader("content"))
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID/content")
+		c.SetParamNames("assetID")
+		c.SetParamValues(uuid.New().String())
+		assetManager := &mockAssetManager{putErr: auerr.SError(auerr.ErrorConflict, "ErrorConflict")}
+		put := newPutAssetContentEndpoint(assetManager, "testBucket")
+		// Assertions
+		err := put(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusConflict, rec.Code)
+		}
+	})
+}
+
+func TestGetAssetContent(t *testing.T) {
+	// Setup
+	e := echo.New()
+	lastModified := time.Date(2019, 5, 10, 20, 40, 51, 0, time.UTC)
+	newContent := func() *assets.Content {
+		return &assets.Content{
+			Body:         &readSeekCloser{strings.NewReader("CONTENT")},
+			Size:         7,
+			ContentType:  "text/plain",
+			ETag:         `"etag"`,
+			LastModified: lastModified,
+			Metadata:     assets.Metadata{Filename: "content.txt"},
+		}
+	}
+	get := func(assetManager *mockAssetManager, headers map[string]string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodGet, "/asset/", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID/content")
+		c.SetParamNames("assetID")
+		c.SetParamValues(uuid.New().String())
+		err := newGetAssetContentEndpoint(assetManager, "testBucket")(c)
+		if err != nil {
+			AssetUploaderHTTPErrorHandler(err, c)
+		}
+		return rec, err
+	}
+	t.Run("TestGetContentOK", func(t *testing.T) {
+		rec, err := get(&mockAssetManager{getContent: newContent()}, nil)
+		// Assertions
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "CONTENT", rec.Body.String())
+			assert.Equal(t, "text/plain", rec.Header().Get(echo.HeaderContentType))
+			assert.Equal(t, `"etag"`, rec.Header().Get("ETag"))
+			assert.Equal(t, lastModified.Format(http.TimeFormat), rec.Header().Get(echo.HeaderLastModified))
+			assert.Equal(t, "attachment; filename=content.txt", rec.Header().Get(echo.HeaderContentDisposition))
+		}
+	})
+	t.Run("TestGetContentRange", func(t *testing.T) {
+		rec, err := get(&mockAssetManager{getContent: newContent()}, map[string]string{"Range": "bytes=1-3"})
+		// Assertions
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusPartialContent, rec.Code)
+			assert.Equal(t, "ONT", rec.Body.String())
+			assert.Equal(t, "bytes 1-3/7", rec.Header().Get("Content-Range"))
+		}
+	})
+	t.Run("TestGetContentRangeNotSatisfiable", func(t *testing.T) {
+		rec, err := get(&mockAssetManager{getContent: newContent()}, map[string]string{"Range": "bytes=7-"})
+		// Assertions
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+		}
+	})
+	t.Run("TestGetContentNotModified", func(t *testing.T) {
+		for _, headers := range []map[string]string{
+			{"If-None-Match": `"etag"`},
+			{"If-Modified-Since": lastModified.Format(http.TimeFormat)},
+		} {
+			rec, err := get(&mockAssetManager{getContent: newContent()}, headers)
+			// Assertions
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusNotModified, rec.Code)
+				assert.Empty(t, rec.Body.String())
+			}
+		}
+	})
+	t.Run("TestGetContentModified", func(t *testing.T) {
+		rec, err := get(&mockAssetManager{getContent: newContent()}, map[string]string{"If-None-Match": `"other"`})
+		// Assertions
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "CONTENT", rec.Body.String())
+		}
+	})
+	t.Run("TestGetContentWithoutContentType", func(t *testing.T) {
+		content := newContent()
+		content.ContentType = ""
+		content.Metadata = assets.Metadata{}
+		rec, err := get(&mockAssetManager{getContent: content}, nil)
+		// Assertions
+		if assert.NoError(t, err) {
+			assert.Equal(t, echo.MIMEOctetStream, rec.Header().Get(echo.HeaderContentType))
+			assert.Empty(t, rec.Header().Get(echo.HeaderContentDisposition))
+		}
+	})
+	t.Run("TestGetContentNotFound", func(t *testing.T) {
+		rec, err := get(&mockAssetManager{getErr: auerr.SError(auerr.ErrorNotFound, "ErrorNotFound")}, nil)
+		// Assertions
+		if assert.Error(t, err) {
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+	})
+}
+
+// readSeekCloser is a content read from memory.
+type readSeekCloser struct {
+	*strings.Reader
+}
+
+func (r *readSeekCloser) Close() error {
+	return nil
+}
+
 func TestGetAsset(t *testing.T) {
 	// Setup
 	e := echo.New()
@@ -198,6 +534,120 @@ func TestGetAsset(t *testing.T) {
 			assert.Equal(t, http.StatusOK, rec.Code)
 		}
 	})
+	t.Run("TestGetCustomerEncryptedForbidden", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/asset", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID")
+		c.SetParamNames("assetID")
+		c.SetParamValues(uuid.New().String())
+		assetManager := &mockAssetManager{getErr: auerr.SError(auerr.ErrorForbidden, "ErrorForbidden")}
+		get := newGetAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		err := get(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusForbidden, rec.Code)
+		}
+	})
+	t.Run("TestGetWithWaitOK", func(t *testing.T) {
+		getURL, err := url.Parse("http://ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/asset?wait=30s", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID")
+		c.SetParamNames("assetID")
+		c.SetParamValues(uuid.New().String())
+		assetManager := &mockAssetManager{getURL: getURL}
+		get := newGetAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, get(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, 30*time.Second, assetManager.wait)
+		}
+	})
+	t.Run("TestGetWithTimeoutOK", func(t *testing.T) {
+		getURL, err := url.Parse("http://ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/asset?timeout=120", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID")
+		c.SetParamNames("assetID")
+		c.SetParamValues(uuid.New().String())
+		expiresAt := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+		assetManager := &mockAssetManager{getURL: getURL, expiresAt: expiresAt}
+		get := newGetAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, get(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, 2*time.Minute, assetManager.expiration)
+			response := &getAssetResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, "2019-01-02T03:04:05Z", response.ExpiresAt)
+		}
+	})
+	t.Run("TestGetWithTimeoutNotCorrect", func(t *testing.T) {
+		for _, timeout := range []string{"soon", "1.5", "0", "-1"} {
+			req := httptest.NewRequest(http.MethodGet, "/asset?timeout="+timeout, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetPath("/asset/:assetID")
+			c.SetParamNames("assetID")
+			c.SetParamValues(uuid.New().String())
+			get := newGetAssetEndpoint(&mockAssetManager{}, "testBucket")
+			// Assertions
+			err := get(c)
+			if assert.Error(t, err) {
+				AssetUploaderHTTPErrorHandler(err, c)
+				assert.Equal(t, http.StatusBadRequest, rec.Code, timeout)
+			}
+		}
+	})
+	t.Run("TestGetWithWaitNotCorrect", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/asset?wait=soon", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID")
+		c.SetParamNames("assetID")
+		c.SetParamValues(uuid.New().String())
+		get := newGetAssetEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		err := get(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+	t.Run("TestGetWithChecksumOK", func(t *testing.T) {
+		getURL, err := url.Parse("http://ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/asset", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID")
+		c.SetParamNames("assetID")
+		c.SetParamValues(uuid.New().String())
+		checksum := assets.Checksum{MD5: "md5", SHA256: "sha256"}
+		assetManager := &mockAssetManager{getURL: getURL, checksum: checksum}
+		get := newGetAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, get(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			response := &getAssetResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, "http://ok", response.DownloadURL)
+			assert.Equal(t, "md5", response.ContentMD5)
+			assert.Equal(t, "sha256", response.ContentSHA256)
+		}
+	})
 	t.Run("TestAssetIDNotCorrect", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/asset/", nil)
 		rec := httptest.NewRecorder()
@@ -249,19 +699,565 @@ func TestGetAsset(t *testing.T) {
 }
 
 type mockAssetManager struct {
-	postURL *url.URL
-	postErr error
-	putErr  error
-	getURL  *url.URL
-	getErr  error
+	postURL  *url.URL
+	postURLs []*url.URL
+	postErr  error
+	// constraints and expiration are the last ones received
+	constraints assets.PutConstraints
+	expiration  time.Duration
+	expiresAt   time.Time
+	headers     map[string]string
+	putErr      error
+	getURL      *url.URL
+	getContent  *assets.Content
+	checksum    assets.Checksum
+	getErr      error
+	// metadata is the last one put, returned by GetURL and UpdateMetadata
+	metadata     assets.Metadata
+	update       assets.MetadataUpdate
+	metadataErr  error
+	revokeErr    error
+	deleteErr    error
+	restoreState assets.AssetState
+	restoreErr   error
+	status       assets.AssetStatus
+	statusErr    error
+	events       []assets.Event
+	historyErr   error
+	// wait is the last one received
+	wait    time.Duration
+	waitErr error
+	// filter is the last one received
+	filter  assets.ListFilter
+	page    assets.AssetPage
+	listErr error
+	// offset and chunk are the last ones received
+	progress    assets.UploadProgress
+	progressErr error
+	offset      int64
+	chunk       []byte
+	// contentType, length and content are the last put ones
+	contentType string
+	length      int64
+	content     []byte
 }
 
-func (mock *mockAssetManager) PutURL(ctx context.Context, bucket string, assetID uuid.UUID) (*url.URL, error) {
-	return mock.postURL, mock.postErr
+func (mock *mockAssetManager) PutURL(ctx context.Context, bucket string, assetID uuid.UUID, constraints assets.PutConstraints, expiration time.Duration) (*assets.Upload, error) {
+	mock.constraints = constraints
+	mock.expiration = expiration
+	if mock.postErr != nil {
+		return nil, mock.postErr
+	}
+	// Without url, the asset is created as a SSE-C one
+	if mock.postURL == nil {
+		return &assets.Upload{ExpiresAt: mock.expiresAt}, nil
+	}
+	return &assets.Upload{URLs: []*url.URL{mock.postURL}, ExpiresAt: mock.expiresAt, Headers: mock.headers}, nil
+}
+func (mock *mockAssetManager) MultipartPutURLs(ctx context.Context, bucket string, assetID uuid.UUID, parts int64, constraints assets.PutConstraints, expiration time.Duration) (*assets.Upload, error) {
+	mock.constraints = constraints
+	mock.expiration = expiration
+	if mock.postErr != nil {
+		return nil, mock.postErr
+	}
+	return &assets.Upload{URLs: mock.postURLs, ExpiresAt: mock.expiresAt, Headers: mock.headers}, nil
+}
+func (mock *mockAssetManager) CreateResumableUpload(ctx context.Context, bucket string, assetID uuid.UUID, constraints assets.PutConstraints) (*assets.UploadProgress, error) {
+	mock.constraints = constraints
+	if mock.postErr != nil {
+		return nil, mock.postErr
+	}
+	return &mock.progress, nil
+}
+func (mock *mockAssetManager) Progress(ctx context.Context, bucket string, assetID uuid.UUID) (*assets.UploadProgress, error) {
+	if mock.progressErr != nil {
+		return nil, mock.progressErr
+	}
+	return &mock.progress, nil
+}
+func (mock *mockAssetManager) WriteChunk(ctx context.Context, bucket string, assetID uuid.UUID, offset int64, chunk io.Reader) (*assets.UploadProgress, error) {
+	mock.offset = offset
+	content, err := ioutil.ReadAll(chunk)
+	if err != nil {
+		return nil, err
+	}
+	mock.chunk = content
+	if mock.progressErr != nil {
+		return nil, mock.progressErr
+	}
+	mock.progress.Offset += int64(len(content))
+	return &mock.progress, nil
+}
+func (mock *mockAssetManager) PutContent(ctx context.Context, bucket string, assetID uuid.UUID, contentType string, length int64, content io.Reader) error {
+	mock.contentType = contentType
+	mock.length = length
+	received, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	mock.content = received
+	return mock.putErr
+}
+func (mock *mockAssetManager) GetContent(ctx context.Context, bucket string, assetID uuid.UUID) (*assets.Content, error) {
+	if mock.getErr != nil {
+		return nil, mock.getErr
+	}
+	return mock.getContent, nil
 }
 func (mock *mockAssetManager) Uploaded(ctx context.Context, bucket string, assetID uuid.UUID) error {
 	return mock.putErr
 }
-func (mock *mockAssetManager) GetURL(ctx context.Context, bucket string, assetID uuid.UUID, timeout int64) (*url.URL, error) {
-	return mock.getURL, mock.getErr
+func (mock *mockAssetManager) GetURL(ctx context.Context, bucket string, assetID uuid.UUID, expiration time.Duration) (*assets.Download, error) {
+	mock.expiration = expiration
+	if mock.getErr != nil {
+		return nil, mock.getErr
+	}
+	return &assets.Download{
+		URL:       mock.getURL,
+		ExpiresAt: mock.expiresAt,
+		Checksum:  mock.checksum,
+		Metadata:  mock.metadata,
+	}, nil
+}
+func (mock *mockAssetManager) PutMetadata(ctx context.Context, bucket string, assetID uuid.UUID, metadata assets.Metadata) error {
+	mock.metadata = metadata
+	return mock.metadataErr
+}
+func (mock *mockAssetManager) Revoke(ctx context.Context, bucket string, assetID uuid.UUID) error {
+	return mock.revokeErr
+}
+func (mock *mockAssetManager) Delete(ctx context.Context, bucket string, assetID uuid.UUID) error {
+	return mock.deleteErr
+}
+func (mock *mockAssetManager) Restore(ctx context.Context, bucket string, assetID uuid.UUID) (assets.AssetState, error) {
+	return mock.restoreState, mock.restoreErr
+}
+func (mock *mockAssetManager) UpdateMetadata(ctx context.Context, bucket string, assetID uuid.UUID, update assets.MetadataUpdate) (*assets.Metadata, error) {
+	mock.update = update
+	if mock.metadataErr != nil {
+		return nil, mock.metadataErr
+	}
+	return &mock.metadata, nil
+}
+
+func (mock *mockAssetManager) Status(ctx context.Context, bucket string, assetID uuid.UUID) (*assets.AssetStatus, error) {
+	if mock.statusErr != nil {
+		return nil, mock.statusErr
+	}
+	return &mock.status, nil
+}
+
+func (mock *mockAssetManager) WaitProcessed(ctx context.Context, bucket string, assetID uuid.UUID, wait time.Duration) error {
+	mock.wait = wait
+	return mock.waitErr
+}
+
+func (mock *mockAssetManager) History(ctx context.Context, bucket string, assetID uuid.UUID) ([]assets.Event, error) {
+	return mock.events, mock.historyErr
+}
+func (mock *mockAssetManager) CollectGarbage(ctx context.Context, bucket string, dryRun bool) (*assets.GarbageReport, error) {
+	return &assets.GarbageReport{DryRun: dryRun}, nil
+}
+func (mock *mockAssetManager) ScheduleGarbageCollection(ctx context.Context, bucket string, period time.Duration, dryRun bool) error {
+	return nil
+}
+func (mock *mockAssetManager) ScheduleUploadWatcher(ctx context.Context, bucket string, period time.Duration) error {
+	return nil
+}
+func (mock *mockAssetManager) ScheduleArchive(ctx context.Context, bucket string, period time.Duration) error {
+	return nil
+}
+func (mock *mockAssetManager) ResumeRestores(ctx context.Context, bucket string) error {
+	return nil
+}
+func (mock *mockAssetManager) ResumePurges(ctx context.Context, bucket string) error {
+	return nil
+}
+func (mock *mockAssetManager) List(ctx context.Context, bucket string, filter assets.ListFilter, cursor string, limit int64) (*assets.AssetPage, error) {
+	mock.filter = filter
+	if mock.listErr != nil {
+		return nil, mock.listErr
+	}
+	return &mock.page, nil
+}
+
+func TestGetAssetStatus(t *testing.T) {
+	// Setup
+	e := echo.New()
+	newContext := func(assetID string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, "/asset/"+assetID+"/status", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID/status")
+		c.SetParamNames("assetID")
+		c.SetParamValues(assetID)
+		return c, rec
+	}
+	t.Run("TestStatusOK", func(t *testing.T) {
+		assetID := uuid.New().String()
+		c, rec := newContext(assetID)
+		assetManager := &mockAssetManager{status: assets.AssetStatus{
+			State:       assets.StateUploading,
+			Size:        7,
+			ContentType: "image/png",
+			CreatedAt:   time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+			UpdatedAt:   time.Date(2018, 1, 1, 0, 0, 30, 0, time.UTC),
+			PromoteAt:   time.Date(2018, 1, 1, 0, 1, 0, 0, time.UTC),
+		}}
+		get := newGetAssetStatusEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, get(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			response := &getAssetStatusResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, &getAssetStatusResponse{
+				AssetID:     assetID,
+				Status:      "uploading",
+				Size:        7,
+				ContentType: "image/png",
+				CreatedAt:   "2018-01-01T00:00:00Z",
+				UpdatedAt:   "2018-01-01T00:00:30Z",
+				PromoteAt:   "2018-01-01T00:01:00Z",
+			}, response)
+		}
+	})
+	t.Run("TestArchivedOK", func(t *testing.T) {
+		assetID := uuid.New().String()
+		c, rec := newContext(assetID)
+		assetManager := &mockAssetManager{status: assets.AssetStatus{
+			State:        assets.StateArchived,
+			Size:         7,
+			CreatedAt:    time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+			UpdatedAt:    time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC),
+			StorageClass: assets.StorageClassGlacier,
+		}}
+		get := newGetAssetStatusEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, get(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			response := &getAssetStatusResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, "archived", response.Status)
+			assert.Equal(t, "GLACIER", response.StorageClass)
+		}
+	})
+	t.Run("TestAssetIDNotCorrect", func(t *testing.T) {
+		c, rec := newContext("nonValidUUID")
+		get := newGetAssetStatusEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		err := get(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+	t.Run("TestNotFound", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String())
+		assetManager := &mockAssetManager{statusErr: auerr.SError(auerr.ErrorNotFound, "ErrorNotFound")}
+		get := newGetAssetStatusEndpoint(assetManager, "testBucket")
+		// Assertions
+		err := get(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+	})
+}
+
+func TestGetAssetHistory(t *testing.T) {
+	// Setup
+	e := echo.New()
+	newContext := func(assetID string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, "/asset/"+assetID+"/history", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID/history")
+		c.SetParamNames("assetID")
+		c.SetParamValues(assetID)
+		return c, rec
+	}
+	t.Run("TestHistoryOK", func(t *testing.T) {
+		assetID := uuid.New().String()
+		c, rec := newContext(assetID)
+		assetManager := &mockAssetManager{events: []assets.Event{
+			{Type: assets.EventURLsIssued, At: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{Type: assets.EventPromotionFailed, At: time.Date(2018, 1, 1, 0, 1, 0, 500, time.UTC), Detail: "not found"},
+		}}
+		get := newGetAssetHistoryEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, get(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			response := &getAssetHistoryResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, &getAssetHistoryResponse{
+				AssetID: assetID,
+				Events: []*assetEvent{
+					{Type: "urls_issued", At: "2018-01-01T00:00:00Z"},
+					{Type: "promotion_failed", At: "2018-01-01T00:01:00.0000005Z", Detail: "not found"},
+				},
+			}, response)
+		}
+	})
+	t.Run("TestAssetIDNotCorrect", func(t *testing.T) {
+		c, rec := newContext("nonValidUUID")
+		get := newGetAssetHistoryEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		err := get(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+	t.Run("TestNotFound", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String())
+		assetManager := &mockAssetManager{historyErr: auerr.SError(auerr.ErrorNotFound, "ErrorNotFound")}
+		get := newGetAssetHistoryEndpoint(assetManager, "testBucket")
+		// Assertions
+		err := get(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+	})
+}
+
+func TestPatchAssetMetadata(t *testing.T) {
+	// Setup
+	e := echo.New()
+	newContext := func(assetID string, body string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodPatch, "/asset/"+assetID+"/metadata", bytes.NewReader([]byte(body)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID/metadata")
+		c.SetParamNames("assetID")
+		c.SetParamValues(assetID)
+		return c, rec
+	}
+	t.Run("TestPatchOK", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String(), `{"owner": "other", "labels": {"animal": null, "color": "black"}}`)
+		assetManager := &mockAssetManager{metadata: assets.Metadata{Owner: "other", Labels: map[string]string{"color": "black"}}}
+		patch := newPatchAssetMetadataEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, patch(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			owner, color := "other", "black"
+			expected := assets.MetadataUpdate{Owner: &owner, Labels: map[string]*string{"animal": nil, "color": &color}}
+			assert.Equal(t, expected, assetManager.update)
+			response := &assetMetadata{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, &assetMetadata{Owner: "other", Labels: map[string]string{"color": "black"}}, response)
+		}
+	})
+	t.Run("TestAssetIDNotCorrect", func(t *testing.T) {
+		c, rec := newContext("nonValidUUID", `{}`)
+		patch := newPatchAssetMetadataEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		err := patch(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+	t.Run("TestNotFound", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String(), `{"owner": "other"}`)
+		assetManager := &mockAssetManager{metadataErr: auerr.SError(auerr.ErrorNotFound, "ErrorNotFound")}
+		patch := newPatchAssetMetadataEndpoint(assetManager, "testBucket")
+		// Assertions
+		err := patch(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+	})
+}
+
+func TestDeleteAsset(t *testing.T) {
+	// Setup
+	e := echo.New()
+	newContext := func(assetID string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodDelete, "/asset/"+assetID, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID")
+		c.SetParamNames("assetID")
+		c.SetParamValues(assetID)
+		return c, rec
+	}
+	t.Run("TestDeleteOK", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String())
+		del := newDeleteAssetEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		if assert.NoError(t, del(c)) {
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+		}
+	})
+	t.Run("TestAssetIDNotCorrect", func(t *testing.T) {
+		c, rec := newContext("nonValidUUID")
+		del := newDeleteAssetEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		err := del(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+	t.Run("TestNotFound", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String())
+		assetManager := &mockAssetManager{deleteErr: auerr.SError(auerr.ErrorNotFound, "ErrorNotFound")}
+		del := newDeleteAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		err := del(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+	})
+}
+
+func TestRevokeAsset(t *testing.T) {
+	// Setup
+	e := echo.New()
+	newContext := func(assetID string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodPost, "/asset/"+assetID+"/revoke", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID/revoke")
+		c.SetParamNames("assetID")
+		c.SetParamValues(assetID)
+		return c, rec
+	}
+	t.Run("TestRevokeOK", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String())
+		revoke := newRevokeAssetEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		if assert.NoError(t, revoke(c)) {
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+		}
+	})
+	t.Run("TestAssetIdNotCorrect", func(t *testing.T) {
+		c, rec := newContext("notAnUUID")
+		revoke := newRevokeAssetEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		err := revoke(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+	t.Run("TestAlreadyUploaded", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String())
+		assetManager := &mockAssetManager{revokeErr: auerr.SError(auerr.ErrorConflict, "ErrorConflict")}
+		revoke := newRevokeAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		err := revoke(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusConflict, rec.Code)
+		}
+	})
+}
+
+func TestRestoreAsset(t *testing.T) {
+	// Setup
+	e := echo.New()
+	newContext := func(assetID string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodPost, "/asset/"+assetID+"/restore", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/asset/:assetID/restore")
+		c.SetParamNames("assetID")
+		c.SetParamValues(assetID)
+		return c, rec
+	}
+	t.Run("TestRestoreOK", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String())
+		restore := newRestoreAssetEndpoint(&mockAssetManager{restoreState: assets.StateUploaded}, "testBucket")
+		// Assertions
+		if assert.NoError(t, restore(c)) {
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+		}
+	})
+	t.Run("TestRestoreArchivedOK", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String())
+		restore := newRestoreAssetEndpoint(&mockAssetManager{restoreState: assets.StateRestoring}, "testBucket")
+		// Assertions
+		if assert.NoError(t, restore(c)) {
+			assert.Equal(t, http.StatusAccepted, rec.Code)
+		}
+	})
+	t.Run("TestNotDeleted", func(t *testing.T) {
+		c, rec := newContext(uuid.New().String())
+		assetManager := &mockAssetManager{restoreErr: auerr.SError(auerr.ErrorConflict, "ErrorConflict")}
+		restore := newRestoreAssetEndpoint(assetManager, "testBucket")
+		// Assertions
+		err := restore(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusConflict, rec.Code)
+		}
+	})
+}
+
+func TestListAssets(t *testing.T) {
+	// Setup
+	e := echo.New()
+	newContext := func(query string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, "/assets?"+query, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/assets")
+		return c, rec
+	}
+	t.Run("TestListOK", func(t *testing.T) {
+		c, rec := newContext("status=created,uploaded&created_after=2018-01-01T00:00:00Z&label=animal:cat&label=color")
+		createdAt := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+		assetManager := &mockAssetManager{page: assets.AssetPage{
+			Assets: []assets.AssetInfo{{
+				ID: "id", State: assets.StateUploaded, Size: 7, ContentType: "text/plain", StorageClass: assets.StorageClassGlacier,
+				Checksum: assets.Checksum{MD5: "md5", SHA256: "sha256"}, CreatedAt: createdAt, UpdatedAt: createdAt, Metadata: assets.Metadata{Owner: "owner"},
+			}},
+			Cursor: "id",
+		}}
+		list := newListAssetsEndpoint(assetManager, "testBucket")
+		// Assertions
+		if assert.NoError(t, list(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			expected := assets.ListFilter{
+				States:       []assets.AssetState{assets.StateCreated, assets.StateUploaded},
+				CreatedAfter: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+				Labels:       map[string]string{"animal": "cat", "color": ""},
+			}
+			assert.Equal(t, expected, assetManager.filter)
+			response := &listAssetsResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+			assert.Equal(t, &listAssetsResponse{
+				Assets: []*listedAsset{{
+					AssetID: "id", Status: "uploaded", Size: 7, ContentType: "text/plain", StorageClass: "GLACIER", ContentMD5: "md5", ContentSHA256: "sha256",
+					CreatedAt: "2018-01-02T00:00:00Z", UpdatedAt: "2018-01-02T00:00:00Z", Metadata: &assetMetadata{Owner: "owner"},
+				}},
+				NextCursor: "id",
+			}, response)
+		}
+	})
+	t.Run("TestCursorNotCorrect", func(t *testing.T) {
+		c, rec := newContext("cursor=nonValidUUID")
+		list := newListAssetsEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		err := list(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+	t.Run("TestDateNotCorrect", func(t *testing.T) {
+		c, rec := newContext("created_before=yesterday")
+		list := newListAssetsEndpoint(&mockAssetManager{}, "testBucket")
+		// Assertions
+		err := list(c)
+		if assert.Error(t, err) {
+			AssetUploaderHTTPErrorHandler(err, c)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
 }
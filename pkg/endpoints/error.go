@@ -17,6 +17,10 @@ func AssetUploaderHTTPErrorHandler(err error, c echo.Context) {
 	switch code := errors.Cause(err).Error(); code {
 	case auerr.ErrorBadInput:
 		c.JSON(http.StatusBadRequest, &httpError{err.Error()})
+	case auerr.ErrorUnauthorized:
+		c.JSON(http.StatusUnauthorized, &httpError{err.Error()})
+	case auerr.ErrorForbidden:
+		c.JSON(http.StatusForbidden, &httpError{err.Error()})
 	case auerr.ErrorConflict:
 		c.JSON(http.StatusConflict, &httpError{err.Error()})
 	case auerr.ErrorNotFound:
@@ -1,27 +1,25 @@
 package endpoints
 
 import (
+	"context"
 	"net/http"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-
 	"github.com/labstack/echo"
 )
 
-//RegisterHealthCheck register to echo engine a healthcheck endpoint.
-func RegisterHealthCheck(e *echo.Echo, svc *s3.S3, bucket string) {
-	e.GET("/healthcheck", newHealthCheck(svc, bucket))
+//RegisterHealthCheck register to echo engine a healthcheck endpoint, which is up when the buckets of all the tenants are.
+func RegisterHealthCheck(e *echo.Echo, tenants *TenantRouter) {
+	e.GET("/healthcheck", newHealthCheck(tenants.Tenants(), 5*time.Second))
 }
 
-func newHealthCheck(svc *s3.S3, bucket string) func(c echo.Context) error {
+func newHealthCheck(tenants []*Tenant, checkPeriod time.Duration) func(c echo.Context) error {
 	queries := make(chan bool)
 	status := make(chan healthcheck)
 	go func() {
 		defer close(status)
 		defer close(queries)
-		ticker := time.NewTicker(5 * time.Second)
+		ticker := time.NewTicker(checkPeriod)
 		check := healthcheck{
 			Status:     "DOWN",
 			StatusCode: http.StatusServiceUnavailable,
@@ -29,7 +27,7 @@ func newHealthCheck(svc *s3.S3, bucket string) func(c echo.Context) error {
 		for {
 			select {
 			case <-ticker.C:
-				_, err := svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+				err := checkBuckets(tenants)
 				if err == nil {
 					check = healthcheck{
 						Status:     "UP",
@@ -65,3 +63,13 @@ type healthcheck struct {
 	Status     string `json:"Status"`
 	StatusCode int    `json:"-"`
 }
+
+func checkBuckets(tenants []*Tenant) error {
+	for _, tenant := range tenants {
+		err := tenant.Storage.CheckBucket(context.Background(), tenant.Bucket)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+	"github.com/tgracchus/assetuploader/pkg/s3test"
+)
+
+func TestHealthCheck(t *testing.T) {
+	e := echo.New()
+	checkPeriod := 10 * time.Millisecond
+	t.Run("TestUP", func(t *testing.T) {
+		healthCheck := newHealthCheck([]*Tenant{{Bucket: "testBucket", Storage: &mockStorage{}}}, checkPeriod)
+		time.Sleep(5 * checkPeriod)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/healthcheck", nil), rec)
+		if assert.NoError(t, healthCheck(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+	})
+	t.Run("TestDOWN", func(t *testing.T) {
+		storage := &mockStorage{checkErr: auerr.SError(auerr.ErrorInternalError, "ErrorInternalError")}
+		healthCheck := newHealthCheck([]*Tenant{{Bucket: "testBucket", Storage: storage}}, checkPeriod)
+		time.Sleep(5 * checkPeriod)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/healthcheck", nil), rec)
+		if assert.NoError(t, healthCheck(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+	t.Run("TestTenantDOWN", func(t *testing.T) {
+		down := &mockStorage{checkErr: auerr.SError(auerr.ErrorInternalError, "ErrorInternalError")}
+		healthCheck := newHealthCheck([]*Tenant{{Bucket: "testBucket", Storage: &mockStorage{}}, {Bucket: "otherBucket", Storage: down}}, checkPeriod)
+		time.Sleep(5 * checkPeriod)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/healthcheck", nil), rec)
+		if assert.NoError(t, healthCheck(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+	t.Run("TestS3", func(t *testing.T) {
+		server := s3test.NewServer("eu-west-1", "accessKey", "secretKey")
+		defer server.Close()
+		server.CreateBucket("testBucket")
+		session, err := assets.NewAwsSession(credentials.NewStaticCredentials("accessKey", "secretKey", ""), "eu-west-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := assets.NewS3Storage(assets.NewS3ClientWithEndpoint(session, "eu-west-1", server.URL))
+		up := newHealthCheck([]*Tenant{{Bucket: "testBucket", Storage: storage}}, checkPeriod)
+		down := newHealthCheck([]*Tenant{{Bucket: "missingBucket", Storage: storage}}, checkPeriod)
+		time.Sleep(10 * checkPeriod)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/healthcheck", nil), rec)
+		if assert.NoError(t, up(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+		rec = httptest.NewRecorder()
+		c = e.NewContext(httptest.NewRequest(http.MethodGet, "/healthcheck", nil), rec)
+		if assert.NoError(t, down(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+}
+
+type mockStorage struct {
+	assets.Storage
+	checkErr error
+}
+
+func (mock *mockStorage) CheckBucket(ctx context.Context, bucket string) error {
+	return mock.checkErr
+}
@@ -0,0 +1,65 @@
+package endpoints
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/labstack/echo"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+)
+
+const bucketParam = "bucket"
+
+// RegisterLocalStorageEndpoints register to echo engine the endpoints serving the local storage signed urls.
+func RegisterLocalStorageEndpoints(e *echo.Echo, storage *assets.LocalStorage) {
+	storagePath := assets.LocalStoragePath + ":" + bucketParam + "/*"
+	e.PUT(storagePath, newPutObjectEndpoint(storage))
+	e.GET(storagePath, newGetObjectEndpoint(storage))
+}
+
+func newPutObjectEndpoint(storage *assets.LocalStorage) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		bucket := c.Param(bucketParam)
+		key := c.Param("*")
+		err := storage.Verify(http.MethodPut, bucket, key, c.QueryParams())
+		if err != nil {
+			return err
+		}
+		contentType := c.Request().Header.Get(echo.HeaderContentType)
+		err = storage.CheckConstraints(c.QueryParams(), contentType, c.Request().ContentLength)
+		if err != nil {
+			return err
+		}
+		if uploadID := c.QueryParam(assets.LocalUploadIDParam); uploadID != "" {
+			err = storage.WritePart(bucket, key, uploadID, c.QueryParam(assets.LocalPartNumberParam), c.Request().Body)
+		} else {
+			err = storage.Write(bucket, key, c.Request().Body, contentType, nil, storage.SignedChecksum(c.QueryParams()))
+		}
+		if err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+func newGetObjectEndpoint(storage *assets.LocalStorage) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		bucket := c.Param(bucketParam)
+		key := c.Param("*")
+		err := storage.Verify(http.MethodGet, bucket, key, c.QueryParams())
+		if err != nil {
+			return err
+		}
+		file, info, err := storage.Open(bucket, key)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if info.ContentType != "" {
+			c.Response().Header().Set(echo.HeaderContentType, info.ContentType)
+		}
+		c.Response().Header().Set("ETag", info.ETag)
+		http.ServeContent(c.Response(), c.Request(), path.Base(key), info.LastModified, file)
+		return nil
+	}
+}
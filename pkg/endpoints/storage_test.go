@@ -0,0 +1,284 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/job"
+	"github.com/tgracchus/assetuploader/pkg/schedule"
+	"github.com/tgracchus/assetuploader/pkg/util"
+)
+
+func TestLocalStorageAssetFlow(t *testing.T) {
+	server := newLocalStorageServer(t)
+	defer server.Close()
+
+	// Create the asset
+	response, err := http.Post(server.URL+"/asset", echo.MIMEApplicationJSON, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	created := &postAssetResponse{}
+	err = json.NewDecoder(response.Body).Decode(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Upload it to the signed url
+	response = doRequest(t, http.MethodPut, created.UploadURL, "text/plain", strings.NewReader("CONTENT"))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	// Tampered signatures are rejected
+	response = doRequest(t, http.MethodPut, created.UploadURL+"0", "text/plain", strings.NewReader("OTHER"))
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	markUploadedAndAssertContent(t, server, created.AssetID, "CONTENT")
+}
+
+func TestLocalStorageMultipartFlow(t *testing.T) {
+	server := newLocalStorageServer(t)
+	defer server.Close()
+
+	// Create the asset with two parts
+	body, err := json.Marshal(&postAssetBody{Parts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := doRequest(t, http.MethodPost, server.URL+"/asset", echo.MIMEApplicationJSON, bytes.NewReader(body))
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	created := &postAssetResponse{}
+	err = json.NewDecoder(response.Body).Decode(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, created.UploadURLs, 2) {
+		return
+	}
+
+	// Upload the parts, in any order
+	response = doRequest(t, http.MethodPut, created.UploadURLs[1], "text/plain", strings.NewReader("TENT"))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	response = doRequest(t, http.MethodPut, created.UploadURLs[0], "text/plain", strings.NewReader("CON"))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	markUploadedAndAssertContent(t, server, created.AssetID, "CONTENT")
+}
+
+func TestLocalStorageConstrainedFlow(t *testing.T) {
+	server := newLocalStorageServer(t)
+	defer server.Close()
+
+	// Create the asset declaring its content type and length
+	body, err := json.Marshal(&postAssetBody{ContentType: "text/plain", ContentLength: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := doRequest(t, http.MethodPost, server.URL+"/asset", echo.MIMEApplicationJSON, bytes.NewReader(body))
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	created := &postAssetResponse{}
+	err = json.NewDecoder(response.Body).Decode(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Puts not matching the declared content type or length are rejected
+	response = doRequest(t, http.MethodPut, created.UploadURL, "image/png", strings.NewReader("CONTENT"))
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	response = doRequest(t, http.MethodPut, created.UploadURL, "text/plain", strings.NewReader("CONTENTS"))
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	response = doRequest(t, http.MethodPut, created.UploadURL, "text/plain", strings.NewReader("CONTENT"))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	markUploadedAndAssertContent(t, server, created.AssetID, "CONTENT")
+}
+
+func TestLocalStorageChecksumFlow(t *testing.T) {
+	server := newLocalStorageServer(t)
+	defer server.Close()
+
+	// Create the asset declaring the sha256 of its content
+	sha256Sum := sha256.Sum256([]byte("CONTENT"))
+	contentSHA256 := hex.EncodeToString(sha256Sum[:])
+	body, err := json.Marshal(&postAssetBody{ContentSHA256: contentSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := doRequest(t, http.MethodPost, server.URL+"/asset", echo.MIMEApplicationJSON, bytes.NewReader(body))
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	created := &postAssetResponse{}
+	err = json.NewDecoder(response.Body).Decode(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Content not matching the checksum is rejected
+	response = doRequest(t, http.MethodPut, created.UploadURL, "text/plain", strings.NewReader("CORRUPT"))
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response = doRequest(t, http.MethodPut, created.UploadURL, "text/plain", strings.NewReader("CONTENT"))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	downloaded := markUploadedAndAssertContent(t, server, created.AssetID, "CONTENT")
+	assert.Equal(t, contentSHA256, downloaded.ContentSHA256)
+}
+
+func TestLocalStorageMetadataFlow(t *testing.T) {
+	server := newLocalStorageServer(t)
+	defer server.Close()
+
+	// Create the asset with metadata
+	body, err := json.Marshal(&postAssetBody{Filename: "cat.txt", Owner: "owner", Labels: map[string]string{"animal": "cat"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := doRequest(t, http.MethodPost, server.URL+"/asset", echo.MIMEApplicationJSON, bytes.NewReader(body))
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	created := &postAssetResponse{}
+	err = json.NewDecoder(response.Body).Decode(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Update it
+	response = doRequest(t, http.MethodPatch, server.URL+"/asset/"+created.AssetID+"/metadata", echo.MIMEApplicationJSON,
+		strings.NewReader(`{"filename": "dog.txt", "labels": {"animal": null, "legs": "4"}}`))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	response = doRequest(t, http.MethodPut, created.UploadURL, "text/plain", strings.NewReader("CONTENT"))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	downloaded := markUploadedAndAssertContent(t, server, created.AssetID, "CONTENT")
+	expected := &assetMetadata{Filename: "dog.txt", Owner: "owner", Labels: map[string]string{"legs": "4"}}
+	assert.Equal(t, expected, downloaded.Metadata)
+}
+
+func TestLocalStorageDeleteFlow(t *testing.T) {
+	server := newLocalStorageServer(t)
+	defer server.Close()
+
+	response, err := http.Post(server.URL+"/asset", echo.MIMEApplicationJSON, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := &postAssetResponse{}
+	err = json.NewDecoder(response.Body).Decode(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = doRequest(t, http.MethodPut, created.UploadURL, "text/plain", strings.NewReader("CONTENT"))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	markUploadedAndAssertContent(t, server, created.AssetID, "CONTENT")
+
+	// Delete it
+	response = doRequest(t, http.MethodDelete, server.URL+"/asset/"+created.AssetID, "", nil)
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, err = http.Get(server.URL + "/asset/" + created.AssetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	// Restore it
+	response = doRequest(t, http.MethodPost, server.URL+"/asset/"+created.AssetID+"/restore", "", nil)
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, err = http.Get(server.URL + "/asset/" + created.AssetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func newLocalStorageServer(t *testing.T) *httptest.Server {
+	e := echo.New()
+	e.HTTPErrorHandler = AssetUploaderHTTPErrorHandler
+	server := httptest.NewServer(e)
+	root, err := ioutil.TempDir("", "localstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := assets.NewLocalStorage(root, baseURL, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, 100*time.Millisecond)
+	manager := assets.NewAssetManager(storage, scheduler, time.Second, assets.WithMultipartAbortDelay(time.Hour))
+	RegisterAssetsEndpoints(e, NewSingleTenantRouter(&Tenant{ID: "test", Bucket: "testBucket", Manager: manager}))
+	RegisterLocalStorageEndpoints(e, storage)
+	return server
+}
+
+func markUploadedAndAssertContent(t *testing.T, server *httptest.Server, assetID string, expectedContent string) *getAssetResponse {
+	// Mark it as uploaded
+	body, err := json.Marshal(&putAssetBody{Status: "uploaded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := doRequest(t, http.MethodPut, server.URL+"/asset/"+assetID, echo.MIMEApplicationJSON, bytes.NewReader(body))
+	assert.Equal(t, http.StatusAccepted, response.StatusCode)
+
+	// Download it once promoted
+	err = util.WaitUntilWithContext(context.Background(), func(ctx context.Context) error {
+		response, err = http.Get(server.URL + "/asset/" + assetID)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode != http.StatusOK {
+			return errors.New(response.Status)
+		}
+		return nil
+	}, 200*time.Millisecond, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded := &getAssetResponse{}
+	err = json.NewDecoder(response.Body).Decode(downloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = http.Get(downloaded.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expectedContent, string(content))
+	return downloaded
+}
+
+func doRequest(t *testing.T, method string, url string, contentType string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(echo.HeaderContentType, contentType)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
@@ -0,0 +1,91 @@
+package endpoints
+
+import (
+	"github.com/labstack/echo"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// APIKeyHeader is the header identifying the tenant of a request.
+const APIKeyHeader = "X-Api-Key"
+
+// Tenant is what the requests of a tenant are served with, its bucket and the storage, manager and notifier of its assets.
+type Tenant struct {
+	ID       string
+	Bucket   string
+	Storage  assets.Storage
+	Manager  assets.AssetManager
+	Notifier *assets.WebhookNotifier
+}
+
+// TenantRouter resolves the tenant of every request by its api key.
+type TenantRouter struct {
+	tenants map[string]*Tenant
+	// added are the tenants in the order they were added.
+	added []*Tenant
+	// single serves every request, without api key, when there is only one tenant.
+	single *Tenant
+}
+
+// NewTenantRouter creates a TenantRouter without tenants, which are added with their api keys.
+func NewTenantRouter() *TenantRouter {
+	return &TenantRouter{tenants: make(map[string]*Tenant)}
+}
+
+// NewSingleTenantRouter creates a TenantRouter serving every request with the given tenant, as no api key is required.
+func NewSingleTenantRouter(tenant *Tenant) *TenantRouter {
+	return &TenantRouter{tenants: make(map[string]*Tenant), single: tenant}
+}
+
+// Add serves the requests with any of the given api keys with the tenant, which is added once.
+func (r *TenantRouter) Add(tenant *Tenant, apiKeys ...string) {
+	r.added = append(r.added, tenant)
+	for _, apiKey := range apiKeys {
+		r.tenants[apiKey] = tenant
+	}
+}
+
+// Tenants returns the tenants served.
+func (r *TenantRouter) Tenants() []*Tenant {
+	if r.single != nil {
+		return []*Tenant{r.single}
+	}
+	return r.added
+}
+
+func (r *TenantRouter) resolve(c echo.Context) (*Tenant, error) {
+	if r.single != nil {
+		return r.single, nil
+	}
+	apiKey := c.Request().Header.Get(APIKeyHeader)
+	if apiKey == "" {
+		return nil, auerr.FError(auerr.ErrorUnauthorized, "Header %s is required", APIKeyHeader)
+	}
+	tenant, ok := r.tenants[apiKey]
+	if !ok {
+		return nil, auerr.SError(auerr.ErrorUnauthorized, "Api key is unknown")
+	}
+	return tenant, nil
+}
+
+// assetEndpoint serves a request with the endpoint of the manager and bucket of its tenant.
+func (r *TenantRouter) assetEndpoint(newEndpoint func(assets.AssetManager, string) func(c echo.Context) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		tenant, err := r.resolve(c)
+		if err != nil {
+			return err
+		}
+		return newEndpoint(tenant.Manager, tenant.Bucket)(c)
+	}
+}
+
+// webhookEndpoint serves a request with the endpoint of the notifier of its tenant.
+func (r *TenantRouter) webhookEndpoint(newEndpoint func(*assets.WebhookNotifier) func(c echo.Context) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		tenant, err := r.resolve(c)
+		if err != nil {
+			return err
+		}
+		return newEndpoint(tenant.Notifier)(c)
+	}
+}
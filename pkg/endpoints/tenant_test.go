@@ -0,0 +1,111 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/job"
+	"github.com/tgracchus/assetuploader/pkg/schedule"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = AssetUploaderHTTPErrorHandler
+	server := httptest.NewServer(e)
+	defer server.Close()
+	root, err := ioutil.TempDir("", "localstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	baseURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := assets.NewLocalStorage(root, baseURL, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both tenants share the bucket, kept apart by their prefixes
+	tenants := NewTenantRouter()
+	for _, id := range []string{"a", "b"} {
+		upsert, query := job.NewMemoryStore(job.MillisKeys)
+		scheduler := schedule.NewSimpleScheduler(upsert, query, 100*time.Millisecond)
+		tenantStorage := assets.NewPrefixedStorage(storage, id)
+		manager := assets.NewAssetManager(tenantStorage, scheduler, time.Second)
+		tenants.Add(&Tenant{ID: id, Bucket: "shared", Storage: tenantStorage, Manager: manager}, "key-"+id)
+	}
+	RegisterAssetsEndpoints(e, tenants)
+	RegisterLocalStorageEndpoints(e, storage)
+
+	response := tenantRequest(t, http.MethodPost, server.URL+"/asset", "", "")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	response = tenantRequest(t, http.MethodPost, server.URL+"/asset", "unknown", "")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	response = tenantRequest(t, http.MethodPost, server.URL+"/asset", "key-a", "")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	created := &postAssetResponse{}
+	err = json.NewDecoder(response.Body).Decode(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = doRequest(t, http.MethodPut, created.UploadURL, "", strings.NewReader("CONTENT"))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	response = tenantRequest(t, http.MethodPut, server.URL+"/asset/"+created.AssetID, "key-a", `{"Status":"uploaded"}`)
+	assert.Equal(t, http.StatusAccepted, response.StatusCode)
+	response = tenantRequest(t, http.MethodGet, server.URL+"/asset/"+created.AssetID+"?wait=5s", "key-a", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	object, err := storage.Get(context.Background(), "shared", "a/uploaded/"+created.AssetID, assets.Encryption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	content, err := ioutil.ReadAll(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "CONTENT", string(content))
+
+	// The other tenant neither finds nor lists the asset
+	response = tenantRequest(t, http.MethodGet, server.URL+"/asset/"+created.AssetID, "key-b", "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	response = tenantRequest(t, http.MethodDelete, server.URL+"/asset/"+created.AssetID, "key-b", "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	response = tenantRequest(t, http.MethodGet, server.URL+"/assets", "key-b", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	page := &listAssetsResponse{}
+	err = json.NewDecoder(response.Body).Decode(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, page.Assets)
+}
+
+func tenantRequest(t *testing.T, method string, url string, apiKey string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	if apiKey != "" {
+		req.Header.Set(APIKeyHeader, apiKey)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
@@ -0,0 +1,205 @@
+package endpoints
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+// TusPath is where the resumable uploads are created, following the tus protocol https://tus.io/protocols/resumable-upload.html
+const TusPath = "/uploads"
+
+const tusVersion = "1.0.0"
+const tusExtensions = "creation,expiration,termination"
+const tusContentType = "application/offset+octet-stream"
+
+const tusResumableHeader = "Tus-Resumable"
+const tusVersionHeader = "Tus-Version"
+const tusExtensionHeader = "Tus-Extension"
+const tusMaxSizeHeader = "Tus-Max-Size"
+const uploadLengthHeader = "Upload-Length"
+const uploadOffsetHeader = "Upload-Offset"
+const uploadMetadataHeader = "Upload-Metadata"
+const uploadExpiresHeader = "Upload-Expires"
+const cacheControlHeader = "Cache-Control"
+
+// RegisterTusEndpoints register to echo engine the endpoints uploading assets by chunks with the tus protocol.
+// maxSize is the maximum size in bytes of an upload, advertised in Tus-Max-Size, 0 means no limit.
+func RegisterTusEndpoints(e *echo.Echo, tenants *TenantRouter, maxSize int64) {
+	e.OPTIONS(TusPath, newTusOptionsEndpoint(maxSize))
+	e.POST(TusPath, tenants.assetEndpoint(newTusCreateEndpoint(maxSize)), tusResumable)
+	e.HEAD(TusPath+"/:"+assetIDParam, tenants.assetEndpoint(newTusHeadEndpoint), tusResumable)
+	e.PATCH(TusPath+"/:"+assetIDParam, tenants.assetEndpoint(newTusPatchEndpoint), tusResumable)
+	e.DELETE(TusPath+"/:"+assetIDParam, tenants.assetEndpoint(newTusDeleteEndpoint), tusResumable)
+}
+
+// tusResumable rejects the requests of other protocol versions, and adds the version to every response.
+func tusResumable(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(tusResumableHeader, tusVersion)
+		if c.Request().Header.Get(tusResumableHeader) != tusVersion {
+			c.Response().Header().Set(tusVersionHeader, tusVersion)
+			return c.NoContent(http.StatusPreconditionFailed)
+		}
+		return next(c)
+	}
+}
+
+func newTusOptionsEndpoint(maxSize int64) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(tusResumableHeader, tusVersion)
+		c.Response().Header().Set(tusVersionHeader, tusVersion)
+		c.Response().Header().Set(tusExtensionHeader, tusExtensions)
+		if maxSize > 0 {
+			c.Response().Header().Set(tusMaxSizeHeader, strconv.FormatInt(maxSize, 10))
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// newTusCreateEndpoint creates uploads of Upload-Length bytes up to maxSize, an empty one is uploaded once created.
+func newTusCreateEndpoint(maxSize int64) func(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+		return func(c echo.Context) error {
+			length, err := strconv.ParseInt(c.Request().Header.Get(uploadLengthHeader), 10, 64)
+			if err != nil || length < 0 {
+				return auerr.FError(auerr.ErrorBadInput, "Upload length should be a positive number, not %s", c.Request().Header.Get(uploadLengthHeader))
+			}
+			if maxSize > 0 && length > maxSize {
+				return c.NoContent(http.StatusRequestEntityTooLarge)
+			}
+			metadata, err := parseUploadMetadata(c.Request().Header.Get(uploadMetadataHeader))
+			if err != nil {
+				return err
+			}
+			// Checked before the upload is created, so an invalid one does not leave it behind
+			err = assets.CheckMetadata(metadata)
+			if err != nil {
+				return err
+			}
+			assetID := uuid.New()
+			constraints := assets.PutConstraints{ContentType: metadata.ContentType, ContentLength: length}
+			progress, err := assetManager.CreateResumableUpload(c.Request().Context(), bucket, assetID, constraints)
+			if err != nil {
+				return err
+			}
+			if metadata.Filename != "" || metadata.ContentType != "" {
+				err := assetManager.PutMetadata(c.Request().Context(), bucket, assetID, metadata)
+				if err != nil {
+					return err
+				}
+			}
+			c.Response().Header().Set(echo.HeaderLocation, TusPath+"/"+assetID.String())
+			setUploadExpires(c, progress)
+			return c.NoContent(http.StatusCreated)
+		}
+	}
+}
+
+// parseUploadMetadata reads the filename and filetype of the comma separated, base64 encoded, key value pairs.
+// Other keys are ignored.
+func parseUploadMetadata(header string) (assets.Metadata, error) {
+	metadata := assets.Metadata{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return metadata, auerr.FError(auerr.ErrorBadInput, "Upload metadata %s should be a key and a base64 encoded value", pair)
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return metadata, auerr.FError(auerr.ErrorBadInput, "Upload metadata %s value should be base64 encoded", fields[0])
+			}
+			value = string(decoded)
+		}
+		switch fields[0] {
+		case "filename":
+			metadata.Filename = value
+		case "filetype":
+			metadata.ContentType = value
+		}
+	}
+	return metadata, nil
+}
+
+func newTusHeadEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorNotFound, err)
+		}
+		progress, err := assetManager.Progress(c.Request().Context(), bucket, assetID)
+		if err != nil {
+			return err
+		}
+		// The offset changes with every chunk
+		c.Response().Header().Set(cacheControlHeader, "no-store")
+		c.Response().Header().Set(uploadLengthHeader, strconv.FormatInt(progress.Length, 10))
+		setUploadOffset(c, progress)
+		setUploadExpires(c, progress)
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+func newTusPatchEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorNotFound, err)
+		}
+		if c.Request().Header.Get(echo.HeaderContentType) != tusContentType {
+			return c.NoContent(http.StatusUnsupportedMediaType)
+		}
+		offset, err := strconv.ParseInt(c.Request().Header.Get(uploadOffsetHeader), 10, 64)
+		if err != nil || offset < 0 {
+			return auerr.FError(auerr.ErrorBadInput, "Upload offset should be a positive number, not %s", c.Request().Header.Get(uploadOffsetHeader))
+		}
+		progress, err := assetManager.WriteChunk(c.Request().Context(), bucket, assetID, offset, c.Request().Body)
+		if err != nil {
+			return err
+		}
+		setUploadOffset(c, progress)
+		setUploadExpires(c, progress)
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func newTusDeleteEndpoint(assetManager assets.AssetManager, bucket string) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		assetID, err := uuid.Parse(c.Param(assetIDParam))
+		if err != nil {
+			return auerr.CError(auerr.ErrorNotFound, err)
+		}
+		// Only resumable uploads can be terminated here
+		_, err = assetManager.Progress(c.Request().Context(), bucket, assetID)
+		if err != nil {
+			return err
+		}
+		err = assetManager.Delete(c.Request().Context(), bucket, assetID)
+		if err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func setUploadOffset(c echo.Context, progress *assets.UploadProgress) {
+	c.Response().Header().Set(uploadOffsetHeader, strconv.FormatInt(progress.Offset, 10))
+}
+
+// setUploadExpires sets when the upload expires, once complete it does not.
+func setUploadExpires(c echo.Context, progress *assets.UploadProgress) {
+	if progress.Offset < progress.Length {
+		c.Response().Header().Set(uploadExpiresHeader, progress.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
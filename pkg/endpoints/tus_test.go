@@ -0,0 +1,176 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/job"
+	"github.com/tgracchus/assetuploader/pkg/schedule"
+)
+
+func TestTusFlow(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = AssetUploaderHTTPErrorHandler
+	server := httptest.NewServer(e)
+	defer server.Close()
+	baseURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := ioutil.TempDir("", "localstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	storage, err := assets.NewLocalStorage(root, baseURL, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The immediate scheduler would abort the upload right away
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	scheduler := schedule.NewSimpleScheduler(upsert, query, 100*time.Millisecond)
+	// Parts of 4 bytes, so the chunks fill some and leave others pending
+	manager := assets.NewAssetManager(storage, scheduler, time.Second, assets.WithResumablePartSize(4))
+	tenants := NewSingleTenantRouter(&Tenant{ID: "test", Bucket: "testBucket", Manager: manager})
+	RegisterAssetsEndpoints(e, tenants)
+	RegisterTusEndpoints(e, tenants, 20)
+	RegisterLocalStorageEndpoints(e, storage)
+
+	response := tusRequest(t, http.MethodOptions, server.URL+TusPath, nil, nil)
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	assert.Equal(t, "1.0.0", response.Header.Get(tusVersionHeader))
+	assert.Equal(t, "creation,expiration,termination", response.Header.Get(tusExtensionHeader))
+	assert.Equal(t, "20", response.Header.Get(tusMaxSizeHeader))
+
+	// Other protocol versions are rejected
+	response = doRequest(t, http.MethodPost, server.URL+TusPath, "", nil)
+	assert.Equal(t, http.StatusPreconditionFailed, response.StatusCode)
+	response = tusRequest(t, http.MethodPost, server.URL+TusPath, map[string]string{uploadLengthHeader: "unknown"}, nil)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response = tusRequest(t, http.MethodPost, server.URL+TusPath, map[string]string{uploadLengthHeader: "21"}, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+	// Invalid metadata does not leave an upload behind
+	longName := "filename " + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 1025)))
+	response = tusRequest(t, http.MethodPost, server.URL+TusPath, map[string]string{uploadLengthHeader: "10", uploadMetadataHeader: longName}, nil)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	page, err := manager.List(context.Background(), "testBucket", assets.ListFilter{}, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, page.Assets)
+
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("cat.txt")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain"))
+	response = tusRequest(t, http.MethodPost, server.URL+TusPath, map[string]string{uploadLengthHeader: "10", uploadMetadataHeader: metadata}, nil)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	assert.Equal(t, "1.0.0", response.Header.Get(tusResumableHeader))
+	assert.NotEmpty(t, response.Header.Get(uploadExpiresHeader))
+	location := response.Header.Get(echo.HeaderLocation)
+	if !strings.HasPrefix(location, TusPath+"/") {
+		t.Fatalf("Location should be under %s, not %s", TusPath, location)
+	}
+	uploadURL := server.URL + location
+
+	response = tusRequest(t, http.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "0", response.Header.Get(uploadOffsetHeader))
+	assert.Equal(t, "10", response.Header.Get(uploadLengthHeader))
+	assert.Equal(t, "no-store", response.Header.Get(cacheControlHeader))
+
+	patch := func(offset string, chunk string) *http.Response {
+		headers := map[string]string{echo.HeaderContentType: tusContentType, uploadOffsetHeader: offset}
+		return tusRequest(t, http.MethodPatch, uploadURL, headers, strings.NewReader(chunk))
+	}
+	// A whole part
+	response = patch("0", "CONT")
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	assert.Equal(t, "4", response.Header.Get(uploadOffsetHeader))
+	response = patch("0", "CONT")
+	assert.Equal(t, http.StatusConflict, response.StatusCode)
+	// Less than a part, kept pending
+	response = patch("4", "EN")
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	assert.Equal(t, "6", response.Header.Get(uploadOffsetHeader))
+	response = tusRequest(t, http.MethodPatch, uploadURL, map[string]string{uploadOffsetHeader: "6"}, strings.NewReader("T!!!"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.StatusCode)
+	response = tusRequest(t, http.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, "6", response.Header.Get(uploadOffsetHeader))
+
+	// The last chunk completes the upload, which is promoted
+	response = patch("6", "T!!!")
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	assert.Equal(t, "10", response.Header.Get(uploadOffsetHeader))
+	assert.Empty(t, response.Header.Get(uploadExpiresHeader))
+	assetID := strings.TrimPrefix(location, TusPath+"/")
+	response, err = http.Get(server.URL + "/asset/" + assetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	downloaded := &getAssetResponse{}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(downloaded))
+	assert.Equal(t, "cat.txt", downloaded.Metadata.Filename)
+	response, err = http.Get(downloaded.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "CONTENT!!!", string(content))
+	response = tusRequest(t, http.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, "10", response.Header.Get(uploadOffsetHeader))
+
+	// Terminated uploads are gone
+	response = tusRequest(t, http.MethodPost, server.URL+TusPath, map[string]string{uploadLengthHeader: "10"}, nil)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	uploadURL = server.URL + response.Header.Get(echo.HeaderLocation)
+	response = tusRequest(t, http.MethodDelete, uploadURL, nil, nil)
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response = tusRequest(t, http.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	// An empty upload is complete once created
+	response = tusRequest(t, http.MethodPost, server.URL+TusPath, map[string]string{uploadLengthHeader: "0"}, nil)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	assert.Empty(t, response.Header.Get(uploadExpiresHeader))
+	location = response.Header.Get(echo.HeaderLocation)
+	response = tusRequest(t, http.MethodHead, server.URL+location, nil, nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "0", response.Header.Get(uploadOffsetHeader))
+	assert.Equal(t, "0", response.Header.Get(uploadLengthHeader))
+	response, err = http.Get(server.URL + "/asset/" + strings.TrimPrefix(location, TusPath+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func tusRequest(t *testing.T, method string, url string, headers map[string]string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(tusResumableHeader, tusVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
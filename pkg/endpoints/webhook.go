@@ -0,0 +1,138 @@
+package endpoints
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/auerr"
+)
+
+const webhookIDParam = "webhookID"
+
+// RegisterWebhookEndpoints register to echo engine the endpoints managing the webhooks of the tenant of every request.
+func RegisterWebhookEndpoints(e *echo.Echo, tenants *TenantRouter) {
+	e.POST("/webhooks", tenants.webhookEndpoint(newPostWebhookEndpoint))
+	e.GET("/webhooks", tenants.webhookEndpoint(newListWebhooksEndpoint))
+	e.DELETE("/webhooks/:"+webhookIDParam, tenants.webhookEndpoint(newDeleteWebhookEndpoint))
+	e.GET("/webhooks/:"+webhookIDParam+"/deliveries", tenants.webhookEndpoint(newListDeliveriesEndpoint))
+}
+
+func newPostWebhookEndpoint(notifier *assets.WebhookNotifier) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		body := new(postWebhookBody)
+		err := c.Bind(body)
+		if err != nil {
+			return auerr.CError(auerr.ErrorBadInput, err)
+		}
+		events := make([]assets.EventType, 0, len(body.Events))
+		for _, event := range body.Events {
+			events = append(events, assets.EventType(event))
+		}
+		webhook, err := notifier.Register(c.Request().Context(), body.URL, body.Secret, events)
+		if err != nil {
+			return err
+		}
+		// The secret is only returned once, when registered
+		response := newWebhookResponse(webhook)
+		response.Secret = webhook.Secret
+		return c.JSON(http.StatusCreated, response)
+	}
+}
+
+type postWebhookBody struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+type webhookResponse struct {
+	WebhookID string   `json:"id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"`
+	Events    []string `json:"events,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+func newWebhookResponse(webhook *assets.Webhook) *webhookResponse {
+	response := &webhookResponse{WebhookID: webhook.ID, URL: webhook.URL, CreatedAt: webhook.CreatedAt.Format(time.RFC3339)}
+	for _, event := range webhook.Events {
+		response.Events = append(response.Events, string(event))
+	}
+	return response
+}
+
+func newListWebhooksEndpoint(notifier *assets.WebhookNotifier) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		webhooks := notifier.Webhooks(c.Request().Context())
+		response := &listWebhooksResponse{Webhooks: make([]*webhookResponse, 0, len(webhooks))}
+		for i := range webhooks {
+			response.Webhooks = append(response.Webhooks, newWebhookResponse(&webhooks[i]))
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+type listWebhooksResponse struct {
+	Webhooks []*webhookResponse `json:"webhooks"`
+}
+
+func newDeleteWebhookEndpoint(notifier *assets.WebhookNotifier) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		err := notifier.Unregister(c.Request().Context(), c.Param(webhookIDParam))
+		if err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func newListDeliveriesEndpoint(notifier *assets.WebhookNotifier) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		status := assets.DeliveryStatus(c.QueryParam(statusQueryParam))
+		switch status {
+		case "", assets.DeliveryPending, assets.DeliveryDelivered, assets.DeliveryFailed:
+		default:
+			return auerr.FError(auerr.ErrorBadInput, "Status should be pending, delivered or failed, not %s", status)
+		}
+		deliveries, err := notifier.Deliveries(c.Request().Context(), c.Param(webhookIDParam), status)
+		if err != nil {
+			return err
+		}
+		response := &listDeliveriesResponse{Deliveries: make([]*deliveryResponse, 0, len(deliveries))}
+		for _, delivery := range deliveries {
+			deliveryResponse := &deliveryResponse{
+				DeliveryID: delivery.ID,
+				Event:      string(delivery.Notification.Event),
+				AssetID:    delivery.Notification.AssetID,
+				Status:     string(delivery.Status),
+				Attempts:   delivery.Attempts,
+				LastError:  delivery.LastError,
+				CreatedAt:  delivery.CreatedAt.Format(time.RFC3339),
+				UpdatedAt:  delivery.UpdatedAt.Format(time.RFC3339),
+			}
+			if !delivery.NextAttempt.IsZero() {
+				deliveryResponse.NextAttempt = delivery.NextAttempt.Format(time.RFC3339)
+			}
+			response.Deliveries = append(response.Deliveries, deliveryResponse)
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+type listDeliveriesResponse struct {
+	Deliveries []*deliveryResponse `json:"deliveries"`
+}
+
+type deliveryResponse struct {
+	DeliveryID  string `json:"id"`
+	Event       string `json:"event"`
+	AssetID     string `json:"asset_id"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	NextAttempt string `json:"next_attempt,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
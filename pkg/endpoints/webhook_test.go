@@ -0,0 +1,95 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/tgracchus/assetuploader/pkg/assets"
+	"github.com/tgracchus/assetuploader/pkg/schedule"
+	"github.com/tgracchus/assetuploader/pkg/util"
+)
+
+func TestWebhookEndpoints(t *testing.T) {
+	// The webhook target always fails, so the deliveries end up failed
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+	notifier := assets.NewWebhookNotifier(schedule.NewImmediateScheduler(), assets.WithDeliveryAttempts(2), assets.WithAllowedHosts("127.0.0.1"))
+	e := echo.New()
+	e.HTTPErrorHandler = AssetUploaderHTTPErrorHandler
+	RegisterWebhookEndpoints(e, NewSingleTenantRouter(&Tenant{ID: "test", Notifier: notifier}))
+	server := httptest.NewServer(e)
+	defer server.Close()
+	post := func(body *postWebhookBody) *http.Response {
+		content, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doRequest(t, http.MethodPost, server.URL+"/webhooks", echo.MIMEApplicationJSON, bytes.NewReader(content))
+	}
+
+	response := post(&postWebhookBody{URL: "not an url"})
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response = post(&postWebhookBody{URL: target.URL, Events: []string{"urls_issued"}})
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response = post(&postWebhookBody{URL: target.URL, Events: []string{"promotion_failed"}})
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	registered := &webhookResponse{}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(registered))
+	assert.NotEmpty(t, registered.Secret)
+	assert.Equal(t, []string{"promotion_failed"}, registered.Events)
+
+	// The secret is not listed
+	response = doRequest(t, http.MethodGet, server.URL+"/webhooks", "", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	listed := &listWebhooksResponse{}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(listed))
+	registered.Secret = ""
+	assert.Equal(t, &listWebhooksResponse{Webhooks: []*webhookResponse{registered}}, listed)
+
+	notifier.Notify(context.Background(), assets.Notification{Event: assets.EventPromotionFailed, AssetID: "asset"})
+	// Attempted by the workers of the notifier, so it fails a bit later
+	err := util.WaitUntilWithContext(context.Background(), func(ctx context.Context) error {
+		failed, err := notifier.Deliveries(ctx, registered.WebhookID, assets.DeliveryFailed)
+		if err != nil {
+			return err
+		}
+		if len(failed) == 0 {
+			return errors.New("Delivery is not failed yet")
+		}
+		return nil
+	}, 10*time.Millisecond, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = doRequest(t, http.MethodGet, server.URL+"/webhooks/"+registered.WebhookID+"/deliveries?status=failed", "", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	deliveries := &listDeliveriesResponse{}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(deliveries))
+	if assert.Len(t, deliveries.Deliveries, 1) {
+		delivery := deliveries.Deliveries[0]
+		assert.Equal(t, "promotion_failed", delivery.Event)
+		assert.Equal(t, "asset", delivery.AssetID)
+		assert.Equal(t, "failed", delivery.Status)
+		assert.Equal(t, 2, delivery.Attempts)
+		assert.Contains(t, delivery.LastError, "503")
+	}
+	response = doRequest(t, http.MethodGet, server.URL+"/webhooks/"+registered.WebhookID+"/deliveries?status=unknown", "", nil)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response = doRequest(t, http.MethodDelete, server.URL+"/webhooks/"+registered.WebhookID, "", nil)
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response = doRequest(t, http.MethodDelete, server.URL+"/webhooks/"+registered.WebhookID, "", nil)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	response = doRequest(t, http.MethodGet, server.URL+"/webhooks/"+registered.WebhookID+"/deliveries", "", nil)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
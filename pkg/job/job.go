@@ -34,6 +34,9 @@ const ExecutingStatus Status = "executing"
 // CompletedStatus is the status of a completed job.
 const CompletedStatus Status = "completed"
 
+// CancelledStatus is the status of a job cancelled before being executed.
+const CancelledStatus Status = "cancelled"
+
 // IsNew if the job has the status New.
 func (j *Job) IsNew() bool {
 	return j.Status == NewStatus
@@ -54,6 +57,11 @@ func (j *Job) IsError() bool {
 	return j.Status == ErrorStatus
 }
 
+// IsCancelled if the job has the status Cancelled.
+func (j *Job) IsCancelled() bool {
+	return j.Status == CancelledStatus
+}
+
 // Completed sets the Completed status to a new copy of the job.
 func (j *Job) Completed() Job {
 	return j.copy(CompletedStatus, "Job was complete succesfully")
@@ -69,6 +77,11 @@ func (j *Job) Executing() Job {
 	return j.copy(ExecutingStatus, "Job is being executed")
 }
 
+// Cancelled sets the Cancelled status to a new copy of the job.
+func (j *Job) Cancelled() Job {
+	return j.copy(CancelledStatus, "Job was cancelled")
+}
+
 func (j *Job) copy(status Status, statusMsg string) Job {
 	return Job{
 		ID:            j.ID,
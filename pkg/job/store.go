@@ -7,7 +7,11 @@ import (
 	"github.com/tgracchus/assetuploader/pkg/auerr"
 )
 
+// finishedJobsRetention is how long after their execution date the finished jobs are kept, before being evicted.
+const finishedJobsRetention = time.Hour
+
 // NewMemoryStore instantiates a new store in memory storage.
+// The completed, errored and cancelled jobs are evicted once older than an hour, so it does not grow forever.
 func NewMemoryStore(bucketKeyFunc BucketKeyFunc) (chan Job, chan StoreQuery) {
 	upSert := make(chan Job, 1000)
 	queries := make(chan StoreQuery, 1000)
@@ -26,6 +30,7 @@ func NewMemoryStore(bucketKeyFunc BucketKeyFunc) (chan Job, chan StoreQuery) {
 				if !ok {
 					queries = nil
 				}
+				jobs.evictFinished(time.Now().Add(-finishedJobsRetention))
 				jobs := jobs.findBucketsBefore(query)
 				select {
 				case <-query.ctx.Done():
@@ -123,6 +128,29 @@ func (j *jobs) findBucketsBefore(query StoreQuery) []Job {
 	return jobs
 }
 
+// evictFinished removes the finished jobs of the buckets before date, and the buckets left empty.
+// The head bucket is always kept, so there is a bucket to start from.
+func (j *jobs) evictFinished(date time.Time) {
+	bucketKey := j.bucketKeyFunc(date)
+	var lastBucket *timeBucket
+	for bucket := j.headBucket; bucket != nil; bucket = bucket.previous {
+		if bucket.bucketKey >= bucketKey {
+			lastBucket = bucket
+			continue
+		}
+		for id, job := range bucket.Jobs {
+			if job.IsCompleted() || job.IsError() || job.IsCancelled() {
+				delete(bucket.Jobs, id)
+			}
+		}
+		if len(bucket.Jobs) == 0 && lastBucket != nil {
+			lastBucket.previous = bucket.previous
+			continue
+		}
+		lastBucket = bucket
+	}
+}
+
 func (j *jobs) findOrCreateBucket(bucketKey int64) *timeBucket {
 	bucket := j.headBucket
 	var lastBucket *timeBucket
@@ -134,10 +162,12 @@ func (j *jobs) findOrCreateBucket(bucketKey int64) *timeBucket {
 		//Bucket is newer than the current bucket, create it
 		if bucketKey > bucket.bucketKey {
 			newBucket := newTimeBucket(bucketKey, bucket)
-			newBucket.previous = bucket
-			//if previous bucket is nil it means we need to change the headBucket
+			//if previous bucket is nil it means we need to change the headBucket,
+			//otherwise the new bucket goes between the last bucket and the current one
 			if lastBucket == nil {
 				j.headBucket = &newBucket
+			} else {
+				lastBucket.previous = &newBucket
 			}
 			return &newBucket
 		}
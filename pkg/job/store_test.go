@@ -187,6 +187,79 @@ func TestAddJobPastInTime(t *testing.T) {
 	}
 }
 
+func TestAddJobBetweenBuckets(t *testing.T) {
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	now := time.Now()
+	ctx := context.Background()
+	futureJob := job.NewFixedDateJob(uuid.New().String(), testJobFunction, now.Add(time.Hour))
+	err := job.UpSert(ctx, upsert, *futureJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// This job bucket goes between the current bucket and the future one
+	nextJob := job.NewFixedDateJob(uuid.New().String(), testJobFunction, now.Add(time.Minute))
+	err = job.UpSert(ctx, upsert, *nextJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var foundJobs []job.Job
+	err = util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		foundJobs, err = job.GetBefore(ctx, query, now.Add(time.Minute), newStoreTestCriteria(nextJob.Status))
+		if err != nil {
+			return err
+		}
+		if len(foundJobs) != 1 {
+			return errors.New("Expected one job")
+		}
+		return nil
+	}, waitTime, jobTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foundJobs[0].ID != nextJob.ID {
+		t.Fatal("Expected job and actual job do not match")
+	}
+}
+
+func TestFinishedJobsAreEvicted(t *testing.T) {
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	now := time.Now()
+	oldDate := now.Add(-2 * time.Hour)
+	ctx := context.Background()
+	completedJob := job.NewFixedDateJob(uuid.New().String(), testJobFunction, oldDate)
+	erroredJob := job.NewFixedDateJob(uuid.New().String(), testJobFunction, oldDate)
+	cancelledJob := job.NewFixedDateJob(uuid.New().String(), testJobFunction, now.Add(-3*time.Hour))
+	pendingJob := job.NewFixedDateJob(uuid.New().String(), testJobFunction, oldDate)
+	for _, oldJob := range []job.Job{completedJob.Completed(), erroredJob.Error(errors.New("error")), cancelledJob.Cancelled(), *pendingJob} {
+		err := job.UpSert(ctx, upsert, oldJob)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the pending job is kept, the finished ones are older than their retention
+	var foundJobs []job.Job
+	err := util.WaitUntilWithContext(ctx, func(ctx context.Context) error {
+		var err error
+		foundJobs, err = job.GetBefore(ctx, query, now, func(job job.Job) bool {
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if len(foundJobs) != 1 {
+			return errors.New("Expected only the pending job")
+		}
+		return nil
+	}, waitTime, jobTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foundJobs[0].ID != pendingJob.ID {
+		t.Fatal("Expected job and actual job do not match")
+	}
+}
+
 func newStoreTestCriteria(status job.Status) func(job job.Job) bool {
 	return func(job job.Job) bool {
 		return job.Status == status
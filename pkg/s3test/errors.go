@@ -0,0 +1,183 @@
+package s3test
+
+import (
+	"encoding/xml"
+	"net/http"
+)
+
+// s3Error is an s3 error response.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+	status  int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var errAccessDenied = &s3Error{Code: "AccessDenied", Message: "Access Denied", status: http.StatusForbidden}
+var errExpired = &s3Error{Code: "AccessDenied", Message: "Request has expired", status: http.StatusForbidden}
+var errSignatureDoesNotMatch = &s3Error{
+	Code:    "SignatureDoesNotMatch",
+	Message: "The request signature we calculated does not match the signature you provided.",
+	status:  http.StatusForbidden,
+}
+var errInvalidAccessKeyID = &s3Error{
+	Code:    "InvalidAccessKeyId",
+	Message: "The AWS Access Key Id you provided does not exist in our records.",
+	status:  http.StatusForbidden,
+}
+var errAuthorizationHeaderMalformed = &s3Error{
+	Code:    "AuthorizationHeaderMalformed",
+	Message: "The authorization header is malformed; the region or service is wrong.",
+	status:  http.StatusBadRequest,
+}
+var errNoSuchBucket = &s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist", status: http.StatusNotFound}
+var errNoSuchKey = &s3Error{Code: "NoSuchKey", Message: "The specified key does not exist.", status: http.StatusNotFound}
+var errNoSuchUpload = &s3Error{
+	Code:    "NoSuchUpload",
+	Message: "The specified multipart upload does not exist.",
+	status:  http.StatusNotFound,
+}
+var errInvalidPart = &s3Error{Code: "InvalidPart", Message: "One or more of the specified parts could not be found.", status: http.StatusBadRequest}
+var errInvalidPartOrder = &s3Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order.", status: http.StatusBadRequest}
+var errMalformedXML = &s3Error{Code: "MalformedXML", Message: "The XML you provided was not well-formed.", status: http.StatusBadRequest}
+var errInvalidTag = &s3Error{Code: "InvalidTag", Message: "The tag provided was not a valid tag.", status: http.StatusBadRequest}
+var errBadDigest = &s3Error{
+	Code:    "BadDigest",
+	Message: "The Content-MD5 you specified did not match what we received.",
+	status:  http.StatusBadRequest,
+}
+var errContentSHA256Mismatch = &s3Error{
+	Code:    "XAmzContentSHA256Mismatch",
+	Message: "The provided 'x-amz-content-sha256' header does not match what was computed.",
+	status:  http.StatusBadRequest,
+}
+var errInvalidArgument = &s3Error{Code: "InvalidArgument", Message: "Invalid Argument", status: http.StatusBadRequest}
+var errInvalidEncryption = &s3Error{
+	Code:    "InvalidArgument",
+	Message: "The encryption parameters are not applicable to this object.",
+	status:  http.StatusBadRequest,
+}
+var errCustomerKeyMissing = &s3Error{
+	Code:    "InvalidRequest",
+	Message: "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.",
+	status:  http.StatusBadRequest,
+}
+var errInvalidStorageClass = &s3Error{
+	Code:    "InvalidStorageClass",
+	Message: "The storage class you specified is not valid",
+	status:  http.StatusBadRequest,
+}
+var errInvalidObjectState = &s3Error{
+	Code:    "InvalidObjectState",
+	Message: "The operation is not valid for the object's storage class",
+	status:  http.StatusForbidden,
+}
+var errRestoreAlreadyInProgress = &s3Error{
+	Code:    "RestoreAlreadyInProgress",
+	Message: "Object restore is already in progress",
+	status:  http.StatusConflict,
+}
+var errInvalidRange = &s3Error{
+	Code:    "InvalidRange",
+	Message: "The requested range is not satisfiable",
+	status:  http.StatusRequestedRangeNotSatisfiable,
+}
+var errNotImplemented = &s3Error{
+	Code:    "NotImplemented",
+	Message: "A header you provided implies functionality that is not implemented",
+	status:  http.StatusNotImplemented,
+}
+var errInternal = &s3Error{Code: "InternalError", Message: "We encountered an internal error. Please try again.", status: http.StatusInternalServerError}
+
+type locationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	KeyCount              int64          `xml:"KeyCount"`
+	MaxKeys               int64          `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []listedObject `xml:"Contents"`
+}
+
+type listedObject struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type tagging struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ Tagging"`
+	TagSet  []tag    `xml:"TagSet>Tag"`
+}
+
+// taggingRequest is a Tagging document without namespace, so any one is accepted.
+type taggingRequest struct {
+	TagSet []tag `xml:"TagSet>Tag"`
+}
+
+type tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+type copyPartResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyPartResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type listPartsResult struct {
+	XMLName     xml.Name     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket      string       `xml:"Bucket"`
+	Key         string       `xml:"Key"`
+	UploadID    string       `xml:"UploadId"`
+	IsTruncated bool         `xml:"IsTruncated"`
+	Parts       []listedPart `xml:"Part"`
+}
+
+type listedPart struct {
+	PartNumber int64  `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size"`
+}
+
+type completeMultipartUpload struct {
+	Parts []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int64  `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
@@ -0,0 +1,1063 @@
+// Package s3test provides an in process s3 stand-in, so s3 code can be tested without network.
+package s3test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+const amzDateFormat = "20060102T150405Z"
+
+// Server is a fake s3 server supporting the object operations used by the asset uploader.
+// Requests are path style and their signature is verified, including presigned urls and their expiration.
+type Server struct {
+	*httptest.Server
+	region      string
+	credentials *credentials.Credentials
+	signer      *v4.Signer
+	mutex       sync.Mutex
+	buckets     map[string]map[string]*object
+	uploads     map[string]*multipartUpload
+	// restoreDelay is how long the restore of an archived object takes.
+	restoreDelay time.Duration
+}
+
+type multipartUpload struct {
+	bucket       string
+	key          string
+	tags         map[string]string
+	contentType  string
+	encryption   Encryption
+	storageClass string
+	parts        map[int64]*object
+}
+
+type object struct {
+	body         []byte
+	tags         map[string]string
+	contentType  string
+	encryption   Encryption
+	etag         string
+	lastModified time.Time
+	// storageClass is empty for STANDARD, as s3 does not return it.
+	storageClass string
+	// restoreAt is when the requested restore of an archived object is done, zero if none was requested.
+	restoreAt time.Time
+}
+
+// Encryption is the server side encryption of an object. The customer key is only kept by its md5, as s3 does.
+type Encryption struct {
+	// Algorithm is AES256 or aws:kms when encrypted by s3, empty otherwise.
+	Algorithm string
+	KMSKeyID  string
+	// CustomerKeyMD5 is the base64 encoded md5 of the SSE-C key, empty if not encrypted with a customer key.
+	CustomerKeyMD5 string
+}
+
+const sseHeader = "X-Amz-Server-Side-Encryption"
+const sseKMSKeyIDHeader = "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"
+const sseCustomerHeader = "X-Amz-Server-Side-Encryption-Customer-"
+const copySourceSSECustomerHeader = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-"
+const storageClassHeader = "X-Amz-Storage-Class"
+const restoreHeader = "X-Amz-Restore"
+
+// storageClasses are the accepted storage classes, by whether they are archive ones.
+var storageClasses = map[string]bool{
+	"STANDARD":            false,
+	"STANDARD_IA":         false,
+	"ONEZONE_IA":          false,
+	"INTELLIGENT_TIERING": false,
+	"REDUCED_REDUNDANCY":  false,
+	"GLACIER":             true,
+	"DEEP_ARCHIVE":        true,
+}
+
+// NewServer starts a fake s3 server for the given region accepting requests signed with accessKey and secretKey.
+func NewServer(region string, accessKey string, secretKey string) *Server {
+	server := newServer(region, accessKey, secretKey)
+	server.Server = httptest.NewServer(server)
+	return server
+}
+
+// NewTLSServer starts a fake s3 server like NewServer, but over https since SSE-C keys are only sent over it.
+// Its clients should trust its certificate, as the http client of the server does.
+func NewTLSServer(region string, accessKey string, secretKey string) *Server {
+	server := newServer(region, accessKey, secretKey)
+	server.Server = httptest.NewTLSServer(server)
+	return server
+}
+
+func newServer(region string, accessKey string, secretKey string) *Server {
+	creds := credentials.NewStaticCredentials(accessKey, secretKey, "")
+	return &Server{
+		region:      region,
+		credentials: creds,
+		signer: v4.NewSigner(creds, func(s *v4.Signer) {
+			s.DisableURIPathEscaping = true
+		}),
+		buckets: make(map[string]map[string]*object),
+		uploads: make(map[string]*multipartUpload),
+	}
+}
+
+// CreateBucket creates an empty bucket.
+func (s *Server) CreateBucket(bucket string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string]*object)
+	}
+}
+
+// Object returns the content of the object under bucket and key, if it exists.
+func (s *Server) Object(bucket string, key string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	obj, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return obj.body, true
+}
+
+// ObjectEncryption returns the encryption of the object under bucket and key, if it exists.
+func (s *Server) ObjectEncryption(bucket string, key string) (Encryption, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	obj, ok := s.buckets[bucket][key]
+	if !ok {
+		return Encryption{}, false
+	}
+	return obj.encryption, true
+}
+
+// SetRestoreDelay sets how long the restore of an archived object takes, none by default.
+func (s *Server) SetRestoreDelay(delay time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.restoreDelay = delay
+}
+
+// ObjectStorageClass returns the storage class of the object under bucket and key, if it exists. STANDARD is empty.
+func (s *Server) ObjectStorageClass(bucket string, key string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	obj, ok := s.buckets[bucket][key]
+	if !ok {
+		return "", false
+	}
+	return obj.storageClass, true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := s.verify(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	bucket, key := splitPath(r.URL.Path)
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet && has(query, "location"):
+		s.getBucketLocation(w, bucket)
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.listObjects(w, bucket, query)
+	case key == "":
+		writeError(w, errNotImplemented)
+	case r.Method == http.MethodPost && has(query, "uploads"):
+		s.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPut && has(query, "uploadId"):
+		s.uploadPart(w, r, bucket, key, query)
+	case r.Method == http.MethodGet && has(query, "uploadId"):
+		s.listParts(w, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodPost && has(query, "uploadId"):
+		s.completeMultipartUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodPost && has(query, "restore"):
+		s.restoreObject(w, bucket, key)
+	case r.Method == http.MethodDelete && has(query, "uploadId"):
+		s.abortMultipartUpload(w, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut && has(query, "tagging"):
+		s.putObjectTagging(w, r, bucket, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyObject(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, bucket, key)
+	case r.Method == http.MethodGet && has(query, "tagging"):
+		s.getObjectTagging(w, bucket, key)
+	case r.Method == http.MethodGet:
+		s.getObject(w, r, bucket, key)
+	case r.Method == http.MethodHead:
+		s.headObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		s.deleteObject(w, bucket, key)
+	default:
+		writeError(w, errNotImplemented)
+	}
+}
+
+func (s *Server) getBucketLocation(w http.ResponseWriter, bucket string) {
+	s.mutex.Lock()
+	_, ok := s.buckets[bucket]
+	s.mutex.Unlock()
+	if !ok {
+		writeError(w, errNoSuchBucket)
+		return
+	}
+	writeXML(w, http.StatusOK, &locationConstraint{Location: s.region})
+}
+
+// listObjects lists the keys in lexicographical order, the continuation token is the last listed key.
+func (s *Server) listObjects(w http.ResponseWriter, bucket string, query url.Values) {
+	maxKeys := int64(1000)
+	if query.Get("max-keys") != "" {
+		var err error
+		maxKeys, err = strconv.ParseInt(query.Get("max-keys"), 10, 64)
+		if err != nil || maxKeys < 0 {
+			writeError(w, errInvalidArgument)
+			return
+		}
+	}
+	prefix := query.Get("prefix")
+	startAfter := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		startAfter = token
+	}
+	s.mutex.Lock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		s.mutex.Unlock()
+		writeError(w, errNoSuchBucket)
+		return
+	}
+	keys := make([]string, 0)
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > startAfter {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := &listBucketResult{Name: bucket, Prefix: prefix, MaxKeys: maxKeys, StartAfter: query.Get("start-after")}
+	for _, key := range keys {
+		if int64(len(result.Contents)) == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[len(result.Contents)-1].Key
+			break
+		}
+		obj := objects[key]
+		result.Contents = append(result.Contents, listedObject{
+			Key:          key,
+			LastModified: obj.lastModified.Format(time.RFC3339),
+			ETag:         obj.etag,
+			Size:         int64(len(obj.body)),
+		})
+	}
+	s.mutex.Unlock()
+	result.KeyCount = int64(len(result.Contents))
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	tags, err := url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+	if err != nil {
+		writeError(w, errInvalidTag)
+		return
+	}
+	encryption, err := requestEncryption(r.Header)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	storageClass, err := requestStorageClass(r.Header)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	obj := &object{
+		body:         body,
+		tags:         flatten(tags),
+		contentType:  r.Header.Get("Content-Type"),
+		encryption:   encryption,
+		etag:         etag(body, encryption),
+		lastModified: time.Now().UTC(),
+		storageClass: storageClass,
+	}
+	err = s.store(bucket, key, obj)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", obj.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	tags, err := url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+	if err != nil {
+		writeError(w, errInvalidTag)
+		return
+	}
+	encryption, err := requestEncryption(r.Header)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	storageClass, err := requestStorageClass(r.Header)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		writeError(w, errNoSuchBucket)
+		return
+	}
+	uploadID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	s.uploads[uploadID] = &multipartUpload{
+		bucket:       bucket,
+		key:          key,
+		tags:         flatten(tags),
+		contentType:  r.Header.Get("Content-Type"),
+		encryption:   encryption,
+		storageClass: storageClass,
+		parts:        make(map[int64]*object),
+	}
+	writeXML(w, http.StatusOK, &initiateMultipartUploadResult{Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, bucket string, key string, query url.Values) {
+	partNumber, err := strconv.ParseInt(query.Get("partNumber"), 10, 64)
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		writeError(w, errInvalidArgument)
+		return
+	}
+	upload, err := s.upload(bucket, key, query.Get("uploadId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Every part is encrypted with the customer key of the upload
+	err = checkCustomerKey(upload.encryption, r.Header, sseCustomerHeader)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var body []byte
+	copySource := r.Header.Get("X-Amz-Copy-Source")
+	if copySource != "" {
+		body, err = s.copySourceRange(copySource, r.Header.Get("X-Amz-Copy-Source-Range"), r.Header)
+	} else {
+		body, err = readBody(r)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	part := &object{body: body, etag: etag(body, upload.encryption), lastModified: time.Now().UTC()}
+	s.mutex.Lock()
+	upload.parts[partNumber] = part
+	s.mutex.Unlock()
+	if copySource != "" {
+		writeXML(w, http.StatusOK, &copyPartResult{ETag: part.etag, LastModified: part.lastModified.Format(time.RFC3339)})
+		return
+	}
+	w.Header().Set("ETag", part.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) copySourceRange(copySource string, copyRange string, header http.Header) ([]byte, error) {
+	source, err := url.PathUnescape(copySource)
+	if err != nil {
+		return nil, errInvalidArgument
+	}
+	src, err := s.load(splitPath(source))
+	if err != nil {
+		return nil, err
+	}
+	err = checkCustomerKey(src.encryption, header, copySourceSSECustomerHeader)
+	if err != nil {
+		return nil, err
+	}
+	if !src.readable(time.Now()) {
+		return nil, errInvalidObjectState
+	}
+	if copyRange == "" {
+		return src.body, nil
+	}
+	var start, end int
+	_, err = fmt.Sscanf(copyRange, "bytes=%d-%d", &start, &end)
+	if err != nil || start > end || end >= len(src.body) {
+		return nil, errInvalidArgument
+	}
+	return src.body[start : end+1], nil
+}
+
+func (s *Server) listParts(w http.ResponseWriter, bucket string, key string, uploadID string) {
+	upload, err := s.upload(bucket, key, uploadID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	result := &listPartsResult{Bucket: bucket, Key: key, UploadID: uploadID}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, partNumber := range partNumbers(upload) {
+		part := upload.parts[partNumber]
+		result.Parts = append(result.Parts, listedPart{PartNumber: partNumber, ETag: part.etag, Size: int64(len(part.body))})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string, uploadID string) {
+	upload, err := s.upload(bucket, key, uploadID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	request := &completeMultipartUpload{}
+	err = xml.NewDecoder(r.Body).Decode(request)
+	if err != nil || len(request.Parts) == 0 {
+		writeError(w, errMalformedXML)
+		return
+	}
+	s.mutex.Lock()
+	body, err := assemble(upload, request.Parts)
+	s.mutex.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	obj := &object{
+		body:         body,
+		tags:         upload.tags,
+		contentType:  upload.contentType,
+		encryption:   upload.encryption,
+		etag:         etag(body, upload.encryption),
+		lastModified: time.Now().UTC(),
+		storageClass: upload.storageClass,
+	}
+	err = s.store(bucket, key, obj)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.mutex.Lock()
+	delete(s.uploads, uploadID)
+	s.mutex.Unlock()
+	writeXML(w, http.StatusOK, &completeMultipartUploadResult{Bucket: bucket, Key: key, ETag: obj.etag})
+}
+
+func assemble(upload *multipartUpload, completedParts []completedPart) ([]byte, error) {
+	body := make([]byte, 0)
+	lastPartNumber := int64(0)
+	for _, completed := range completedParts {
+		part, ok := upload.parts[completed.PartNumber]
+		if !ok || part.etag != completed.ETag {
+			return nil, errInvalidPart
+		}
+		if completed.PartNumber <= lastPartNumber {
+			return nil, errInvalidPartOrder
+		}
+		lastPartNumber = completed.PartNumber
+		body = append(body, part.body...)
+	}
+	return body, nil
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, bucket string, key string, uploadID string) {
+	_, err := s.upload(bucket, key, uploadID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.mutex.Lock()
+	delete(s.uploads, uploadID)
+	s.mutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Uploads returns the number of multipart uploads in progress.
+func (s *Server) Uploads() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.uploads)
+}
+
+func (s *Server) upload(bucket string, key string, uploadID string) (*multipartUpload, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	upload, ok := s.uploads[uploadID]
+	if !ok || upload.bucket != bucket || upload.key != key {
+		return nil, errNoSuchUpload
+	}
+	return upload, nil
+}
+
+func partNumbers(upload *multipartUpload) []int64 {
+	numbers := make([]int64, 0, len(upload.parts))
+	for partNumber := range upload.parts {
+		numbers = append(numbers, partNumber)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, errInvalidArgument)
+		return
+	}
+	srcBucket, srcKey := splitPath(source)
+	src, err := s.load(srcBucket, srcKey)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = checkCustomerKey(src.encryption, r.Header, copySourceSSECustomerHeader)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !src.readable(time.Now()) {
+		writeError(w, errInvalidObjectState)
+		return
+	}
+	// The copy is not encrypted nor stored as the source, but as requested
+	encryption, err := requestEncryption(r.Header)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	storageClass, err := requestStorageClass(r.Header)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	tags := src.tags
+	switch directive := r.Header.Get("X-Amz-Tagging-Directive"); directive {
+	case "", "COPY":
+	case "REPLACE":
+		replaced, err := url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+		if err != nil {
+			writeError(w, errInvalidTag)
+			return
+		}
+		tags = flatten(replaced)
+	default:
+		writeError(w, errInvalidArgument)
+		return
+	}
+	obj := &object{
+		body:         src.body,
+		tags:         tags,
+		contentType:  src.contentType,
+		encryption:   encryption,
+		etag:         etag(src.body, encryption),
+		lastModified: time.Now().UTC(),
+		storageClass: storageClass,
+	}
+	err = s.store(bucket, key, obj)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeXML(w, http.StatusOK, &copyObjectResult{ETag: obj.etag, LastModified: obj.lastModified.Format(time.RFC3339)})
+}
+
+func (s *Server) putObjectTagging(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	request := &taggingRequest{}
+	err := xml.NewDecoder(r.Body).Decode(request)
+	if err != nil {
+		writeError(w, errMalformedXML)
+		return
+	}
+	tags := make(map[string]string, len(request.TagSet))
+	for _, tag := range request.TagSet {
+		tags[tag.Key] = tag.Value
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, errNoSuchBucket)
+		return
+	}
+	obj, ok := objects[key]
+	if !ok {
+		writeError(w, errNoSuchKey)
+		return
+	}
+	// Objects are replaced instead of modified, so loaded ones can be read without the lock
+	tagged := *obj
+	tagged.tags = tags
+	objects[key] = &tagged
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getObjectTagging(w http.ResponseWriter, bucket string, key string) {
+	obj, err := s.load(bucket, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	keys := make([]string, 0, len(obj.tags))
+	for k := range obj.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tagging := &tagging{}
+	for _, k := range keys {
+		tagging.TagSet = append(tagging.TagSet, tag{Key: k, Value: obj.tags[k]})
+	}
+	writeXML(w, http.StatusOK, tagging)
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	obj, err := s.load(bucket, key)
+	if err == nil {
+		err = checkCustomerKey(obj.encryption, r.Header, sseCustomerHeader)
+	}
+	if err == nil && !obj.readable(time.Now()) {
+		err = errInvalidObjectState
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeHeaders(w, obj)
+	byteRange := r.Header.Get("Range")
+	if byteRange == "" {
+		w.WriteHeader(http.StatusOK)
+		w.Write(obj.body)
+		return
+	}
+	start, end, err := parseRange(byteRange, int64(len(obj.body)))
+	if err != nil {
+		w.Header().Del("Content-Length")
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.body)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(obj.body[start : end+1])
+}
+
+// parseRange returns the first and last byte of a single bytes=start-end or bytes=start- range, the end is capped to the size.
+func parseRange(byteRange string, size int64) (int64, int64, error) {
+	bounds := strings.SplitN(strings.TrimPrefix(byteRange, "bytes="), "-", 2)
+	if len(bounds) != 2 || !strings.HasPrefix(byteRange, "bytes=") {
+		return 0, 0, errInvalidRange
+	}
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, errInvalidRange
+	}
+	end := size - 1
+	if bounds[1] != "" {
+		end, err = strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errInvalidRange
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, nil
+}
+
+func (s *Server) headObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	obj, err := s.load(bucket, key)
+	if err == nil {
+		err = checkCustomerKey(obj.encryption, r.Header, sseCustomerHeader)
+	}
+	if err != nil {
+		w.WriteHeader(err.(*s3Error).status)
+		return
+	}
+	writeHeaders(w, obj)
+	w.WriteHeader(http.StatusOK)
+}
+
+// restoreObject starts the restore of an archived object, which is done after the restore delay.
+func (s *Server) restoreObject(w http.ResponseWriter, bucket string, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, errNoSuchBucket)
+		return
+	}
+	obj, ok := objects[key]
+	if !ok {
+		writeError(w, errNoSuchKey)
+		return
+	}
+	now := time.Now()
+	switch {
+	case !storageClasses[obj.storageClass]:
+		writeError(w, errInvalidObjectState)
+	case obj.restoreAt.IsZero():
+		// Objects are replaced instead of modified, so loaded ones can be read without the lock
+		restoring := *obj
+		restoring.restoreAt = now.Add(s.restoreDelay)
+		objects[key] = &restoring
+		w.WriteHeader(http.StatusAccepted)
+	case now.Before(obj.restoreAt):
+		writeError(w, errRestoreAlreadyInProgress)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, bucket string, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, errNoSuchBucket)
+		return
+	}
+	delete(objects, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) store(bucket string, key string, obj *object) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		return errNoSuchBucket
+	}
+	objects[key] = obj
+	return nil
+}
+
+func (s *Server) load(bucket string, key string) (*object, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		return nil, errNoSuchBucket
+	}
+	obj, ok := objects[key]
+	if !ok {
+		return nil, errNoSuchKey
+	}
+	return obj, nil
+}
+
+// verify checks the v4 signature of the request, either in the Authorization header or presigned in the query.
+func (s *Server) verify(r *http.Request) error {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Signature") != "" {
+		return s.verifyPresigned(r, query)
+	}
+	return s.verifyHeader(r)
+}
+
+func (s *Server) verifyPresigned(r *http.Request, query url.Values) error {
+	signTime, err := time.Parse(amzDateFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return errAccessDenied
+	}
+	expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil {
+		return errAccessDenied
+	}
+	if time.Now().After(signTime.Add(time.Duration(expires) * time.Second)) {
+		return errExpired
+	}
+	err = s.checkCredential(query.Get("X-Amz-Credential"))
+	if err != nil {
+		return err
+	}
+	signature := query.Get("X-Amz-Signature")
+	unsigned := url.Values{}
+	for k, v := range query {
+		switch k {
+		case "X-Amz-Signature", "X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-Expires", "X-Amz-SignedHeaders":
+		default:
+			unsigned[k] = v
+		}
+	}
+	req, err := s.unsignedRequest(r, unsigned, strings.Split(query.Get("X-Amz-SignedHeaders"), ";"))
+	if err != nil {
+		return err
+	}
+	_, err = s.signer.Presign(req, nil, "s3", s.region, time.Duration(expires)*time.Second, signTime)
+	if err != nil {
+		return errAccessDenied
+	}
+	if req.URL.Query().Get("X-Amz-Signature") != signature {
+		return errSignatureDoesNotMatch
+	}
+	return nil
+}
+
+func (s *Server) verifyHeader(r *http.Request) error {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") {
+		return errAccessDenied
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	err := s.checkCredential(fields["Credential"])
+	if err != nil {
+		return err
+	}
+	signTime, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return errAccessDenied
+	}
+	req, err := s.unsignedRequest(r, r.URL.Query(), strings.Split(fields["SignedHeaders"], ";"))
+	if err != nil {
+		return err
+	}
+	_, err = s.signer.Sign(req, nil, "s3", s.region, signTime)
+	if err != nil {
+		return errAccessDenied
+	}
+	if !strings.HasSuffix(req.Header.Get("Authorization"), "Signature="+fields["Signature"]) {
+		return errSignatureDoesNotMatch
+	}
+	return nil
+}
+
+func (s *Server) checkCredential(credential string) error {
+	creds, err := s.credentials.Get()
+	if err != nil {
+		return errInternal
+	}
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] != creds.AccessKeyID {
+		return errInvalidAccessKeyID
+	}
+	if parts[2] != s.region || parts[3] != "s3" {
+		return errAuthorizationHeaderMalformed
+	}
+	return nil
+}
+
+// unsignedRequest rebuilds the request with the given query and only the signed headers, so it can be signed again.
+func (s *Server) unsignedRequest(r *http.Request, query url.Values, signedHeaders []string) (*http.Request, error) {
+	u := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: query.Encode()}
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		return nil, errInvalidArgument
+	}
+	req.Host = r.Host
+	for _, header := range signedHeaders {
+		switch header {
+		case "host", "":
+		case "content-length":
+			req.Header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		default:
+			req.Header[http.CanonicalHeaderKey(header)] = r.Header[http.CanonicalHeaderKey(header)]
+		}
+	}
+	return req, nil
+}
+
+// readBody reads the request body checking it against the Content-MD5 and X-Amz-Content-Sha256 headers.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errInternal
+	}
+	if contentMD5 := r.Header.Get("Content-MD5"); contentMD5 != "" {
+		hash := md5.Sum(body)
+		if contentMD5 != base64.StdEncoding.EncodeToString(hash[:]) {
+			return nil, errBadDigest
+		}
+	}
+	contentSHA256 := r.Header.Get("X-Amz-Content-Sha256")
+	if contentSHA256 != "" && contentSHA256 != "UNSIGNED-PAYLOAD" && !strings.HasPrefix(contentSHA256, "STREAMING-") {
+		hash := sha256.Sum256(body)
+		if contentSHA256 != hex.EncodeToString(hash[:]) {
+			return nil, errContentSHA256Mismatch
+		}
+	}
+	return body, nil
+}
+
+func splitPath(path string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func has(query url.Values, key string) bool {
+	_, ok := query[key]
+	return ok
+}
+
+func flatten(values url.Values) map[string]string {
+	flat := make(map[string]string, len(values))
+	for k := range values {
+		flat[k] = values.Get(k)
+	}
+	return flat
+}
+
+// requestStorageClass returns the storage class of the request headers, empty for STANDARD.
+func requestStorageClass(header http.Header) (string, error) {
+	storageClass := header.Get(storageClassHeader)
+	if _, ok := storageClasses[storageClass]; storageClass != "" && !ok {
+		return "", errInvalidStorageClass
+	}
+	if storageClass == "STANDARD" {
+		return "", nil
+	}
+	return storageClass, nil
+}
+
+// readable tells if the object can be read, it is not archived or its restore is done.
+func (o *object) readable(now time.Time) bool {
+	return !storageClasses[o.storageClass] || (!o.restoreAt.IsZero() && !now.Before(o.restoreAt))
+}
+
+// etag is the md5 of the body, except for kms or customer key encryption whose etag is not.
+func etag(body []byte, encryption Encryption) string {
+	hash := md5.Sum(body)
+	if encryption.Algorithm == "aws:kms" || encryption.CustomerKeyMD5 != "" {
+		hash = md5.Sum(append([]byte(encryption.KMSKeyID+encryption.CustomerKeyMD5), hash[:]...))
+	}
+	return `"` + hex.EncodeToString(hash[:]) + `"`
+}
+
+// requestEncryption returns the encryption requested for a written object.
+func requestEncryption(header http.Header) (Encryption, error) {
+	encryption := Encryption{Algorithm: header.Get(sseHeader), KMSKeyID: header.Get(sseKMSKeyIDHeader)}
+	switch encryption.Algorithm {
+	case "", "AES256":
+		if encryption.KMSKeyID != "" {
+			return encryption, errInvalidEncryption
+		}
+	case "aws:kms":
+	default:
+		return encryption, errInvalidEncryption
+	}
+	keyMD5, err := customerKeyMD5(header, sseCustomerHeader)
+	if err != nil {
+		return encryption, err
+	}
+	if keyMD5 != "" && encryption.Algorithm != "" {
+		return encryption, errInvalidEncryption
+	}
+	encryption.CustomerKeyMD5 = keyMD5
+	return encryption, nil
+}
+
+// customerKeyMD5 returns the md5 of the SSE-C key sent in the headers with the given prefix, once checked, empty if none is sent.
+func customerKeyMD5(header http.Header, prefix string) (string, error) {
+	algorithm, encodedKey, keyMD5 := header.Get(prefix+"Algorithm"), header.Get(prefix+"Key"), header.Get(prefix+"Key-Md5")
+	if algorithm == "" && encodedKey == "" && keyMD5 == "" {
+		return "", nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if algorithm != "AES256" || err != nil || len(key) != 32 {
+		return "", errInvalidEncryption
+	}
+	hash := md5.Sum(key)
+	if keyMD5 != base64.StdEncoding.EncodeToString(hash[:]) {
+		return "", errInvalidEncryption
+	}
+	return keyMD5, nil
+}
+
+// checkCustomerKey checks the SSE-C key sent in the headers with the given prefix is the one the object was encrypted with.
+func checkCustomerKey(encryption Encryption, header http.Header, prefix string) error {
+	keyMD5, err := customerKeyMD5(header, prefix)
+	if err != nil {
+		return err
+	}
+	switch {
+	case encryption.CustomerKeyMD5 == "" && keyMD5 != "":
+		return errInvalidEncryption
+	case encryption.CustomerKeyMD5 != "" && keyMD5 == "":
+		return errCustomerKeyMissing
+	case encryption.CustomerKeyMD5 != keyMD5:
+		return errAccessDenied
+	}
+	return nil
+}
+
+func writeHeaders(w http.ResponseWriter, obj *object) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+	if obj.contentType != "" {
+		w.Header().Set("Content-Type", obj.contentType)
+	}
+	w.Header().Set("ETag", obj.etag)
+	w.Header().Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+	if obj.encryption.Algorithm != "" {
+		w.Header().Set(sseHeader, obj.encryption.Algorithm)
+	}
+	if obj.encryption.KMSKeyID != "" {
+		w.Header().Set(sseKMSKeyIDHeader, obj.encryption.KMSKeyID)
+	}
+	if obj.encryption.CustomerKeyMD5 != "" {
+		w.Header().Set(sseCustomerHeader+"Algorithm", "AES256")
+		w.Header().Set(sseCustomerHeader+"Key-Md5", obj.encryption.CustomerKeyMD5)
+	}
+	if obj.storageClass != "" {
+		w.Header().Set(storageClassHeader, obj.storageClass)
+	}
+	if !obj.restoreAt.IsZero() {
+		if time.Now().Before(obj.restoreAt) {
+			w.Header().Set(restoreHeader, `ongoing-request="true"`)
+		} else {
+			expiry := obj.restoreAt.Add(24 * time.Hour).UTC().Format(http.TimeFormat)
+			w.Header().Set(restoreHeader, `ongoing-request="false", expiry-date="`+expiry+`"`)
+		}
+	}
+}
+
+func writeXML(w http.ResponseWriter, status int, body interface{}) {
+	content, err := xml.Marshal(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(content)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	s3Err, ok := err.(*s3Error)
+	if !ok {
+		s3Err = errInternal
+	}
+	writeXML(w, s3Err.status, s3Err)
+}
@@ -0,0 +1,313 @@
+package s3test_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/tgracchus/assetuploader/pkg/s3test"
+)
+
+const region = "eu-west-1"
+const bucket = "testBucket"
+
+func newTestClient(server *s3test.Server, secretKey string) *s3.S3 {
+	sess := session.Must(session.NewSession(
+		aws.NewConfig().
+			WithCredentials(credentials.NewStaticCredentials("accessKey", secretKey, "")).
+			WithRegion(region).
+			WithEndpoint(server.URL).
+			WithS3ForcePathStyle(true).
+			WithMaxRetries(0),
+	))
+	// The client of the server trusts its certificate, it is set on the client since a session may override its transport
+	return s3.New(sess, aws.NewConfig().WithHTTPClient(server.Client()))
+}
+
+func TestPresignedPut(t *testing.T) {
+	server := s3test.NewServer(region, "accessKey", "secretKey")
+	defer server.Close()
+	server.CreateBucket(bucket)
+	svc := newTestClient(server, "secretKey")
+	t.Run("TestValid", func(t *testing.T) {
+		req, _ := svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String("temp/asset")})
+		putURL, err := req.Presign(time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPutStatus(t, putURL, http.StatusOK)
+		body, ok := server.Object(bucket, "temp/asset")
+		if !ok || string(body) != "CONTENT" {
+			t.Fatalf("Object should be CONTENT, not %s", string(body))
+		}
+	})
+	t.Run("TestExpired", func(t *testing.T) {
+		req, _ := svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String("temp/expired")})
+		putURL, err := req.Presign(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Second)
+		assertPutStatus(t, putURL, http.StatusForbidden)
+	})
+	t.Run("TestTampered", func(t *testing.T) {
+		req, _ := svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String("temp/asset")})
+		putURL, err := req.Presign(time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPutStatus(t, strings.Replace(putURL, "temp/asset", "uploaded/asset", 1), http.StatusForbidden)
+		assertPutStatus(t, strings.Replace(putURL, "X-Amz-Expires=60", "X-Amz-Expires=600", 1), http.StatusForbidden)
+	})
+}
+
+func TestSignedRequests(t *testing.T) {
+	server := s3test.NewServer(region, "accessKey", "secretKey")
+	defer server.Close()
+	server.CreateBucket(bucket)
+	svc := newTestClient(server, "secretKey")
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String("temp/asset"),
+		Body:    strings.NewReader("CONTENT"),
+		Tagging: aws.String("status=new"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:           aws.String(bucket),
+		CopySource:       aws.String(bucket + "/temp/asset"),
+		Key:              aws.String("uploaded/asset"),
+		Tagging:          aws.String("status=uploaded"),
+		TaggingDirective: aws.String(s3.TaggingDirectiveReplace),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagging, err := svc.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: aws.String(bucket), Key: aws.String("uploaded/asset")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagging.TagSet) != 1 || aws.StringValue(tagging.TagSet[0].Value) != "uploaded" {
+		t.Fatalf("Tags should be status=uploaded, not %v", tagging.TagSet)
+	}
+	location, err := svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(location.LocationConstraint) != region {
+		t.Fatalf("Location should be %s, not %s", region, aws.StringValue(location.LocationConstraint))
+	}
+	_, err = svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String("otherBucket")})
+	if err == nil {
+		t.Fatal("We expected an error for a missing bucket")
+	}
+	_, err = newTestClient(server, "wrongSecret").GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		t.Fatal("We expected an error for a wrong secret")
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	server := s3test.NewTLSServer(region, "accessKey", "secretKey")
+	defer server.Close()
+	server.CreateBucket(bucket)
+	svc := newTestClient(server, "secretKey")
+	key := strings.Repeat("k", 32)
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String("temp/asset"),
+		Body:                 strings.NewReader("CONTENT"),
+		SSECustomerAlgorithm: aws.String("AES256"),
+		SSECustomerKey:       aws.String(key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("TestCustomerKey", func(t *testing.T) {
+		_, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("temp/asset")})
+		assertErrorCode(t, err, http.StatusBadRequest)
+		_, err = svc.GetObject(&s3.GetObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String("temp/asset"),
+			SSECustomerAlgorithm: aws.String("AES256"),
+			SSECustomerKey:       aws.String(strings.Repeat("w", 32)),
+		})
+		assertErrorCode(t, err, http.StatusForbidden)
+		object, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String("temp/asset"),
+			SSECustomerAlgorithm: aws.String("AES256"),
+			SSECustomerKey:       aws.String(key),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		object.Body.Close()
+		if aws.StringValue(object.SSECustomerAlgorithm) != "AES256" {
+			t.Fatalf("Customer algorithm should be AES256, not %s", aws.StringValue(object.SSECustomerAlgorithm))
+		}
+	})
+	t.Run("TestCopyWithKMS", func(t *testing.T) {
+		_, err := svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:                         aws.String(bucket),
+			CopySource:                     aws.String(bucket + "/temp/asset"),
+			Key:                            aws.String("uploaded/asset"),
+			ServerSideEncryption:           aws.String(s3.ServerSideEncryptionAwsKms),
+			SSEKMSKeyId:                    aws.String("kmsKey"),
+			CopySourceSSECustomerAlgorithm: aws.String("AES256"),
+			CopySourceSSECustomerKey:       aws.String(key),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encryption, ok := server.ObjectEncryption(bucket, "uploaded/asset")
+		expected := s3test.Encryption{Algorithm: s3.ServerSideEncryptionAwsKms, KMSKeyID: "kmsKey"}
+		if !ok || encryption != expected {
+			t.Fatalf("Encryption should be %v, not %v", expected, encryption)
+		}
+		head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("uploaded/asset")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aws.StringValue(head.SSEKMSKeyId) != "kmsKey" {
+			t.Fatalf("KMS key should be kmsKey, not %s", aws.StringValue(head.SSEKMSKeyId))
+		}
+	})
+	t.Run("TestCopyWithoutSourceKey", func(t *testing.T) {
+		_, err := svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			CopySource: aws.String(bucket + "/temp/asset"),
+			Key:        aws.String("uploaded/other"),
+		})
+		assertErrorCode(t, err, http.StatusBadRequest)
+	})
+}
+
+func TestArchiveAndRestore(t *testing.T) {
+	server := s3test.NewServer(region, "accessKey", "secretKey")
+	defer server.Close()
+	server.CreateBucket(bucket)
+	server.SetRestoreDelay(time.Second)
+	svc := newTestClient(server, "secretKey")
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String("uploaded/asset"),
+		Body:         strings.NewReader("CONTENT"),
+		StorageClass: aws.String(s3.StorageClassGlacier),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String("uploaded/other"),
+		Body:         strings.NewReader("CONTENT"),
+		StorageClass: aws.String("COLD"),
+	})
+	assertErrorCode(t, err, http.StatusBadRequest)
+	input := &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String("uploaded/asset")}
+	_, err = svc.GetObject(input)
+	assertErrorCode(t, err, http.StatusForbidden)
+	restore := &s3.RestoreObjectInput{
+		Bucket:         aws.String(bucket),
+		Key:            aws.String("uploaded/asset"),
+		RestoreRequest: &s3.RestoreRequest{Days: aws.Int64(1)},
+	}
+	_, err = svc.RestoreObject(restore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.RestoreObject(restore)
+	assertErrorCode(t, err, http.StatusConflict)
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("uploaded/asset")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(head.StorageClass) != s3.StorageClassGlacier || !strings.Contains(aws.StringValue(head.Restore), `ongoing-request="true"`) {
+		t.Fatalf("Object should be restoring from GLACIER, not %s %s", aws.StringValue(head.StorageClass), aws.StringValue(head.Restore))
+	}
+	time.Sleep(time.Second)
+	object, err := svc.GetObject(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object.Body.Close()
+	// Copied in place, the object is out of the archive
+	_, err = svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:       aws.String(bucket),
+		CopySource:   aws.String(bucket + "/uploaded/asset"),
+		Key:          aws.String("uploaded/asset"),
+		StorageClass: aws.String(s3.StorageClassStandardIa),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageClass, ok := server.ObjectStorageClass(bucket, "uploaded/asset")
+	if !ok || storageClass != s3.StorageClassStandardIa {
+		t.Fatalf("Storage class should be %s, not %s", s3.StorageClassStandardIa, storageClass)
+	}
+	_, err = svc.RestoreObject(restore)
+	assertErrorCode(t, err, http.StatusForbidden)
+}
+
+func TestGetRange(t *testing.T) {
+	server := s3test.NewServer(region, "accessKey", "secretKey")
+	defer server.Close()
+	server.CreateBucket(bucket)
+	svc := newTestClient(server, "secretKey")
+	_, err := svc.PutObject(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String("asset"), Body: strings.NewReader("CONTENT")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for byteRange, expected := range map[string]string{"bytes=1-3": "ONT", "bytes=4-": "ENT", "bytes=5-100": "NT"} {
+		result, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String("asset"), Range: aws.String(byteRange)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(result.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expected {
+			t.Fatalf("Range %s should be %s, not %s", byteRange, expected, body)
+		}
+		if !strings.HasSuffix(aws.StringValue(result.ContentRange), "/7") {
+			t.Fatalf("Content range of %s should end with the size, not %s", byteRange, aws.StringValue(result.ContentRange))
+		}
+	}
+	_, err = svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String("asset"), Range: aws.String("bytes=7-")})
+	assertErrorCode(t, err, http.StatusRequestedRangeNotSatisfiable)
+}
+
+func assertErrorCode(t *testing.T, err error, status int) {
+	failure, ok := err.(awserr.RequestFailure)
+	if !ok {
+		t.Fatalf("We expected a request failure, not %v", err)
+	}
+	if failure.StatusCode() != status {
+		t.Fatalf("Status should be %d, not %d", status, failure.StatusCode())
+	}
+}
+
+func assertPutStatus(t *testing.T, putURL string, status int) {
+	req, err := http.NewRequest(http.MethodPut, putURL, strings.NewReader("CONTENT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != status {
+		t.Fatalf("Put status should be %d, not %d", status, response.StatusCode)
+	}
+}
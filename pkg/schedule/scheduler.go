@@ -11,6 +11,8 @@ import (
 // SimpleScheduler is an scheduler for jobs.
 type SimpleScheduler interface {
 	Schedule(ctx context.Context, job job.Job) error
+	// Cancel marks a scheduled job, found by its ID and execution date, as cancelled so it is not executed.
+	Cancel(ctx context.Context, job job.Job) error
 }
 
 type immediateScheduler struct {
@@ -24,6 +26,11 @@ func (s *immediateScheduler) Schedule(ctx context.Context, job job.Job) error {
 	return job.Function(ctx)
 }
 
+// Cancel does nothing, the jobs were already executed when scheduled.
+func (s *immediateScheduler) Cancel(ctx context.Context, job job.Job) error {
+	return nil
+}
+
 // NewSimpleScheduler is a scheduler looking for new jobs every tickPeriod
 func NewSimpleScheduler(
 	upsert chan job.Job, queries chan job.StoreQuery,
@@ -44,6 +51,10 @@ func (s *simpleScheduler) Schedule(ctx context.Context, scheduledJob job.Job) er
 	return job.UpSert(ctx, s.upsert, scheduledJob)
 }
 
+func (s *simpleScheduler) Cancel(ctx context.Context, cancelledJob job.Job) error {
+	return job.UpSert(ctx, s.upsert, cancelledJob.Cancelled())
+}
+
 func (s *simpleScheduler) executionLoop() {
 	ticker := time.NewTicker(s.tickPeriod)
 	go func() {
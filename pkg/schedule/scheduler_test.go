@@ -116,6 +116,32 @@ func TestExecutedOverduedJob(t *testing.T) {
 	}
 }
 
+func TestCancelledJobIsNotExecuted(t *testing.T) {
+	ctx := context.Background()
+	upsert, query := job.NewMemoryStore(job.MillisKeys)
+	simpleScheduler := schedule.NewSimpleScheduler(upsert, query, tickPeriod)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	callback := newJobCallBack(&wg)
+	newJob := job.NewFixedDateJob(uuid.New().String(), callback, time.Now().Add(tickPeriod))
+	simpleScheduler.Schedule(ctx, *newJob)
+	err := simpleScheduler.Cancel(ctx, *newJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobExecuted := waitTimeout(&wg, jobTimeout)
+	if jobExecuted {
+		t.Fatal("We expect the job not to be executed")
+	}
+	jobs, err := job.GetBefore(ctx, query, time.Now(), newSchedulerTestCriteria(job.CancelledStatus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("We are expecting 1 job, not %d", len(jobs))
+	}
+}
+
 func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
 	c := make(chan struct{})
 	go func() {